@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"iter"
+	"time"
+)
+
+// ExpiringEntry is an [Entry] with its expiration time.
+type ExpiringEntry[K comparable, V any] struct {
+	Entry[K, V]
+	ExpiresAt time.Time
+}
+
+// SetMany inserts or updates the given entries like [ExpirationCache.SetFromTail],
+// but takes the lock only once for the whole batch.
+//
+// Entries are inserted in order, so if a key appears more than once, the last entry wins.
+func (c *ExpirationCache[K, V]) SetMany(entries []ExpiringEntry[K, V], now time.Time) {
+	if len(entries) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	for _, e := range entries {
+		node := c.getOrCreateNode(e.Key, e.Value, defaultCost, now, e.ExpiresAt)
+		c.insertFromTail(node)
+		c.wakeJanitor(node)
+	}
+	c.unlockAndNotify()
+}
+
+// GetMany looks up the given keys like [ExpirationCache.GetEntry], but takes the lock only once for the whole batch.
+// It appends the found entries to dst in the order of keys, and returns the extended slice.
+// Keys that do not exist or are expired are skipped.
+func (c *ExpirationCache[K, V]) GetMany(dst []Entry[K, V], keys []K, now time.Time) []Entry[K, V] {
+	if c.idleTimeout > 0 {
+		c.mu.Lock()
+		for _, key := range keys {
+			if node, ok := c.touchIdle(key, now); ok {
+				dst = append(dst, node.Entry)
+			}
+		}
+		c.mu.Unlock()
+		return dst
+	}
+
+	c.mu.RLock()
+	for _, key := range keys {
+		node, ok := c.nodeByKey[key]
+		if c.countLookup(node, ok, now) {
+			dst = append(dst, node.Entry)
+		}
+	}
+	c.mu.RUnlock()
+	return dst
+}
+
+// RemoveFunc removes all entries for which pred returns true, and returns the number of entries removed.
+// Expired entries are passed to pred too.
+//
+// pred is called with the write lock held, so it must not call methods on the cache.
+// OnEvict is called with [EvictionReasonRemoved] for each removed entry after the lock is released.
+func (c *ExpirationCache[K, V]) RemoveFunc(pred func(key K, value V) bool) int {
+	var n int
+	c.mu.Lock()
+	for _, node := range c.nodeByKey {
+		if pred(node.Key, node.Value) {
+			c.remove(node, EvictionReasonRemoved)
+			n++
+		}
+	}
+	c.unlockAndNotify()
+	return n
+}
+
+// PopExpired returns an iterator that removes the entries expired at now and yields them,
+// starting from the earliest expiration. Use it to release resources held by expired entries.
+//
+// Each entry is removed under its own short critical section, and yielded with the lock released,
+// so the caller may use the cache during iteration. Stopping early leaves the remaining expired entries in the cache.
+//
+// Ownership of popped entries passes to the caller: OnEvict is not called for them.
+func (c *ExpirationCache[K, V]) PopExpired(now time.Time) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for {
+			c.mu.Lock()
+			node := c.first()
+			if node == nil || node.expiresAt.After(now) {
+				c.mu.Unlock()
+				return
+			}
+			delete(c.nodeByKey, node.Key)
+			c.totalCost -= node.cost
+			c.detach(node)
+			c.mu.Unlock()
+			c.counters.expirations.Add(1)
+
+			if !yield(node.Key, node.Value) {
+				return
+			}
+		}
+	}
+}
+
+// RemoveFunc is like [ExpirationCache.RemoveFunc]. The shards are locked one after another.
+func (c *ShardedExpirationCache[K, V]) RemoveFunc(pred func(key K, value V) bool) int {
+	var n int
+	for _, s := range c.shards {
+		n += s.RemoveFunc(pred)
+	}
+	return n
+}
+
+// PopExpired is like [ExpirationCache.PopExpired], but pops the shards one after another,
+// so the entries are only ordered by expiration time within each shard.
+func (c *ShardedExpirationCache[K, V]) PopExpired(now time.Time) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		for _, s := range c.shards {
+			for key, value := range s.PopExpired(now) {
+				if !yield(key, value) {
+					return
+				}
+			}
+		}
+	}
+}
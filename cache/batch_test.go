@@ -0,0 +1,146 @@
+package cache_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+func TestExpirationCacheSetManyGetMany(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := o.new(3)
+			now := time.Now()
+			c.SetMany([]cache.ExpiringEntry[int, int]{
+				{cache.Entry[int, int]{Key: 1, Value: -1}, now.Add(3 * time.Second)},
+				{cache.Entry[int, int]{Key: 2, Value: -2}, now.Add(time.Second)},
+				{cache.Entry[int, int]{Key: 3, Value: -3}, now.Add(2 * time.Second)},
+				{cache.Entry[int, int]{Key: 2, Value: 2}, now.Add(4 * time.Second)},
+				{cache.Entry[int, int]{Key: 4, Value: -4}, now.Add(5 * time.Second)},
+			}, now)
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{1, -1}, {2, 2}, {4, -4}}, 3, now)
+
+			want := []cache.Entry[int, int]{{0, 0}, {4, -4}, {1, -1}, {2, 2}}
+			if got := c.GetMany([]cache.Entry[int, int]{{0, 0}}, []int{4, 3, 1, 2}, now); !slices.Equal(got, want) {
+				t.Errorf("c.GetMany() = %v, want %v", got, want)
+			}
+
+			now = now.Add(3 * time.Second)
+			want = []cache.Entry[int, int]{{2, 2}}
+			if got := c.GetMany(nil, []int{1, 2}, now); !slices.Equal(got, want) {
+				t.Errorf("c.GetMany() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestExpirationCacheRemoveFunc(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			var evicted []cache.Entry[int, int]
+			c := cache.ExpirationCacheConfig[int, int]{
+				Ordering: o.new(0).Ordering(),
+				OnEvict: func(entry cache.Entry[int, int], reason cache.EvictionReason) {
+					if reason != cache.EvictionReasonRemoved {
+						t.Errorf("OnEvict(%v) reason = %v, want %v", entry, reason, cache.EvictionReasonRemoved)
+					}
+					evicted = append(evicted, entry)
+				},
+			}.NewCache()
+
+			now := time.Now()
+			for key := range 10 {
+				c.SetFromTail(key, key%3, now, now.Add(time.Duration(key+1)*time.Second))
+			}
+
+			if got := c.RemoveFunc(func(_, value int) bool { return value == 0 }); got != 4 {
+				t.Errorf("c.RemoveFunc() = %d, want 4", got)
+			}
+			slices.SortFunc(evicted, func(a, b cache.Entry[int, int]) int { return a.Key - b.Key })
+			if want := []cache.Entry[int, int]{{0, 0}, {3, 0}, {6, 0}, {9, 0}}; !slices.Equal(evicted, want) {
+				t.Errorf("evicted = %v, want %v", evicted, want)
+			}
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{
+				{1, 1}, {2, 2}, {4, 1}, {5, 2}, {7, 1}, {8, 2},
+			}, c.Capacity(), now)
+
+			if got := c.RemoveFunc(func(int, int) bool { return false }); got != 0 {
+				t.Errorf("c.RemoveFunc() = %d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestExpirationCachePopExpired(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := cache.ExpirationCacheConfig[int, int]{
+				Ordering: o.new(0).Ordering(),
+				OnEvict: func(entry cache.Entry[int, int], reason cache.EvictionReason) {
+					t.Errorf("OnEvict(%v, %v) called for popped entry", entry, reason)
+				},
+			}.NewCache()
+
+			now := time.Now()
+			for key := range 5 {
+				c.SetFromTail(key, -key, now, now.Add(time.Duration(key+1)*time.Second))
+			}
+
+			now = now.Add(3 * time.Second)
+
+			// Stopping early leaves the remaining expired entries in the cache.
+			for key, value := range c.PopExpired(now) {
+				if key != 0 || value != 0 {
+					t.Errorf("first popped entry = %d, %d, want 0, 0", key, value)
+				}
+				break
+			}
+			if got := c.Len(); got != 4 {
+				t.Errorf("c.Len() = %d, want 4", got)
+			}
+
+			want := []cache.Entry[int, int]{{1, -1}, {2, -2}}
+			if got := slices.Collect(entries(c.PopExpired(now))); !slices.Equal(got, want) {
+				t.Errorf("c.PopExpired() = %v, want %v", got, want)
+			}
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{3, -3}, {4, -4}}, c.Capacity(), now)
+
+			if got := c.Stats().Expirations; got != 3 {
+				t.Errorf("c.Stats().Expirations = %d, want 3", got)
+			}
+		})
+	}
+}
+
+func TestShardedExpirationCacheRemoveFuncPopExpired(t *testing.T) {
+	c := cache.NewShardedExpirationCache[int, int](0, 4)
+	now := time.Now()
+	for key := range 100 {
+		c.SetFromTail(key, key, now, now.Add(time.Duration(key+1)*time.Second))
+	}
+
+	if got := c.RemoveFunc(func(key, _ int) bool { return key%2 == 0 }); got != 50 {
+		t.Errorf("c.RemoveFunc() = %d, want 50", got)
+	}
+
+	now = now.Add(50 * time.Second)
+	got := slices.Sorted(func(yield func(int) bool) {
+		for key := range c.PopExpired(now) {
+			if !yield(key) {
+				return
+			}
+		}
+	})
+	want := make([]int, 0, 25)
+	for key := 1; key < 50; key += 2 {
+		want = append(want, key)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("c.PopExpired() = %v, want %v", got, want)
+	}
+	if got := c.Len(); got != 25 {
+		t.Errorf("c.Len() = %d, want 25", got)
+	}
+}
@@ -3,6 +3,8 @@ package cache
 import (
 	"iter"
 	"math"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -17,33 +19,226 @@ type expirationNode[K comparable, V any] struct {
 	prev      *expirationNode[K, V]
 	next      *expirationNode[K, V]
 	expiresAt time.Time
+	// index is the node's position in the heap. It is only used with [HeapOrdering].
+	index int
+	// seq is the node's insertion sequence, which breaks expiration time ties in the heap.
+	// It is only used with [HeapOrdering].
+	seq uint64
+	// cost is the entry's share of the cache's cost budget.
+	cost int64
 	Entry[K, V]
 }
 
+// ExpirationOrdering is the data structure an [ExpirationCache] uses to keep its entries
+// ordered by expiration time.
+type ExpirationOrdering uint8
+
+const (
+	// ListOrdering keeps entries in a doubly linked list.
+	//
+	// Inserting an entry walks the list from one end to find the insertion point.
+	// This is O(1) when new expiration times are among the earliest or the latest in the cache,
+	// such as with a fixed TTL, but O(n) when they land in the middle of the list.
+	// Iterating over the entries is O(1) per entry and does not allocate.
+	ListOrdering ExpirationOrdering = iota
+
+	// HeapOrdering keeps entries in a binary min-heap.
+	//
+	// Inserting, updating, and removing an entry are O(log n) regardless of the expiration time,
+	// which makes it the better choice for large caches with jittered or widely varying TTLs.
+	// Iterating over the entries requires copying and sorting them first.
+	HeapOrdering
+)
+
+// String returns the string representation of the ordering.
+func (o ExpirationOrdering) String() string {
+	switch o {
+	case ListOrdering:
+		return "list"
+	case HeapOrdering:
+		return "heap"
+	default:
+		return "ExpirationOrdering(" + strconv.Itoa(int(o)) + ")"
+	}
+}
+
+// EvictionReason describes why an entry was removed from an [ExpirationCache].
+type EvictionReason uint8
+
+const (
+	// EvictionReasonExpired means the entry was pruned after its expiration time.
+	EvictionReasonExpired EvictionReason = iota
+
+	// EvictionReasonCapacity means the entry was evicted to make room for a new entry.
+	EvictionReasonCapacity
+
+	// EvictionReasonReplaced means the entry's value was overwritten by a set operation.
+	// The evicted entry carries the old value.
+	EvictionReasonReplaced
+
+	// EvictionReasonRemoved means the entry was explicitly removed.
+	EvictionReasonRemoved
+
+	// EvictionReasonCleared means the entry was removed by clearing the cache.
+	EvictionReasonCleared
+)
+
+// String returns the string representation of the eviction reason.
+func (r EvictionReason) String() string {
+	switch r {
+	case EvictionReasonExpired:
+		return "expired"
+	case EvictionReasonCapacity:
+		return "capacity"
+	case EvictionReasonReplaced:
+		return "replaced"
+	case EvictionReasonRemoved:
+		return "removed"
+	case EvictionReasonCleared:
+		return "cleared"
+	default:
+		return "EvictionReason(" + strconv.Itoa(int(r)) + ")"
+	}
+}
+
+// ExpirationCacheConfig is a set of options for an [*ExpirationCache].
+type ExpirationCacheConfig[K comparable, V any] struct {
+	// Capacity is the maximum number of entries the cache can hold.
+	// If not positive, the cache will be effectively unbounded.
+	Capacity int
+
+	// Ordering is the data structure used to order entries by expiration time.
+	// The default is [ListOrdering].
+	Ordering ExpirationOrdering
+
+	// OnEvict, if not nil, is called with each entry that leaves the cache, and the reason it left.
+	//
+	// OnEvict is called after the operation that evicted the entry has released the cache lock,
+	// so it may call back into the cache. Evictions are reported in the order they happened.
+	OnEvict func(entry Entry[K, V], reason EvictionReason)
+
+	// NegativeTTL, if positive, is how long [ExpirationCache.GetOrLoad] remembers loader errors.
+	// If not positive, loader errors are not cached.
+	NegativeTTL time.Duration
+
+	// MaxCost, if positive, is the total cost budget of the cache.
+	// Each entry carries a cost, set by [ExpirationCache.SetFromHeadWithCost] and [ExpirationCache.SetFromTailWithCost].
+	// Inserting an entry evicts the earliest-expiring entries until the new entry fits in the budget.
+	// A sharded cache splits the budget across its shards, see [ShardedExpirationCache.MaxEntryCost].
+	// If not positive, only Capacity limits the cache.
+	MaxCost int64
+
+	// Clock is the source of the current time for the methods that do not take it as a parameter,
+	// such as [ExpirationCache.GetNow] and [ExpirationCache.SetFromTailTTL], and for the janitor.
+	// The default is [SystemClock].
+	Clock Clock
+
+	// IdleTimeout, if positive, enables sliding expiration: each successful Get or GetEntry
+	// extends the entry's expiration time to at least now + IdleTimeout.
+	// Reads then take the write lock, because they move the entry toward the tail.
+	IdleTimeout time.Duration
+}
+
+// NewCache returns a new expiration cache with the config.
+func (cfg ExpirationCacheConfig[K, V]) NewCache() *ExpirationCache[K, V] {
+	capacity := cfg.Capacity
+	if capacity <= 0 {
+		capacity = math.MaxInt
+	}
+	clock := cfg.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+	c := ExpirationCache[K, V]{
+		nodeByKey:   make(map[K]*expirationNode[K, V]),
+		capacity:    capacity,
+		ordering:    cfg.Ordering,
+		maxCost:     cfg.MaxCost,
+		clock:       clock,
+		onEvict:     cfg.OnEvict,
+		idleTimeout: cfg.IdleTimeout,
+		janitorWake: make(chan struct{}, 1),
+	}
+	if cfg.NegativeTTL > 0 {
+		c.negative = ExpirationCacheConfig[K, error]{
+			Capacity: capacity,
+			Ordering: cfg.Ordering,
+		}.NewCache()
+		c.negativeTTL = cfg.NegativeTTL
+	}
+	return &c
+}
+
+// eviction is an entry evicted while the cache lock is held, pending a call to onEvict.
+type eviction[K comparable, V any] struct {
+	entry  Entry[K, V]
+	reason EvictionReason
+}
+
 // ExpirationCache is an in-memory cache with a fixed capacity where each entry has its own fixed
-// expiration time. Expired entries are pruned on each set operation. When the cache reaches its
-// capacity, insertions will evict the entry with the earliest expiration time (the head of the list).
+// expiration time. Expired entries are pruned on each set operation, or in the background by
+// [ExpirationCache.RunJanitor]. When the cache reaches its capacity, insertions will evict the entry
+// with the earliest expiration time (the head of the list).
+//
+// Entries with the same expiration time are ordered by when they were last inserted,
+// updated, or repositioned, oldest first, with either ordering and from either end.
+// Iteration yields them in that order, and capacity evictions remove the oldest of them first.
 type ExpirationCache[K comparable, V any] struct {
 	mu        sync.RWMutex
 	nodeByKey map[K]*expirationNode[K, V]
 	capacity  int
+	ordering  ExpirationOrdering
+
+	// maxCost is the cost budget, if positive.
+	maxCost int64
+	// totalCost is the sum of the costs of all entries.
+	totalCost int64
+
+	onEvict func(entry Entry[K, V], reason EvictionReason)
+	// evictions collects entries evicted while the write lock is held.
+	// It is only used when onEvict is not nil.
+	evictions []eviction[K, V]
+
+	counters expirationCacheCounters
+
+	// clock is the source of the current time for the convenience methods.
+	clock Clock
+
+	// idleTimeout is the sliding expiration applied on reads, if positive.
+	idleTimeout time.Duration
+
+	// janitorWake wakes up the janitor when the earliest expiration time changes.
+	janitorWake chan struct{}
+
+	// loadMu protects loads.
+	loadMu sync.Mutex
+	// loads holds in-flight GetOrLoad calls by key.
+	loads map[K]*loadCall[V]
+
+	// negative caches loader errors when NegativeTTL is positive. Otherwise it is nil.
+	negative    *ExpirationCache[K, error]
+	negativeTTL time.Duration
 
 	// head is the node with the earliest expiration time.
 	head *expirationNode[K, V]
 	// tail is the node with the latest expiration time.
 	tail *expirationNode[K, V]
+
+	// heap holds the nodes when ordering is [HeapOrdering]. head and tail are unused in that case.
+	heap expirationHeap[K, V]
+	// insertions counts heap insertions, to give each node its insertion sequence.
+	insertions uint64
 }
 
 // NewExpirationCache returns a new expiration cache with the given capacity.
 // If capacity is not positive, the cache will be effectively unbounded.
 func NewExpirationCache[K comparable, V any](capacity int) *ExpirationCache[K, V] {
-	if capacity <= 0 {
-		capacity = math.MaxInt
-	}
-	return &ExpirationCache[K, V]{
-		nodeByKey: make(map[K]*expirationNode[K, V]),
-		capacity:  capacity,
-	}
+	return ExpirationCacheConfig[K, V]{Capacity: capacity}.NewCache()
+}
+
+// NewHeapExpirationCache is like [NewExpirationCache], but the returned cache uses [HeapOrdering].
+func NewHeapExpirationCache[K comparable, V any](capacity int) *ExpirationCache[K, V] {
+	return ExpirationCacheConfig[K, V]{Capacity: capacity, Ordering: HeapOrdering}.NewCache()
 }
 
 // Len returns the number of entries in the cache.
@@ -59,6 +254,11 @@ func (c *ExpirationCache[K, V]) Capacity() int {
 	return c.capacity
 }
 
+// Ordering returns the data structure the cache uses to order its entries.
+func (c *ExpirationCache[K, V]) Ordering() ExpirationOrdering {
+	return c.ordering
+}
+
 // Contains returns whether the cache contains the given key.
 func (c *ExpirationCache[K, V]) Contains(key K) bool {
 	c.mu.RLock()
@@ -78,22 +278,48 @@ func (c *ExpirationCache[K, V]) TryContains(key K) bool {
 }
 
 // Get returns the value associated with the given key, if it exists and is not expired.
+//
+// If the cache has an idle timeout, the entry's expiration time is extended to at least now + IdleTimeout.
 func (c *ExpirationCache[K, V]) Get(key K, now time.Time) (value V, ok bool) {
+	if c.idleTimeout > 0 {
+		c.mu.Lock()
+		node, ok := c.touchIdle(key, now)
+		if ok {
+			value = node.Value
+		}
+		c.mu.Unlock()
+		return value, ok
+	}
+
 	c.mu.RLock()
 	node, ok := c.nodeByKey[key]
-	c.mu.RUnlock()
-	if !ok || !node.expiresAt.After(now) {
-		return value, false
+	ok = c.countLookup(node, ok, now)
+	if ok {
+		value = node.Value
 	}
-	return node.Value, true
+	c.mu.RUnlock()
+	return value, ok
 }
 
 // GetEntry returns the entry associated with the given key, if it exists and is not expired.
+//
+// If the cache has an idle timeout, the entry's expiration time is extended to at least now + IdleTimeout.
 func (c *ExpirationCache[K, V]) GetEntry(key K, now time.Time) (entry *Entry[K, V], ok bool) {
+	if c.idleTimeout > 0 {
+		c.mu.Lock()
+		node, ok := c.touchIdle(key, now)
+		c.mu.Unlock()
+		if !ok {
+			return nil, false
+		}
+		return &node.Entry, true
+	}
+
 	c.mu.RLock()
 	node, ok := c.nodeByKey[key]
+	ok = c.countLookup(node, ok, now)
 	c.mu.RUnlock()
-	if !ok || !node.expiresAt.After(now) {
+	if !ok {
 		return nil, false
 	}
 	return &node.Entry, true
@@ -103,6 +329,7 @@ func (c *ExpirationCache[K, V]) GetEntry(key K, now time.Time) (entry *Entry[K,
 //
 // As opposed to SetFromTail, SetFromHead is optimized for cases where the new expiration time is expected to be among the earliest in the cache.
 // It searches for the correct insertion point starting from the head of the list (the earliest expiration).
+// With [HeapOrdering], SetFromHead and SetFromTail are equivalent.
 // If the key already exists, its node is updated and repositioned; otherwise, the oldest entry is evicted if at capacity.
 // All expired entries are pruned before insertion.
 //
@@ -112,35 +339,14 @@ func (c *ExpirationCache[K, V]) GetEntry(key K, now time.Time) (entry *Entry[K,
 //   - now:       The current time, used to prune expired entries.
 //   - expiresAt: The expiration time for the entry.
 func (c *ExpirationCache[K, V]) SetFromHead(key K, value V, now, expiresAt time.Time) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	node := c.getOrCreateNode(key, value, now, expiresAt)
-	mark := c.head
-	if mark == nil {
-		c.head = node
-		c.tail = node
-		return
-	}
-
-	for {
-		if expiresAt.Before(mark.expiresAt) {
-			c.insertBefore(node, mark)
-			return
-		}
-
-		mark = mark.next
-		if mark == nil {
-			c.insertAfter(node, c.tail)
-			return
-		}
-	}
+	c.set(key, value, defaultCost, now, expiresAt, false)
 }
 
 // SetFromTail inserts or updates the entry for the given key with the specified value and expiration time.
 //
 // As opposed to SetFromHead, SetFromTail is optimized for cases where the new expiration time is expected to be among the latest in the cache.
 // It searches for the correct insertion point starting from the tail of the list (the latest expiration).
+// With [HeapOrdering], SetFromHead and SetFromTail are equivalent.
 // If the key already exists, its node is updated and repositioned; otherwise, the oldest entry is evicted if at capacity.
 // All expired entries are pruned before insertion.
 //
@@ -150,62 +356,74 @@ func (c *ExpirationCache[K, V]) SetFromHead(key K, value V, now, expiresAt time.
 //   - now:       The current time, used to prune expired entries.
 //   - expiresAt: The expiration time for the entry.
 func (c *ExpirationCache[K, V]) SetFromTail(key K, value V, now, expiresAt time.Time) {
+	c.set(key, value, defaultCost, now, expiresAt, true)
+}
+
+// Touch sets the expiration time of the entry for the given key without changing its value,
+// and returns whether the entry exists and is not expired.
+//
+// Like SetFromTail, Touch searches for the new position starting from the tail of the list,
+// which is the fast path for sliding expiration, where refreshed entries always move to the tail.
+// Unlike the set operations, Touch does not prune expired entries.
+func (c *ExpirationCache[K, V]) Touch(key K, now, expiresAt time.Time) bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	node := c.getOrCreateNode(key, value, now, expiresAt)
-	mark := c.tail
-	if mark == nil {
-		c.head = node
-		c.tail = node
-		return
-	}
-
-	for {
-		if expiresAt.After(mark.expiresAt) {
-			c.insertAfter(node, mark)
-			return
-		}
-
-		mark = mark.prev
-		if mark == nil {
-			c.insertBefore(node, c.head)
-			return
-		}
+	node, ok := c.nodeByKey[key]
+	if !ok || !node.expiresAt.After(now) {
+		return false
 	}
+	c.reposition(node, expiresAt)
+	return true
 }
 
 // Remove deletes the value associated with the given key and returns whether the key was found.
+// It also forgets any loader error remembered for the key by [ExpirationCache.GetOrLoad].
 func (c *ExpirationCache[K, V]) Remove(key K) bool {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	if c.negative != nil {
+		c.negative.Remove(key)
+	}
 
+	c.mu.Lock()
 	node, ok := c.nodeByKey[key]
-	if !ok {
-		return false
+	if ok {
+		c.remove(node, EvictionReasonRemoved)
 	}
-	c.remove(node)
-	return true
+	c.unlockAndNotify()
+	return ok
 }
 
-// Clear removes all entries from the cache.
+// Clear removes all entries from the cache, and all loader errors remembered by [ExpirationCache.GetOrLoad].
 func (c *ExpirationCache[K, V]) Clear() {
+	if c.negative != nil {
+		c.negative.Clear()
+	}
+
 	c.mu.Lock()
+	if c.onEvict != nil {
+		for node := range c.ascend() {
+			c.evictions = append(c.evictions, eviction[K, V]{node.Entry, EvictionReasonCleared})
+		}
+	}
 	clear(c.nodeByKey)
+	c.totalCost = 0
 	c.head = nil
 	c.tail = nil
-	c.mu.Unlock()
+	clear(c.heap)
+	c.heap = c.heap[:0]
+	c.unlockAndNotify()
 }
 
 // All returns an iterator over all entries in the cache,
 // starting from the earliest expiration (head) to the latest expiration (tail).
 //
 // An ongoing iterator blocks concurrent writes until it completes.
+// With [HeapOrdering], the entries are copied and sorted before the first one is yielded.
 func (c *ExpirationCache[K, V]) All() iter.Seq2[K, V] {
 	return func(yield func(K, V) bool) {
 		c.mu.RLock()
 		defer c.mu.RUnlock()
-		for node := c.head; node != nil; node = node.next {
+		for node := range c.ascend() {
 			if !yield(node.Key, node.Value) {
 				break
 			}
@@ -217,11 +435,12 @@ func (c *ExpirationCache[K, V]) All() iter.Seq2[K, V] {
 // starting from the latest expiration (tail) to the earliest expiration (head).
 //
 // An ongoing iterator blocks concurrent writes until it completes.
+// With [HeapOrdering], the entries are copied and sorted before the first one is yielded.
 func (c *ExpirationCache[K, V]) Backward() iter.Seq2[K, V] {
 	return func(yield func(K, V) bool) {
 		c.mu.RLock()
 		defer c.mu.RUnlock()
-		for node := c.tail; node != nil; node = node.prev {
+		for node := range c.descend() {
 			if !yield(node.Key, node.Value) {
 				break
 			}
@@ -229,34 +448,202 @@ func (c *ExpirationCache[K, V]) Backward() iter.Seq2[K, V] {
 	}
 }
 
+// unlockAndNotify releases the write lock, then calls onEvict for each entry evicted while the lock was held.
+func (c *ExpirationCache[K, V]) unlockAndNotify() {
+	evictions := c.evictions
+	c.evictions = nil
+	c.mu.Unlock()
+
+	for _, e := range evictions {
+		c.onEvict(e.entry, e.reason)
+	}
+}
+
+// ascend returns an iterator over all nodes from the earliest expiration to the latest.
+// The caller must hold the lock.
+func (c *ExpirationCache[K, V]) ascend() iter.Seq[*expirationNode[K, V]] {
+	return func(yield func(*expirationNode[K, V]) bool) {
+		if c.ordering == HeapOrdering {
+			for _, node := range c.heap.sorted() {
+				if !yield(node) {
+					return
+				}
+			}
+			return
+		}
+		for node := c.head; node != nil; node = node.next {
+			if !yield(node) {
+				return
+			}
+		}
+	}
+}
+
+// descend returns an iterator over all nodes from the latest expiration to the earliest.
+// The caller must hold the lock.
+func (c *ExpirationCache[K, V]) descend() iter.Seq[*expirationNode[K, V]] {
+	return func(yield func(*expirationNode[K, V]) bool) {
+		if c.ordering == HeapOrdering {
+			for _, node := range slices.Backward(c.heap.sorted()) {
+				if !yield(node) {
+					return
+				}
+			}
+			return
+		}
+		for node := c.tail; node != nil; node = node.prev {
+			if !yield(node) {
+				return
+			}
+		}
+	}
+}
+
+// pushHeap pushes the detached node onto the heap, after all nodes inserted before it.
+func (c *ExpirationCache[K, V]) pushHeap(node *expirationNode[K, V]) {
+	c.insertions++
+	node.seq = c.insertions
+	c.heap.push(node)
+}
+
+// insertFromHead inserts the detached node, searching for the insertion point from the head of the list.
+func (c *ExpirationCache[K, V]) insertFromHead(node *expirationNode[K, V]) {
+	if c.ordering == HeapOrdering {
+		c.pushHeap(node)
+		return
+	}
+
+	mark := c.head
+	if mark == nil {
+		c.head = node
+		c.tail = node
+		return
+	}
+
+	for {
+		if node.expiresAt.Before(mark.expiresAt) {
+			c.insertBefore(node, mark)
+			return
+		}
+
+		mark = mark.next
+		if mark == nil {
+			c.insertAfter(node, c.tail)
+			return
+		}
+	}
+}
+
+// insertFromTail inserts the detached node, searching for the insertion point from the tail of the list.
+func (c *ExpirationCache[K, V]) insertFromTail(node *expirationNode[K, V]) {
+	if c.ordering == HeapOrdering {
+		c.pushHeap(node)
+		return
+	}
+
+	mark := c.tail
+	if mark == nil {
+		c.head = node
+		c.tail = node
+		return
+	}
+
+	for {
+		// Insert after entries with the same expiration time, like insertFromHead does.
+		if !node.expiresAt.Before(mark.expiresAt) {
+			c.insertAfter(node, mark)
+			return
+		}
+
+		mark = mark.prev
+		if mark == nil {
+			c.insertBefore(node, c.head)
+			return
+		}
+	}
+}
+
+// set implements the set operations. It returns false if the entry was rejected for its cost.
+func (c *ExpirationCache[K, V]) set(key K, value V, cost int64, now, expiresAt time.Time, fromTail bool) bool {
+	if cost < 0 || c.maxCost > 0 && cost > c.maxCost {
+		return false
+	}
+
+	c.mu.Lock()
+	node := c.getOrCreateNode(key, value, cost, now, expiresAt)
+	if fromTail {
+		c.insertFromTail(node)
+	} else {
+		c.insertFromHead(node)
+	}
+	c.wakeJanitor(node)
+	c.unlockAndNotify()
+	return true
+}
+
 // getOrCreateNode retrieves the node for the given key if it exists, otherwise it creates a new one.
-func (c *ExpirationCache[K, V]) getOrCreateNode(key K, value V, now, expiresAt time.Time) *expirationNode[K, V] {
+// The returned node is detached, and must be inserted by the caller.
+func (c *ExpirationCache[K, V]) getOrCreateNode(key K, value V, cost int64, now, expiresAt time.Time) *expirationNode[K, V] {
 	c.pruneExpired(now)
 
 	node, ok := c.nodeByKey[key]
 	if !ok {
 		c.pruneOldest()
+		c.pruneForCost(cost)
 		node = &expirationNode[K, V]{
 			expiresAt: expiresAt,
 			Entry:     Entry[K, V]{Key: key, Value: value},
 		}
 		c.nodeByKey[key] = node
 	} else {
+		c.counters.replacements.Add(1)
+		if c.onEvict != nil {
+			c.evictions = append(c.evictions, eviction[K, V]{node.Entry, EvictionReasonReplaced})
+		}
 		c.detach(node)
+		c.totalCost -= node.cost
+		c.pruneForCost(cost)
 		node.expiresAt = expiresAt
 		node.Value = value
 	}
 
+	node.cost = cost
+	c.totalCost += cost
 	return node
 }
 
+// touchIdle looks up the node for the given key, and if it is not expired,
+// extends its expiration time to at least now + idleTimeout.
+// The caller must hold the write lock.
+func (c *ExpirationCache[K, V]) touchIdle(key K, now time.Time) (*expirationNode[K, V], bool) {
+	node, ok := c.nodeByKey[key]
+	if !c.countLookup(node, ok, now) {
+		return nil, false
+	}
+	if expiresAt := now.Add(c.idleTimeout); expiresAt.After(node.expiresAt) {
+		c.reposition(node, expiresAt)
+	}
+	return node, true
+}
+
+// reposition moves the node to its position for the new expiration time.
+// The caller must hold the write lock.
+func (c *ExpirationCache[K, V]) reposition(node *expirationNode[K, V], expiresAt time.Time) {
+	c.detach(node)
+	node.expiresAt = expiresAt
+	c.insertFromTail(node)
+	c.wakeJanitor(node)
+}
+
 // pruneExpired removes all expired entries from the cache.
 func (c *ExpirationCache[K, V]) pruneExpired(now time.Time) {
-	for node := c.head; node != nil; node = node.next {
-		if node.expiresAt.After(now) {
+	for {
+		node := c.first()
+		if node == nil || node.expiresAt.After(now) {
 			break
 		}
-		c.remove(node)
+		c.remove(node, EvictionReasonExpired)
+		c.counters.expirations.Add(1)
 	}
 }
 
@@ -265,7 +652,16 @@ func (c *ExpirationCache[K, V]) pruneOldest() {
 	if len(c.nodeByKey) < c.capacity {
 		return
 	}
-	c.remove(c.head)
+	c.remove(c.first(), EvictionReasonCapacity)
+	c.counters.capacityEvictions.Add(1)
+}
+
+// first returns the node with the earliest expiration time, or nil if the cache is empty.
+func (c *ExpirationCache[K, V]) first() *expirationNode[K, V] {
+	if c.ordering == HeapOrdering {
+		return c.heap.first()
+	}
+	return c.head
 }
 
 // insertBefore inserts the new node immediately before mark.
@@ -292,14 +688,23 @@ func (c *ExpirationCache[K, V]) insertAfter(node, mark *expirationNode[K, V]) {
 	mark.next = node
 }
 
-// remove deletes the given node from the cache.
-func (c *ExpirationCache[K, V]) remove(node *expirationNode[K, V]) {
+// remove deletes the given node from the cache, and records the eviction if onEvict is set.
+func (c *ExpirationCache[K, V]) remove(node *expirationNode[K, V], reason EvictionReason) {
 	delete(c.nodeByKey, node.Key)
+	c.totalCost -= node.cost
 	c.detach(node)
+	if c.onEvict != nil {
+		c.evictions = append(c.evictions, eviction[K, V]{node.Entry, reason})
+	}
 }
 
-// detach detaches the given node from the list.
+// detach detaches the given node from the list or heap.
 func (c *ExpirationCache[K, V]) detach(node *expirationNode[K, V]) {
+	if c.ordering == HeapOrdering {
+		c.heap.remove(node)
+		return
+	}
+
 	if node.prev != nil {
 		node.prev.next = node.next
 	} else {
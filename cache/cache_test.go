@@ -1,7 +1,10 @@
 package cache_test
 
 import (
+	"fmt"
+	"iter"
 	"math"
+	mrand "math/rand/v2"
 	"slices"
 	"testing"
 	"time"
@@ -9,8 +12,23 @@ import (
 	"github.com/database64128/cubic-go-playground/cache"
 )
 
+var expirationCacheOrderings = [...]struct {
+	name string
+	new  func(capacity int) *cache.ExpirationCache[int, int]
+}{
+	{"List", cache.NewExpirationCache[int, int]},
+	{"Heap", cache.NewHeapExpirationCache[int, int]},
+}
+
 func TestExpirationCache(t *testing.T) {
-	c := cache.NewExpirationCache[int, int](3)
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			testExpirationCache(t, o.new(3))
+		})
+	}
+}
+
+func testExpirationCache(t *testing.T, c *cache.ExpirationCache[int, int]) {
 	now := time.Now()
 	assertExpirationCacheLenCapacityContent(t, c, nil, 3, now)
 	c.SetFromHead(1, -1, now, now.Add(time.Second))
@@ -32,7 +50,14 @@ func TestExpirationCache(t *testing.T) {
 }
 
 func TestExpirationCacheUnboundedCapacity(t *testing.T) {
-	c := cache.NewExpirationCache[int, int](0)
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			testExpirationCacheUnboundedCapacity(t, o.new(0))
+		})
+	}
+}
+
+func testExpirationCacheUnboundedCapacity(t *testing.T, c *cache.ExpirationCache[int, int]) {
 	now := time.Now()
 	assertExpirationCacheLenCapacityContent(t, c, nil, math.MaxInt, now)
 	c.SetFromTail(1, -1, now, now.Add(3*time.Second))
@@ -52,6 +77,212 @@ func TestExpirationCacheUnboundedCapacity(t *testing.T) {
 	}, math.MaxInt, now)
 }
 
+func TestExpirationCacheTouch(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := o.new(0)
+			now := time.Now()
+			c.SetFromTail(1, -1, now, now.Add(time.Second))
+			c.SetFromTail(2, -2, now, now.Add(2*time.Second))
+			c.SetFromTail(3, -3, now, now.Add(3*time.Second))
+
+			if !c.Touch(1, now, now.Add(4*time.Second)) {
+				t.Error("c.Touch(1) = false, want true")
+			}
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{2, -2}, {3, -3}, {1, -1}}, math.MaxInt, now)
+
+			if !c.Touch(3, now, now.Add(500*time.Millisecond)) {
+				t.Error("c.Touch(3) = false, want true")
+			}
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{3, -3}, {2, -2}, {1, -1}}, math.MaxInt, now)
+
+			if c.Touch(4, now, now.Add(time.Second)) {
+				t.Error("c.Touch(4) = true, want false")
+			}
+
+			// Expired entries cannot be touched back to life.
+			now = now.Add(time.Second)
+			if c.Touch(3, now, now.Add(time.Second)) {
+				t.Error("c.Touch(3) = true, want false")
+			}
+		})
+	}
+}
+
+func TestExpirationCacheIdleTimeout(t *testing.T) {
+	for _, ordering := range [...]cache.ExpirationOrdering{cache.ListOrdering, cache.HeapOrdering} {
+		t.Run(ordering.String(), func(t *testing.T) {
+			c := cache.ExpirationCacheConfig[int, int]{
+				Ordering:    ordering,
+				IdleTimeout: 2 * time.Second,
+			}.NewCache()
+			now := time.Now()
+			c.SetFromTail(1, -1, now, now.Add(2*time.Second))
+			c.SetFromTail(2, -2, now, now.Add(2*time.Second+time.Millisecond))
+			c.SetFromTail(3, -3, now, now.Add(time.Hour))
+
+			// Each read extends the entry and moves it toward the tail.
+			now = now.Add(time.Second)
+			if value, ok := c.Get(1, now); value != -1 || !ok {
+				t.Errorf("c.Get(1) = %d, %v, want -1, true", value, ok)
+			}
+			now = now.Add(time.Second + time.Millisecond/2)
+			if entry, ok := c.GetEntry(1, now); entry == nil || entry.Value != -1 || !ok {
+				t.Errorf("c.GetEntry(1) = %v, %v, want {1 -1}, true", entry, ok)
+			}
+
+			// Entry 2 was never read, and expired. Entry 3 already expires later than the idle timeout.
+			if _, ok := c.Get(2, now.Add(time.Millisecond)); ok {
+				t.Error("c.Get(2) = _, true, want false")
+			}
+			got := slices.Collect(entries(c.All()))
+			want := []cache.Entry[int, int]{{2, -2}, {1, -1}, {3, -3}}
+			if !slices.Equal(got, want) {
+				t.Errorf("c.All() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+type testEviction struct {
+	entry  cache.Entry[int, int]
+	reason cache.EvictionReason
+}
+
+func TestExpirationCacheOnEvict(t *testing.T) {
+	for _, ordering := range [...]cache.ExpirationOrdering{cache.ListOrdering, cache.HeapOrdering} {
+		t.Run(fmt.Sprint(ordering), func(t *testing.T) {
+			var (
+				c         *cache.ExpirationCache[int, int]
+				evictions []testEviction
+			)
+			c = cache.ExpirationCacheConfig[int, int]{
+				Capacity: 3,
+				Ordering: ordering,
+				OnEvict: func(entry cache.Entry[int, int], reason cache.EvictionReason) {
+					// Calling back into the cache must not deadlock.
+					if c.Contains(entry.Key) && reason != cache.EvictionReasonReplaced {
+						t.Errorf("evicted key %d is still in the cache", entry.Key)
+					}
+					evictions = append(evictions, testEviction{entry, reason})
+				},
+			}.NewCache()
+
+			assertEvictions := func(want ...testEviction) {
+				t.Helper()
+				if !slices.Equal(evictions, want) {
+					t.Errorf("evictions = %v, want %v", evictions, want)
+				}
+				evictions = nil
+			}
+
+			now := time.Now()
+			c.SetFromTail(1, -1, now, now.Add(time.Second))
+			c.SetFromTail(2, -2, now, now.Add(2*time.Second))
+			c.SetFromTail(3, -3, now, now.Add(3*time.Second))
+			assertEvictions()
+
+			c.SetFromTail(4, -4, now, now.Add(4*time.Second))
+			assertEvictions(testEviction{cache.Entry[int, int]{Key: 1, Value: -1}, cache.EvictionReasonCapacity})
+
+			c.SetFromHead(2, 2, now, now.Add(5*time.Second))
+			assertEvictions(testEviction{cache.Entry[int, int]{Key: 2, Value: -2}, cache.EvictionReasonReplaced})
+
+			if !c.Remove(4) {
+				t.Error("c.Remove(4) = false, want true")
+			}
+			assertEvictions(testEviction{cache.Entry[int, int]{Key: 4, Value: -4}, cache.EvictionReasonRemoved})
+
+			now = now.Add(3 * time.Second)
+			c.SetFromTail(6, -6, now, now.Add(time.Second))
+			assertEvictions(testEviction{cache.Entry[int, int]{Key: 3, Value: -3}, cache.EvictionReasonExpired})
+
+			c.Clear()
+			assertEvictions(
+				testEviction{cache.Entry[int, int]{Key: 6, Value: -6}, cache.EvictionReasonCleared},
+				testEviction{cache.Entry[int, int]{Key: 2, Value: 2}, cache.EvictionReasonCleared},
+			)
+		})
+	}
+}
+
+func TestExpirationCacheTies(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := o.new(3)
+			now := time.Now()
+			expiresAt := now.Add(time.Second)
+
+			// Ties are kept in insertion order, whichever end the insertion point is searched from.
+			c.SetFromHead(1, -1, now, expiresAt)
+			c.SetFromTail(2, -2, now, expiresAt)
+			c.SetFromHead(3, -3, now, expiresAt)
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{1, -1}, {2, -2}, {3, -3}}, 3, now)
+
+			// Updating an entry moves it after the others with the same expiration time.
+			c.SetFromTail(1, -11, now, expiresAt)
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{2, -2}, {3, -3}, {1, -11}}, 3, now)
+
+			// The oldest of the tied entries is evicted first.
+			c.SetFromHead(4, -4, now, expiresAt)
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{3, -3}, {1, -11}, {4, -4}}, 3, now)
+		})
+	}
+}
+
+func TestHeapExpirationCacheMatchesList(t *testing.T) {
+	const (
+		capacity = 64
+		keys     = 128
+		ops      = 10000
+	)
+
+	list := cache.NewExpirationCache[int, int](capacity)
+	heap := cache.NewHeapExpirationCache[int, int](capacity)
+	now := time.Now()
+	r := mrand.New(mrand.NewPCG(1, 2))
+
+	for i := range ops {
+		key := r.IntN(keys)
+		switch op := r.IntN(8); {
+		case op < 6:
+			// Few distinct expiration times, so that both orderings must break many ties the same way.
+			expiresAt := now.Add(time.Duration(r.IntN(100)) * time.Second)
+			if op%2 == 0 {
+				list.SetFromHead(key, i, now, expiresAt)
+				heap.SetFromHead(key, i, now, expiresAt)
+			} else {
+				list.SetFromTail(key, i, now, expiresAt)
+				heap.SetFromTail(key, i, now, expiresAt)
+			}
+		case op < 7:
+			if got, want := heap.Remove(key), list.Remove(key); got != want {
+				t.Fatalf("heap.Remove(%d) = %v, want %v", key, got, want)
+			}
+		default:
+			now = now.Add(time.Duration(r.IntN(10)) * time.Second)
+		}
+
+		want := slices.Collect(entries(list.All()))
+		got := slices.Collect(entries(heap.All()))
+		if !slices.Equal(got, want) {
+			t.Fatalf("after op %d: heap.All() = %v, want %v", i, got, want)
+		}
+	}
+
+	assertExpirationCacheLenCapacityContent(t, heap, slices.Collect(entries(list.All())), capacity, now)
+}
+
+func entries[K comparable, V any](seq iter.Seq2[K, V]) iter.Seq[cache.Entry[K, V]] {
+	return func(yield func(cache.Entry[K, V]) bool) {
+		for key, value := range seq {
+			if !yield(cache.Entry[K, V]{Key: key, Value: value}) {
+				return
+			}
+		}
+	}
+}
+
 func assertExpirationCacheLenCapacityContent(t *testing.T, c *cache.ExpirationCache[int, int], want []cache.Entry[int, int], expectedCapacity int, now time.Time) {
 	t.Helper()
 
@@ -137,3 +368,69 @@ func slicesReverseEqual[S ~[]E, E comparable](s1, s2 S) bool {
 	}
 	return true
 }
+
+// ttlDistribution generates expiration times for [BenchmarkExpirationCacheSet].
+type ttlDistribution struct {
+	name string
+	// next returns the i-th expiration time as an offset from the base time.
+	// prefill is the number of entries inserted before the benchmark loop.
+	next func(r *mrand.Rand, i, prefill int) time.Duration
+}
+
+var ttlDistributions = [...]ttlDistribution{
+	{
+		// Fixed TTL: every new entry expires after all existing ones.
+		name: "Fixed",
+		next: func(_ *mrand.Rand, i, _ int) time.Duration {
+			return time.Duration(i) * time.Millisecond
+		},
+	},
+	{
+		// Jittered TTL: new entries land near the tail.
+		name: "Jittered",
+		next: func(r *mrand.Rand, i, _ int) time.Duration {
+			return time.Duration(i)*time.Millisecond + time.Duration(r.IntN(1000))*time.Millisecond
+		},
+	},
+	{
+		// Uniform TTL: new entries land anywhere in the cache.
+		name: "Uniform",
+		next: func(r *mrand.Rand, _, prefill int) time.Duration {
+			return time.Duration(r.IntN(prefill)) * time.Millisecond
+		},
+	},
+}
+
+func BenchmarkExpirationCacheSet(b *testing.B) {
+	for _, o := range expirationCacheOrderings {
+		b.Run(o.name, func(b *testing.B) {
+			for _, size := range [...]int{1_000, 10_000, 100_000} {
+				b.Run(fmt.Sprint(size), func(b *testing.B) {
+					for _, d := range ttlDistributions {
+						b.Run(d.name, func(b *testing.B) {
+							benchmarkExpirationCacheSet(b, o.new(size), size, d)
+						})
+					}
+				})
+			}
+		})
+	}
+}
+
+func benchmarkExpirationCacheSet(b *testing.B, c *cache.ExpirationCache[int, int], size int, d ttlDistribution) {
+	now := time.Now()
+	base := now.Add(time.Hour)
+
+	// Prefill in expiration order, so that the list does not walk during setup.
+	for i := range size {
+		c.SetFromTail(i, i, now, base.Add(time.Duration(i)*time.Millisecond))
+	}
+
+	r := mrand.New(mrand.NewPCG(1, 2))
+	i := size
+
+	for b.Loop() {
+		c.SetFromTail(r.IntN(size), i, now, base.Add(d.next(r, i, size)))
+		i++
+	}
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Clock is a source of time for an [ExpirationCache] and its background tasks.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// After waits for the duration to elapse and then sends the current time on the returned channel.
+	After(d time.Duration) <-chan time.Time
+}
+
+// SystemClock is a [Clock] backed by the time package.
+type SystemClock struct{}
+
+// Now implements [Clock.Now].
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// After implements [Clock.After].
+func (SystemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// CoarseClock is a [Clock] whose current time is updated periodically by [CoarseClock.Run],
+// which makes Now a single atomic load. The returned times carry a monotonic clock reading,
+// so comparisons and subtractions between them are not affected by wall clock changes.
+//
+// Now lags behind the real time by up to the update interval.
+type CoarseClock struct {
+	epoch    time.Time
+	elapsed  atomic.Int64
+	interval time.Duration
+}
+
+// NewCoarseClock returns a new coarse clock that is updated every interval once started.
+func NewCoarseClock(interval time.Duration) *CoarseClock {
+	return &CoarseClock{
+		epoch:    time.Now(),
+		interval: interval,
+	}
+}
+
+// Run updates the clock every interval until ctx is canceled.
+// It blocks until then, so it is usually called in its own goroutine.
+func (c *CoarseClock) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.elapsed.Store(int64(time.Since(c.epoch)))
+		}
+	}
+}
+
+// Now implements [Clock.Now].
+func (c *CoarseClock) Now() time.Time {
+	return c.epoch.Add(time.Duration(c.elapsed.Load()))
+}
+
+// After implements [Clock.After].
+func (c *CoarseClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock is a [Clock] for tests. Its time only moves when advanced.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeClockWaiter
+}
+
+type fakeClockWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock returns a new fake clock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now implements [Clock.Now].
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After implements [Clock.After].
+// The returned channel receives the fake time once the clock is advanced past the deadline.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeClockWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock forward by d, and fires all timers whose deadlines have passed.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	waiters := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	clear(c.waiters[len(waiters):])
+	c.waiters = waiters
+}
+
+// Clock returns the clock used by the convenience methods that do not take the current time.
+func (c *ExpirationCache[K, V]) Clock() Clock {
+	return c.clock
+}
+
+// GetNow is like [ExpirationCache.Get], but uses the cache's clock for the current time.
+func (c *ExpirationCache[K, V]) GetNow(key K) (value V, ok bool) {
+	return c.Get(key, c.clock.Now())
+}
+
+// GetEntryNow is like [ExpirationCache.GetEntry], but uses the cache's clock for the current time.
+func (c *ExpirationCache[K, V]) GetEntryNow(key K) (entry *Entry[K, V], ok bool) {
+	return c.GetEntry(key, c.clock.Now())
+}
+
+// SetFromHeadTTL is like [ExpirationCache.SetFromHead], but uses the cache's clock for the current time,
+// and sets the entry to expire after ttl.
+func (c *ExpirationCache[K, V]) SetFromHeadTTL(key K, value V, ttl time.Duration) {
+	now := c.clock.Now()
+	c.SetFromHead(key, value, now, now.Add(ttl))
+}
+
+// SetFromTailTTL is like [ExpirationCache.SetFromTail], but uses the cache's clock for the current time,
+// and sets the entry to expire after ttl.
+func (c *ExpirationCache[K, V]) SetFromTailTTL(key K, value V, ttl time.Duration) {
+	now := c.clock.Now()
+	c.SetFromTail(key, value, now, now.Add(ttl))
+}
+
+// TouchTTL is like [ExpirationCache.Touch], but uses the cache's clock for the current time,
+// and sets the entry to expire after ttl.
+func (c *ExpirationCache[K, V]) TouchTTL(key K, ttl time.Duration) bool {
+	now := c.clock.Now()
+	return c.Touch(key, now, now.Add(ttl))
+}
+
+// GetOrLoadNow is like [ExpirationCache.GetOrLoad], but uses the cache's clock for the current time.
+func (c *ExpirationCache[K, V]) GetOrLoadNow(key K, loader func(key K) (value V, expiresAt time.Time, err error)) (V, error) {
+	return c.GetOrLoad(key, c.clock.Now(), loader)
+}
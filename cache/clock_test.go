@@ -0,0 +1,105 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Now()
+	clock := cache.NewFakeClock(start)
+	if got := clock.Now(); !got.Equal(start) {
+		t.Errorf("clock.Now() = %v, want %v", got, start)
+	}
+
+	immediate := clock.After(0)
+	select {
+	case <-immediate:
+	default:
+		t.Error("clock.After(0) did not fire immediately")
+	}
+
+	ch := clock.After(2 * time.Second)
+	clock.Advance(time.Second)
+	select {
+	case <-ch:
+		t.Error("clock.After(2s) fired after 1s")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case got := <-ch:
+		if want := start.Add(2 * time.Second); !got.Equal(want) {
+			t.Errorf("clock.After(2s) sent %v, want %v", got, want)
+		}
+	default:
+		t.Error("clock.After(2s) did not fire after 2s")
+	}
+}
+
+func TestCoarseClock(t *testing.T) {
+	clock := cache.NewCoarseClock(time.Millisecond)
+	start := clock.Now()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		clock.Run(ctx)
+		close(done)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if got := clock.Now(); !got.After(start) {
+		t.Errorf("clock.Now() = %v, want after %v", got, start)
+	}
+	if got := clock.Now(); got.After(time.Now()) {
+		t.Errorf("clock.Now() = %v is ahead of the real time", got)
+	}
+
+	cancel()
+	<-done
+}
+
+func TestExpirationCacheClock(t *testing.T) {
+	clock := cache.NewFakeClock(time.Now())
+	c := cache.ExpirationCacheConfig[int, int]{Clock: clock}.NewCache()
+	if c.Clock() != clock {
+		t.Error("c.Clock() is not the configured clock")
+	}
+
+	c.SetFromTailTTL(1, -1, 2*time.Second)
+	c.SetFromHeadTTL(2, -2, time.Second)
+	assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{2, -2}, {1, -1}}, c.Capacity(), clock.Now())
+
+	clock.Advance(time.Second)
+	if _, ok := c.GetNow(2); ok {
+		t.Error("c.GetNow(2) = _, true, want false")
+	}
+	if entry, ok := c.GetEntryNow(1); entry == nil || entry.Value != -1 || !ok {
+		t.Errorf("c.GetEntryNow(1) = %v, %v, want {1 -1}, true", entry, ok)
+	}
+
+	if !c.TouchTTL(1, 2*time.Second) {
+		t.Error("c.TouchTTL(1) = false, want true")
+	}
+	clock.Advance(time.Second)
+	if value, ok := c.GetNow(1); value != -1 || !ok {
+		t.Errorf("c.GetNow(1) = %d, %v, want -1, true", value, ok)
+	}
+
+	value, err := c.GetOrLoadNow(3, func(key int) (int, time.Time, error) {
+		return -key, clock.Now().Add(time.Second), nil
+	})
+	if value != -3 || err != nil {
+		t.Errorf("c.GetOrLoadNow(3) = %d, %v, want -3, nil", value, err)
+	}
+
+	// The default clock is the system clock.
+	if _, ok := cache.NewExpirationCache[int, int](0).Clock().(cache.SystemClock); !ok {
+		t.Error("default clock is not cache.SystemClock")
+	}
+}
@@ -0,0 +1,88 @@
+package cache
+
+import "time"
+
+// defaultCost is the cost of entries inserted without an explicit cost.
+const defaultCost = 1
+
+// SetFromHeadWithCost is like [ExpirationCache.SetFromHead], but the entry carries the given cost.
+//
+// If the cache has a cost budget (MaxCost), the earliest-expiring entries are evicted until the new entry fits.
+// The entry is rejected, and the cache left unchanged, if cost is negative or exceeds the whole budget.
+// It returns whether the entry was inserted.
+//
+// Entries inserted by SetFromHead, SetFromTail, and other methods without a cost parameter have a cost of 1.
+func (c *ExpirationCache[K, V]) SetFromHeadWithCost(key K, value V, cost int64, now, expiresAt time.Time) bool {
+	return c.set(key, value, cost, now, expiresAt, false)
+}
+
+// SetFromTailWithCost is like [ExpirationCache.SetFromTail], but the entry carries the given cost.
+// See [ExpirationCache.SetFromHeadWithCost] for how the cost is enforced.
+func (c *ExpirationCache[K, V]) SetFromTailWithCost(key K, value V, cost int64, now, expiresAt time.Time) bool {
+	return c.set(key, value, cost, now, expiresAt, true)
+}
+
+// Cost returns the total cost of all entries in the cache.
+func (c *ExpirationCache[K, V]) Cost() int64 {
+	c.mu.RLock()
+	cost := c.totalCost
+	c.mu.RUnlock()
+	return cost
+}
+
+// MaxCost returns the cost budget of the cache, or 0 if the cache has no cost budget.
+func (c *ExpirationCache[K, V]) MaxCost() int64 {
+	return c.maxCost
+}
+
+// pruneForCost evicts the earliest-expiring entries until an entry with the given cost fits in the budget.
+// The caller must hold the write lock.
+func (c *ExpirationCache[K, V]) pruneForCost(cost int64) {
+	if c.maxCost <= 0 {
+		return
+	}
+	for c.totalCost+cost > c.maxCost {
+		node := c.first()
+		if node == nil {
+			return
+		}
+		c.remove(node, EvictionReasonCapacity)
+		c.counters.capacityEvictions.Add(1)
+	}
+}
+
+// SetFromHeadWithCost is like [ExpirationCache.SetFromHeadWithCost].
+// The cost budget applies to the key's shard, so entries larger than the shard's share of the budget are rejected.
+// Entries that cost at most [ShardedExpirationCache.MaxEntryCost] are accepted in every shard.
+func (c *ShardedExpirationCache[K, V]) SetFromHeadWithCost(key K, value V, cost int64, now, expiresAt time.Time) bool {
+	return c.shard(key).SetFromHeadWithCost(key, value, cost, now, expiresAt)
+}
+
+// SetFromTailWithCost is like [ExpirationCache.SetFromTailWithCost].
+// See [ShardedExpirationCache.SetFromHeadWithCost] for how the cost is enforced.
+func (c *ShardedExpirationCache[K, V]) SetFromTailWithCost(key K, value V, cost int64, now, expiresAt time.Time) bool {
+	return c.shard(key).SetFromTailWithCost(key, value, cost, now, expiresAt)
+}
+
+// Cost returns the total cost of all entries in the cache.
+func (c *ShardedExpirationCache[K, V]) Cost() int64 {
+	var cost int64
+	for _, s := range c.shards {
+		cost += s.Cost()
+	}
+	return cost
+}
+
+// MaxCost returns the total cost budget of the cache, or 0 if the cache has no cost budget.
+func (c *ShardedExpirationCache[K, V]) MaxCost() int64 {
+	return c.maxCost
+}
+
+// MaxEntryCost returns the largest cost of an entry that every shard accepts,
+// which is the smallest shard's share of the budget, or 0 if the cache has no cost budget.
+func (c *ShardedExpirationCache[K, V]) MaxEntryCost() int64 {
+	if c.maxCost <= 0 {
+		return 0
+	}
+	return c.maxCost / int64(len(c.shards))
+}
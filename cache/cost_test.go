@@ -0,0 +1,117 @@
+package cache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+func TestExpirationCacheCost(t *testing.T) {
+	for _, ordering := range [...]cache.ExpirationOrdering{cache.ListOrdering, cache.HeapOrdering} {
+		t.Run(ordering.String(), func(t *testing.T) {
+			var evictions []testEviction
+			c := cache.ExpirationCacheConfig[int, int]{
+				Ordering: ordering,
+				MaxCost:  100,
+				OnEvict: func(entry cache.Entry[int, int], reason cache.EvictionReason) {
+					evictions = append(evictions, testEviction{entry, reason})
+				},
+			}.NewCache()
+			if got := c.MaxCost(); got != 100 {
+				t.Errorf("c.MaxCost() = %d, want 100", got)
+			}
+
+			assertCost := func(want int64) {
+				t.Helper()
+				if got := c.Cost(); got != want {
+					t.Errorf("c.Cost() = %d, want %d", got, want)
+				}
+			}
+
+			now := time.Now()
+			for key := range 4 {
+				if !c.SetFromTailWithCost(key, -key, 20, now, now.Add(time.Duration(key+1)*time.Second)) {
+					t.Errorf("c.SetFromTailWithCost(%d, cost 20) = false, want true", key)
+				}
+			}
+			assertCost(80)
+
+			// Fitting 50 more evicts the two earliest-expiring entries.
+			if !c.SetFromHeadWithCost(4, -4, 50, now, now.Add(5*time.Second)) {
+				t.Error("c.SetFromHeadWithCost(4, cost 50) = false, want true")
+			}
+			assertCost(90)
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{2, -2}, {3, -3}, {4, -4}}, c.Capacity(), now)
+			want := []testEviction{
+				{cache.Entry[int, int]{Key: 0, Value: 0}, cache.EvictionReasonCapacity},
+				{cache.Entry[int, int]{Key: 1, Value: -1}, cache.EvictionReasonCapacity},
+			}
+			if len(evictions) != len(want) || evictions[0] != want[0] || evictions[1] != want[1] {
+				t.Errorf("evictions = %v, want %v", evictions, want)
+			}
+
+			// Entries larger than the whole budget are rejected without touching the cache.
+			if c.SetFromTailWithCost(5, -5, 101, now, now.Add(time.Second)) {
+				t.Error("c.SetFromTailWithCost(5, cost 101) = true, want false")
+			}
+			if c.SetFromTailWithCost(5, -5, -1, now, now.Add(time.Second)) {
+				t.Error("c.SetFromTailWithCost(5, cost -1) = true, want false")
+			}
+			assertCost(90)
+
+			// Replacing an entry releases its old cost first.
+			c.SetFromTailWithCost(4, 4, 60, now, now.Add(5*time.Second))
+			assertCost(100)
+			assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{2, -2}, {3, -3}, {4, 4}}, c.Capacity(), now)
+
+			// Entries without an explicit cost cost 1.
+			c.SetFromTail(6, -6, now, now.Add(6*time.Second))
+			assertCost(81)
+
+			c.Remove(6)
+			assertCost(80)
+			c.Clear()
+			assertCost(0)
+		})
+	}
+}
+
+func TestShardedExpirationCacheCost(t *testing.T) {
+	c := cache.ExpirationCacheConfig[int, int]{MaxCost: 100}.NewShardedCache(8)
+	if got := c.MaxCost(); got != 100 {
+		t.Errorf("c.MaxCost() = %d, want 100", got)
+	}
+	// Each shard gets 12 or 13 of the budget.
+	if got := c.MaxEntryCost(); got != 12 {
+		t.Errorf("c.MaxEntryCost() = %d, want 12", got)
+	}
+
+	now := time.Now()
+	for key := range 100 {
+		if !c.SetFromTailWithCost(key, key, 12, now, now.Add(time.Second)) {
+			t.Errorf("c.SetFromTailWithCost(%d, cost 12) = false, want true", key)
+		}
+		// Half of the budget is more than any shard's share.
+		if c.SetFromTailWithCost(key, key, 50, now, now.Add(time.Second)) {
+			t.Errorf("c.SetFromTailWithCost(%d, cost 50) = true, want false", key)
+		}
+	}
+	if got := c.Cost(); got > 100 {
+		t.Errorf("c.Cost() = %d, want at most 100", got)
+	}
+
+	// Each shard must have a budget of at least 1.
+	c = cache.ExpirationCacheConfig[int, int]{MaxCost: 3}.NewShardedCache(8)
+	if got := c.Shards(); got != 3 {
+		t.Errorf("c.Shards() = %d, want 3", got)
+	}
+	if got := c.MaxEntryCost(); got != 1 {
+		t.Errorf("c.MaxEntryCost() = %d, want 1", got)
+	}
+
+	c = cache.NewShardedExpirationCache[int, int](0, 8)
+	if got, got2 := c.MaxCost(), c.MaxEntryCost(); got != 0 || got2 != 0 {
+		t.Errorf("c.MaxCost(), c.MaxEntryCost() = %d, %d, want 0, 0", got, got2)
+	}
+}
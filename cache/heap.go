@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"cmp"
+	"slices"
+	"time"
+)
+
+// expirationHeap is a binary min-heap of nodes ordered by expiration time,
+// with ties broken by insertion sequence, so that the order matches [ListOrdering].
+// Each node tracks its own position in the heap, so arbitrary nodes can be removed in O(log n).
+type expirationHeap[K comparable, V any] []*expirationNode[K, V]
+
+// compareNodes orders nodes by expiration time, then by insertion sequence.
+func compareNodes[K comparable, V any](a, b *expirationNode[K, V]) int {
+	if c := a.expiresAt.Compare(b.expiresAt); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.seq, b.seq)
+}
+
+// first returns the node with the earliest expiration time, or nil if the heap is empty.
+func (h expirationHeap[K, V]) first() *expirationNode[K, V] {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0]
+}
+
+// push adds the node to the heap. The caller must have set node.seq.
+func (h *expirationHeap[K, V]) push(node *expirationNode[K, V]) {
+	node.index = len(*h)
+	*h = append(*h, node)
+	h.up(node.index)
+}
+
+// remove removes the node from the heap.
+func (h *expirationHeap[K, V]) remove(node *expirationNode[K, V]) {
+	s := *h
+	i := node.index
+	last := len(s) - 1
+	if i != last {
+		h.swap(i, last)
+	}
+	s[last] = nil
+	*h = s[:last]
+	if i != last && !h.down(i) {
+		h.up(i)
+	}
+}
+
+// sorted returns a copy of the heap's nodes in expiration order.
+func (h expirationHeap[K, V]) sorted() []*expirationNode[K, V] {
+	nodes := slices.Clone(h)
+	slices.SortFunc(nodes, compareNodes)
+	return nodes
+}
+
+func (h expirationHeap[K, V]) less(i, j int) bool {
+	return compareNodes(h[i], h[j]) < 0
+}
+
+func (h expirationHeap[K, V]) swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h expirationHeap[K, V]) up(i int) {
+	for i > 0 {
+		parent := (i - 1) / 2
+		if !h.less(i, parent) {
+			break
+		}
+		h.swap(i, parent)
+		i = parent
+	}
+}
+
+// down moves the node at index i down the heap and returns whether it was moved.
+func (h expirationHeap[K, V]) down(i int) bool {
+	start := i
+	n := len(h)
+	for {
+		left := 2*i + 1
+		if left >= n {
+			break
+		}
+		smallest := left
+		if right := left + 1; right < n && h.less(right, left) {
+			smallest = right
+		}
+		if !h.less(smallest, i) {
+			break
+		}
+		h.swap(i, smallest)
+		i = smallest
+	}
+	return i > start
+}
+
+// before returns the nodes expiring before t, in expiration order.
+// Subtrees whose root does not expire before t are skipped, since none of their nodes can.
+func (h expirationHeap[K, V]) before(t time.Time) []*expirationNode[K, V] {
+	var nodes []*expirationNode[K, V]
+	var walk func(i int)
+	walk = func(i int) {
+		if i >= len(h) || !h[i].expiresAt.Before(t) {
+			return
+		}
+		nodes = append(nodes, h[i])
+		walk(2*i + 1)
+		walk(2*i + 2)
+	}
+	walk(0)
+	slices.SortFunc(nodes, compareNodes)
+	return nodes
+}
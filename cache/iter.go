@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"iter"
+	"slices"
+	"time"
+)
+
+// AllUnexpired is like [ExpirationCache.All], but skips entries that are expired at now.
+func (c *ExpirationCache[K, V]) AllUnexpired(now time.Time) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for node := range c.ascend() {
+			if !node.expiresAt.After(now) {
+				continue
+			}
+			if !yield(node.Key, node.Value) {
+				break
+			}
+		}
+	}
+}
+
+// BackwardUnexpired is like [ExpirationCache.Backward], but skips entries that are expired at now.
+func (c *ExpirationCache[K, V]) BackwardUnexpired(now time.Time) iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for node := range c.descend() {
+			// All remaining nodes expire even earlier.
+			if !node.expiresAt.After(now) {
+				break
+			}
+			if !yield(node.Key, node.Value) {
+				break
+			}
+		}
+	}
+}
+
+// ExpiringBefore returns an iterator over the entries that expire before t, and their expiration times,
+// starting from the earliest expiration.
+//
+// An ongoing iterator blocks concurrent writes until it completes.
+func (c *ExpirationCache[K, V]) ExpiringBefore(t time.Time) iter.Seq2[Entry[K, V], time.Time] {
+	return func(yield func(Entry[K, V], time.Time) bool) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for node := range c.ascendBefore(t) {
+			if !yield(node.Entry, node.expiresAt) {
+				break
+			}
+		}
+	}
+}
+
+// ExpiringBetween returns an iterator over the entries that expire in the half-open interval [start, end),
+// and their expiration times, starting from the earliest expiration.
+//
+// An ongoing iterator blocks concurrent writes until it completes.
+func (c *ExpirationCache[K, V]) ExpiringBetween(start, end time.Time) iter.Seq2[Entry[K, V], time.Time] {
+	return func(yield func(Entry[K, V], time.Time) bool) {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		for node := range c.ascendBefore(end) {
+			if node.expiresAt.Before(start) {
+				continue
+			}
+			if !yield(node.Entry, node.expiresAt) {
+				break
+			}
+		}
+	}
+}
+
+// Snapshot returns an iterator over a copy of all entries in the cache,
+// starting from the earliest expiration (head) to the latest expiration (tail).
+//
+// The entries are copied under the read lock when iteration starts, and yielded after it is released,
+// so a slow consumer does not block concurrent writes. Changes made during iteration are not reflected.
+func (c *ExpirationCache[K, V]) Snapshot() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.mu.RLock()
+		entries := make([]Entry[K, V], 0, len(c.nodeByKey))
+		for node := range c.ascend() {
+			entries = append(entries, node.Entry)
+		}
+		c.mu.RUnlock()
+
+		for _, entry := range entries {
+			if !yield(entry.Key, entry.Value) {
+				break
+			}
+		}
+	}
+}
+
+// ascendBefore returns an iterator over the nodes expiring before t, from the earliest expiration.
+// The caller must hold the lock.
+func (c *ExpirationCache[K, V]) ascendBefore(t time.Time) iter.Seq[*expirationNode[K, V]] {
+	if c.ordering == HeapOrdering {
+		return slices.Values(c.heap.before(t))
+	}
+	return func(yield func(*expirationNode[K, V]) bool) {
+		for node := c.head; node != nil && node.expiresAt.Before(t); node = node.next {
+			if !yield(node) {
+				return
+			}
+		}
+	}
+}
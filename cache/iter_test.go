@@ -0,0 +1,92 @@
+package cache_test
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+type testExpiringEntry struct {
+	entry     cache.Entry[int, int]
+	expiresAt time.Time
+}
+
+func TestExpirationCacheExpirationAwareIterators(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := o.new(0)
+			start := time.Now()
+			at := func(seconds int) time.Time {
+				return start.Add(time.Duration(seconds) * time.Second)
+			}
+			for key := 1; key <= 5; key++ {
+				c.SetFromTail(key, -key, start, at(key))
+			}
+
+			now := at(2)
+			if got, want := slices.Collect(entries(c.AllUnexpired(now))), []cache.Entry[int, int]{{3, -3}, {4, -4}, {5, -5}}; !slices.Equal(got, want) {
+				t.Errorf("c.AllUnexpired(%v) = %v, want %v", now, got, want)
+			}
+			if got, want := slices.Collect(entries(c.BackwardUnexpired(now))), []cache.Entry[int, int]{{5, -5}, {4, -4}, {3, -3}}; !slices.Equal(got, want) {
+				t.Errorf("c.BackwardUnexpired(%v) = %v, want %v", now, got, want)
+			}
+
+			collect := func(seq func(yield func(cache.Entry[int, int], time.Time) bool)) []testExpiringEntry {
+				var s []testExpiringEntry
+				for entry, expiresAt := range seq {
+					s = append(s, testExpiringEntry{entry, expiresAt})
+				}
+				return s
+			}
+
+			got := collect(c.ExpiringBefore(at(3)))
+			want := []testExpiringEntry{{cache.Entry[int, int]{Key: 1, Value: -1}, at(1)}, {cache.Entry[int, int]{Key: 2, Value: -2}, at(2)}}
+			if !slices.EqualFunc(got, want, testExpiringEntryEqual) {
+				t.Errorf("c.ExpiringBefore(3s) = %v, want %v", got, want)
+			}
+
+			got = collect(c.ExpiringBetween(at(2), at(4)))
+			want = []testExpiringEntry{{cache.Entry[int, int]{Key: 2, Value: -2}, at(2)}, {cache.Entry[int, int]{Key: 3, Value: -3}, at(3)}}
+			if !slices.EqualFunc(got, want, testExpiringEntryEqual) {
+				t.Errorf("c.ExpiringBetween(2s, 4s) = %v, want %v", got, want)
+			}
+
+			if got := collect(c.ExpiringBefore(at(1))); len(got) != 0 {
+				t.Errorf("c.ExpiringBefore(1s) = %v, want none", got)
+			}
+			if got := collect(c.ExpiringBetween(at(4), at(4))); len(got) != 0 {
+				t.Errorf("c.ExpiringBetween(4s, 4s) = %v, want none", got)
+			}
+		})
+	}
+}
+
+func testExpiringEntryEqual(a, b testExpiringEntry) bool {
+	return a.entry == b.entry && a.expiresAt.Equal(b.expiresAt)
+}
+
+func TestExpirationCacheSnapshotIterator(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := o.new(0)
+			now := time.Now()
+			c.SetFromTail(1, -1, now, now.Add(time.Second))
+			c.SetFromTail(2, -2, now, now.Add(2*time.Second))
+
+			var got []cache.Entry[int, int]
+			for key, value := range c.Snapshot() {
+				// Writing during iteration must not deadlock, and is not reflected.
+				c.SetFromTail(key+10, value, now, now.Add(3*time.Second))
+				got = append(got, cache.Entry[int, int]{Key: key, Value: value})
+			}
+			if want := []cache.Entry[int, int]{{1, -1}, {2, -2}}; !slices.Equal(got, want) {
+				t.Errorf("c.Snapshot() = %v, want %v", got, want)
+			}
+			if got := c.Len(); got != 4 {
+				t.Errorf("c.Len() = %d, want 4", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// RunJanitor prunes expired entries from the cache until ctx is canceled.
+//
+// Instead of waking up on a fixed interval, the janitor sleeps until the earliest expiration time in the cache.
+// A set operation that inserts a new earliest entry wakes the janitor up to reschedule.
+// Pruned entries are reported to OnEvict with [EvictionReasonExpired].
+//
+// RunJanitor blocks until ctx is canceled, so it is usually called in its own goroutine.
+// At most one janitor should run on a cache at a time. If clock is nil, the cache's clock is used.
+func (c *ExpirationCache[K, V]) RunJanitor(ctx context.Context, clock Clock) {
+	if clock == nil {
+		clock = c.clock
+	}
+
+	for {
+		now := clock.Now()
+
+		c.mu.Lock()
+		// Wake-ups sent before this point are already reflected in this scan.
+		select {
+		case <-c.janitorWake:
+		default:
+		}
+		c.pruneExpired(now)
+		node := c.first()
+		var wait <-chan time.Time
+		if node != nil {
+			wait = clock.After(node.expiresAt.Sub(now))
+		}
+		c.unlockAndNotify()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.janitorWake:
+		case <-wait:
+		}
+	}
+}
+
+// wakeJanitor wakes up the janitor if node is the new earliest entry.
+// The caller must hold the write lock.
+func (c *ExpirationCache[K, V]) wakeJanitor(node *expirationNode[K, V]) {
+	if c.first() != node {
+		return
+	}
+	select {
+	case c.janitorWake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,82 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+// recordingClock is a [cache.FakeClock] that reports the duration of each After call.
+type recordingClock struct {
+	*cache.FakeClock
+	afterCalls chan time.Duration
+}
+
+func newRecordingClock(now time.Time) *recordingClock {
+	return &recordingClock{
+		FakeClock:  cache.NewFakeClock(now),
+		afterCalls: make(chan time.Duration, 16),
+	}
+}
+
+func (c *recordingClock) After(d time.Duration) <-chan time.Time {
+	ch := c.FakeClock.After(d)
+	c.afterCalls <- d
+	return ch
+}
+
+func TestExpirationCacheRunJanitor(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			testExpirationCacheRunJanitor(t, o.new(0))
+		})
+	}
+}
+
+func testExpirationCacheRunJanitor(t *testing.T, c *cache.ExpirationCache[int, int]) {
+	clock := newRecordingClock(time.Now())
+	now := clock.Now()
+	c.SetFromTail(1, -1, now, now.Add(time.Second))
+	c.SetFromTail(2, -2, now, now.Add(2*time.Second))
+	c.SetFromTail(3, -3, now, now.Add(3*time.Second))
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		c.RunJanitor(ctx, clock)
+		close(done)
+	}()
+
+	assertAfter := func(want time.Duration) {
+		t.Helper()
+		if got := <-clock.afterCalls; got != want {
+			t.Errorf("clock.After(%v), want %v", got, want)
+		}
+	}
+
+	// The janitor sleeps until the head expires.
+	assertAfter(time.Second)
+	assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{1, -1}, {2, -2}, {3, -3}}, c.Capacity(), now)
+
+	// Once the head expires, it is pruned without a set operation.
+	clock.Advance(time.Second)
+	assertAfter(time.Second)
+	now = clock.Now()
+	assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{2, -2}, {3, -3}}, c.Capacity(), now)
+
+	// Inserting a new head reschedules the janitor.
+	c.SetFromHead(4, -4, now, now.Add(500*time.Millisecond))
+	assertAfter(500 * time.Millisecond)
+
+	// Once everything expires, the janitor waits for the next set operation.
+	clock.Advance(3 * time.Second)
+	now = clock.Now()
+	c.SetFromTail(5, -5, now, now.Add(time.Second))
+	assertAfter(time.Second)
+	assertExpirationCacheLenCapacityContent(t, c, []cache.Entry[int, int]{{5, -5}}, c.Capacity(), now)
+
+	cancel()
+	<-done
+}
@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrLoaderPanicked is returned by [ExpirationCache.GetOrLoad] to callers that were waiting on a loader that panicked.
+var ErrLoaderPanicked = errors.New("cache: loader panicked")
+
+// loadCall is an in-flight or completed loader call.
+type loadCall[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// GetOrLoad returns the value associated with the given key, if it exists and is not expired.
+// Otherwise, it calls loader to load the value and its expiration time, and inserts them with SetFromTail.
+//
+// Concurrent calls for the same missing key share a single call to loader.
+// The other callers wait for it to return and receive the same value and error.
+//
+// If loader returns an error, the error is returned and nothing is cached,
+// unless the cache was configured with a positive NegativeTTL. In that case, the error is
+// remembered for NegativeTTL, and returned by subsequent calls without calling loader.
+// A loaded value with an expiration time not after now is returned, but not cached.
+func (c *ExpirationCache[K, V]) GetOrLoad(key K, now time.Time, loader func(key K) (value V, expiresAt time.Time, err error)) (V, error) {
+	if value, ok := c.Get(key, now); ok {
+		return value, nil
+	}
+	if c.negative != nil {
+		if err, ok := c.negative.Get(key, now); ok {
+			var zero V
+			return zero, err
+		}
+	}
+
+	c.loadMu.Lock()
+	if call, ok := c.loads[key]; ok {
+		c.loadMu.Unlock()
+		<-call.done
+		return call.value, call.err
+	}
+
+	// A load may have completed between the lookup above and acquiring loadMu.
+	// The miss has already been counted, so this lookup must not count again.
+	if value, ok := c.peek(key, now); ok {
+		c.loadMu.Unlock()
+		return value, nil
+	}
+
+	call := &loadCall[V]{
+		done: make(chan struct{}),
+		err:  ErrLoaderPanicked,
+	}
+	if c.loads == nil {
+		c.loads = make(map[K]*loadCall[V])
+	}
+	c.loads[key] = call
+	c.loadMu.Unlock()
+
+	defer func() {
+		c.loadMu.Lock()
+		delete(c.loads, key)
+		c.loadMu.Unlock()
+		close(call.done)
+	}()
+
+	value, expiresAt, err := loader(key)
+	call.value, call.err = value, err
+
+	switch {
+	case err == nil:
+		if expiresAt.After(now) {
+			c.SetFromTail(key, value, now, expiresAt)
+		}
+	case c.negative != nil:
+		c.negative.SetFromTail(key, err, now, now.Add(c.negativeTTL))
+	}
+
+	return value, err
+}
+
+// peek returns the value associated with the given key, if it exists and is not expired,
+// without updating the lookup counters or the idle timeout.
+func (c *ExpirationCache[K, V]) peek(key K, now time.Time) (value V, ok bool) {
+	c.mu.RLock()
+	node, ok := c.nodeByKey[key]
+	ok = ok && node.expiresAt.After(now)
+	if ok {
+		value = node.Value
+	}
+	c.mu.RUnlock()
+	return value, ok
+}
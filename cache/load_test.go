@@ -0,0 +1,217 @@
+package cache_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+var errTestLoad = errors.New("test load error")
+
+func TestExpirationCacheGetOrLoad(t *testing.T) {
+	c := cache.NewExpirationCache[int, int](0)
+	now := time.Now()
+
+	var calls int
+	loader := func(key int) (int, time.Time, error) {
+		calls++
+		return -key, now.Add(time.Second), nil
+	}
+
+	for range 2 {
+		value, err := c.GetOrLoad(1, now, loader)
+		if value != -1 || err != nil {
+			t.Errorf("c.GetOrLoad(1) = %d, %v, want -1, nil", value, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loader called %d times, want 1", calls)
+	}
+
+	// Expired entries are loaded again.
+	now = now.Add(time.Second)
+	if _, err := c.GetOrLoad(1, now, loader); err != nil {
+		t.Errorf("c.GetOrLoad(1) = _, %v, want nil", err)
+	}
+	if calls != 2 {
+		t.Errorf("loader called %d times, want 2", calls)
+	}
+
+	// Each call counts one lookup: a miss for each load, and a hit otherwise.
+	want := cache.ExpirationCacheStats{Hits: 1, Misses: 2, ExpiredOnRead: 1, Expirations: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("c.Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExpirationCacheGetOrLoadError(t *testing.T) {
+	c := cache.NewExpirationCache[int, int](0)
+	now := time.Now()
+
+	var calls int
+	loader := func(key int) (int, time.Time, error) {
+		calls++
+		return 0, time.Time{}, errTestLoad
+	}
+
+	for range 2 {
+		if _, err := c.GetOrLoad(1, now, loader); err != errTestLoad {
+			t.Errorf("c.GetOrLoad(1) = _, %v, want %v", err, errTestLoad)
+		}
+	}
+	if calls != 2 {
+		t.Errorf("loader called %d times, want 2", calls)
+	}
+	if c.Contains(1) {
+		t.Error("c.Contains(1) = true, want false")
+	}
+}
+
+func TestExpirationCacheGetOrLoadNegativeTTL(t *testing.T) {
+	c := cache.ExpirationCacheConfig[int, int]{NegativeTTL: time.Second}.NewCache()
+	now := time.Now()
+
+	var calls int
+	loader := func(key int) (int, time.Time, error) {
+		calls++
+		if calls == 1 {
+			return 0, time.Time{}, errTestLoad
+		}
+		return -key, now.Add(time.Hour), nil
+	}
+
+	for range 2 {
+		if _, err := c.GetOrLoad(1, now, loader); err != errTestLoad {
+			t.Errorf("c.GetOrLoad(1) = _, %v, want %v", err, errTestLoad)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("loader called %d times, want 1", calls)
+	}
+
+	// Once the negative entry expires, the loader is called again.
+	now = now.Add(time.Second)
+	if value, err := c.GetOrLoad(1, now, loader); value != -1 || err != nil {
+		t.Errorf("c.GetOrLoad(1) = %d, %v, want -1, nil", value, err)
+	}
+	if calls != 2 {
+		t.Errorf("loader called %d times, want 2", calls)
+	}
+}
+
+func TestExpirationCacheGetOrLoadNegativeTTLRemoveClear(t *testing.T) {
+	c := cache.ExpirationCacheConfig[int, int]{NegativeTTL: time.Hour}.NewCache()
+	now := time.Now()
+
+	var fail bool
+	loader := func(key int) (int, time.Time, error) {
+		if fail {
+			return 0, time.Time{}, errTestLoad
+		}
+		return -key, now.Add(time.Hour), nil
+	}
+
+	fail = true
+	for _, key := range [...]int{1, 2} {
+		if _, err := c.GetOrLoad(key, now, loader); err != errTestLoad {
+			t.Errorf("c.GetOrLoad(%d) = _, %v, want %v", key, err, errTestLoad)
+		}
+	}
+	fail = false
+
+	// Remove forgets the error for its key only.
+	if c.Remove(1) {
+		t.Error("c.Remove(1) = true, want false")
+	}
+	if value, err := c.GetOrLoad(1, now, loader); value != -1 || err != nil {
+		t.Errorf("c.GetOrLoad(1) = %d, %v, want -1, nil", value, err)
+	}
+	if _, err := c.GetOrLoad(2, now, loader); err != errTestLoad {
+		t.Errorf("c.GetOrLoad(2) = _, %v, want %v", err, errTestLoad)
+	}
+
+	// Clear forgets all errors.
+	c.Clear()
+	if value, err := c.GetOrLoad(2, now, loader); value != -2 || err != nil {
+		t.Errorf("c.GetOrLoad(2) = %d, %v, want -2, nil", value, err)
+	}
+}
+
+func TestExpirationCacheGetOrLoadSingleflight(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		const waiters = 8
+
+		c := cache.NewExpirationCache[int, int](0)
+		now := time.Now()
+
+		var calls atomic.Int32
+		release := make(chan struct{})
+		loader := func(key int) (int, time.Time, error) {
+			calls.Add(1)
+			<-release
+			return -key, now.Add(time.Second), nil
+		}
+
+		var wg sync.WaitGroup
+		for range waiters {
+			wg.Go(func() {
+				if value, err := c.GetOrLoad(1, now, loader); value != -1 || err != nil {
+					t.Errorf("c.GetOrLoad(1) = %d, %v, want -1, nil", value, err)
+				}
+			})
+		}
+
+		// Wait for all callers to either run the loader or wait for it.
+		synctest.Wait()
+		close(release)
+		wg.Wait()
+
+		if got := calls.Load(); got != 1 {
+			t.Errorf("loader called %d times, want 1", got)
+		}
+	})
+}
+
+func TestExpirationCacheGetOrLoadPanic(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		c := cache.NewExpirationCache[int, int](0)
+		now := time.Now()
+
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer func() {
+				if recover() == nil {
+					t.Error("loader panic was not propagated")
+				}
+			}()
+			c.GetOrLoad(1, now, func(key int) (int, time.Time, error) {
+				<-release
+				panic("test panic")
+			})
+		}()
+		synctest.Wait()
+
+		result := make(chan error, 1)
+		go func() {
+			_, err := c.GetOrLoad(1, now, func(key int) (int, time.Time, error) {
+				t.Error("loader called while another load is in flight")
+				return 0, time.Time{}, nil
+			})
+			result <- err
+		}()
+		synctest.Wait()
+
+		close(release)
+		<-done
+		if err := <-result; err != cache.ErrLoaderPanicked {
+			t.Errorf("c.GetOrLoad(1) = _, %v, want %v", err, cache.ErrLoaderPanicked)
+		}
+	})
+}
@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// ReplayFilter remembers keys seen within a fixed window, such as salts or session IDs, to reject replays.
+type ReplayFilter[K comparable] interface {
+	// Check records key as seen at now, and returns true if it was not seen within the window before now.
+	// A false return means the key is a replay and must be rejected.
+	Check(key K, now time.Time) bool
+}
+
+// ExactReplayFilter is a [ReplayFilter] backed by an [ExpirationCache].
+// It never accepts a replay within the window, but uses memory proportional to the number of keys seen within the window.
+type ExactReplayFilter[K comparable] struct {
+	// mu makes looking up and recording a key atomic, so that concurrent checks never accept the same key twice.
+	mu     sync.Mutex
+	window time.Duration
+	cache  *ExpirationCache[K, struct{}]
+}
+
+// NewExactReplayFilter returns a new exact replay filter that remembers each key for the given window.
+//
+// If capacity is positive, at most capacity keys are remembered. When the filter is full of keys
+// still within their window, new keys are rejected as if they were replays, until some of them expire.
+// Pick a capacity well above the expected number of keys per window, or use 0 for no limit.
+func NewExactReplayFilter[K comparable](window time.Duration, capacity int) *ExactReplayFilter[K] {
+	return &ExactReplayFilter[K]{
+		window: window,
+		cache:  NewExpirationCache[K, struct{}](capacity),
+	}
+}
+
+// Window returns the duration for which each key is remembered.
+func (f *ExactReplayFilter[K]) Window() time.Duration {
+	return f.window
+}
+
+// Len returns the number of keys remembered by the filter, including expired keys not yet pruned.
+func (f *ExactReplayFilter[K]) Len() int {
+	return f.cache.Len()
+}
+
+// Check implements [ReplayFilter.Check].
+func (f *ExactReplayFilter[K]) Check(key K, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.cache.Get(key, now); ok {
+		return false
+	}
+
+	// Never let the cache evict an unexpired key to make room, or its replay would be accepted.
+	if capacity := f.cache.Capacity(); f.cache.Len() >= capacity {
+		for range f.cache.PopExpired(now) {
+		}
+		if f.cache.Len() >= capacity {
+			return false
+		}
+	}
+
+	f.cache.SetFromTail(key, struct{}{}, now, now.Add(f.window))
+	return true
+}
+
+// BloomReplayFilter is a [ReplayFilter] backed by two rotating Bloom filters.
+// Its memory usage is fixed at creation, at the cost of a small rate of false positives,
+// where a key never seen before is reported as a replay.
+//
+// Keys are added to the current filter, and looked up in both the current and the previous filter.
+// Every window, the previous filter is discarded and the current filter takes its place.
+// Each key is therefore remembered for at least one window, and at most two.
+type BloomReplayFilter[K comparable] struct {
+	mu        sync.Mutex
+	seed      maphash.Seed
+	window    time.Duration
+	rotatedAt time.Time
+	current   bloomFilter
+	previous  bloomFilter
+	capacity  int
+	fpRate    float64
+}
+
+// NewBloomReplayFilter returns a new Bloom replay filter that remembers each key for at least the given window.
+//
+// capacity is the expected maximum number of keys seen within one window.
+// falsePositiveRate is the target probability of rejecting a fresh key when the filter holds capacity keys per window,
+// and must be in the open interval (0, 1). Each of the two filters is sized for half the target rate,
+// so the combined rate stays below the target.
+//
+// Each filter uses about -capacity * ln(falsePositiveRate/2) / ln(2)^2 bits.
+// For example, 1 million keys at a 1e-6 rate take about 3.6 MiB per filter.
+func NewBloomReplayFilter[K comparable](window time.Duration, capacity int, falsePositiveRate float64) *BloomReplayFilter[K] {
+	if capacity <= 0 {
+		panic("cache: non-positive capacity for NewBloomReplayFilter")
+	}
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		panic("cache: false positive rate for NewBloomReplayFilter out of range (0, 1)")
+	}
+
+	// m = -n * ln(p) / ln(2)^2, k = m/n * ln(2)
+	p := falsePositiveRate / 2
+	m := math.Ceil(-float64(capacity) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := max(int(math.Round(m/float64(capacity)*math.Ln2)), 1)
+	words := (int(m) + 63) / 64
+
+	return &BloomReplayFilter[K]{
+		seed:     maphash.MakeSeed(),
+		window:   window,
+		current:  newBloomFilter(words, k),
+		previous: newBloomFilter(words, k),
+		capacity: capacity,
+		fpRate:   falsePositiveRate,
+	}
+}
+
+// Window returns the minimum duration for which each key is remembered.
+func (f *BloomReplayFilter[K]) Window() time.Duration {
+	return f.window
+}
+
+// Capacity returns the expected maximum number of keys per window the filter was sized for.
+func (f *BloomReplayFilter[K]) Capacity() int {
+	return f.capacity
+}
+
+// FalsePositiveRate returns the target false positive rate the filter was sized for.
+// The actual rate is higher if more than Capacity keys are seen within a window.
+func (f *BloomReplayFilter[K]) FalsePositiveRate() float64 {
+	return f.fpRate
+}
+
+// SizeBytes returns the memory used by the bit arrays of both filters.
+func (f *BloomReplayFilter[K]) SizeBytes() int {
+	return 2 * 8 * len(f.current.bits)
+}
+
+// Check implements [ReplayFilter.Check].
+func (f *BloomReplayFilter[K]) Check(key K, now time.Time) bool {
+	h := maphash.Comparable(f.seed, key)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rotate(now)
+	if f.current.contains(h) || f.previous.contains(h) {
+		return false
+	}
+	f.current.add(h)
+	return true
+}
+
+// rotate discards filters that only hold keys older than the window.
+func (f *BloomReplayFilter[K]) rotate(now time.Time) {
+	if f.rotatedAt.IsZero() {
+		f.rotatedAt = now
+		return
+	}
+
+	elapsed := now.Sub(f.rotatedAt)
+	switch {
+	case elapsed < f.window:
+	case elapsed < 2*f.window:
+		f.current, f.previous = f.previous, f.current
+		f.current.clear()
+		f.rotatedAt = f.rotatedAt.Add(f.window)
+	default:
+		f.current.clear()
+		f.previous.clear()
+		f.rotatedAt = now
+	}
+}
+
+// bloomFilter is a Bloom filter over 64-bit hashes, using double hashing to derive k bit positions.
+type bloomFilter struct {
+	bits []uint64
+	k    int
+}
+
+func newBloomFilter(words, k int) bloomFilter {
+	return bloomFilter{
+		bits: make([]uint64, words),
+		k:    k,
+	}
+}
+
+// position returns the i-th bit position of h, out of m bits.
+// The positions are derived by double hashing, and mapped to [0, m) by multiplication instead of modulo.
+func (f *bloomFilter) position(h, i, m uint64) uint64 {
+	hi, _ := bits.Mul64(h+i*(bits.RotateLeft64(h, 32)|1), m)
+	return hi
+}
+
+func (f *bloomFilter) contains(h uint64) bool {
+	m := uint64(len(f.bits)) * 64
+	for i := range uint64(f.k) {
+		pos := f.position(h, i, m)
+		if f.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) add(h uint64) {
+	m := uint64(len(f.bits)) * 64
+	for i := range uint64(f.k) {
+		pos := f.position(h, i, m)
+		f.bits[pos/64] |= 1 << (pos % 64)
+	}
+}
+
+func (f *bloomFilter) clear() {
+	clear(f.bits)
+}
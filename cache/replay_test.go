@@ -0,0 +1,212 @@
+package cache_test
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+var replayFilters = [...]struct {
+	name string
+	new  func(window time.Duration) cache.ReplayFilter[[32]byte]
+}{
+	{"Exact", func(window time.Duration) cache.ReplayFilter[[32]byte] {
+		return cache.NewExactReplayFilter[[32]byte](window, 0)
+	}},
+	{"Bloom", func(window time.Duration) cache.ReplayFilter[[32]byte] {
+		return cache.NewBloomReplayFilter[[32]byte](window, 1024, 1e-6)
+	}},
+}
+
+func TestReplayFilter(t *testing.T) {
+	for _, f := range replayFilters {
+		t.Run(f.name, func(t *testing.T) {
+			testReplayFilter(t, f.new(time.Minute))
+		})
+	}
+}
+
+func testReplayFilter(t *testing.T, f cache.ReplayFilter[[32]byte]) {
+	now := time.Now()
+	salt0 := [32]byte{0}
+	salt1 := [32]byte{1}
+
+	if !f.Check(salt0, now) {
+		t.Error("f.Check(salt0) = false, want true")
+	}
+	if f.Check(salt0, now) {
+		t.Error("f.Check(salt0) = true, want false for replay")
+	}
+
+	now = now.Add(30 * time.Second)
+	if !f.Check(salt1, now) {
+		t.Error("f.Check(salt1) = false, want true")
+	}
+	if f.Check(salt0, now) {
+		t.Error("f.Check(salt0) = true, want false for replay within window")
+	}
+
+	// Long after the window, both keys are forgotten.
+	now = now.Add(5 * time.Minute)
+	if !f.Check(salt0, now) {
+		t.Error("f.Check(salt0) = false, want true after window")
+	}
+	if !f.Check(salt1, now) {
+		t.Error("f.Check(salt1) = false, want true after window")
+	}
+}
+
+func TestExactReplayFilterWindow(t *testing.T) {
+	f := cache.NewExactReplayFilter[int](time.Second, 0)
+	now := time.Now()
+	f.Check(1, now)
+	f.Check(2, now.Add(500*time.Millisecond))
+
+	now = now.Add(time.Second)
+	if !f.Check(1, now) {
+		t.Error("f.Check(1) = false, want true at end of window")
+	}
+	if f.Check(2, now) {
+		t.Error("f.Check(2) = true, want false within window")
+	}
+	if got := f.Len(); got != 2 {
+		t.Errorf("f.Len() = %d, want 2", got)
+	}
+}
+
+func TestExactReplayFilterFull(t *testing.T) {
+	f := cache.NewExactReplayFilter[int](time.Second, 2)
+	now := time.Now()
+	f.Check(1, now)
+	f.Check(2, now)
+
+	// A full filter rejects new keys instead of forgetting keys within their window.
+	if f.Check(3, now) {
+		t.Error("f.Check(3) = true, want false when full")
+	}
+	if f.Check(1, now) {
+		t.Error("f.Check(1) = true, want false within window")
+	}
+
+	// Expired keys make room for new ones.
+	now = now.Add(time.Second)
+	if !f.Check(3, now) {
+		t.Error("f.Check(3) = false, want true after window")
+	}
+	if got := f.Len(); got != 1 {
+		t.Errorf("f.Len() = %d, want 1", got)
+	}
+}
+
+func TestBloomReplayFilterWindow(t *testing.T) {
+	f := cache.NewBloomReplayFilter[int](time.Second, 16, 1e-9)
+	now := time.Now()
+	f.Check(1, now)
+
+	// A key is remembered for at least one window, and at most two.
+	if f.Check(1, now.Add(1999*time.Millisecond)) {
+		t.Error("f.Check(1) = true, want false within two windows")
+	}
+	if !f.Check(1, now.Add(4*time.Second)) {
+		t.Error("f.Check(1) = false, want true after two windows")
+	}
+}
+
+func TestBloomReplayFilterFalsePositiveRate(t *testing.T) {
+	const (
+		capacity = 10000
+		fpRate   = 0.01
+	)
+
+	f := cache.NewBloomReplayFilter[uint64](time.Minute, capacity, fpRate)
+	if got := f.Capacity(); got != capacity {
+		t.Errorf("f.Capacity() = %d, want %d", got, capacity)
+	}
+	if got := f.FalsePositiveRate(); got != fpRate {
+		t.Errorf("f.FalsePositiveRate() = %v, want %v", got, fpRate)
+	}
+
+	now := time.Now()
+	for key := range uint64(capacity) {
+		f.Check(key, now)
+	}
+
+	// Fill the current filter too, leaving room for the probe keys,
+	// which are added as they are checked. Both filters end up at capacity.
+	const probes = 2000
+	now = now.Add(time.Minute)
+	for key := range uint64(capacity - probes) {
+		f.Check(capacity+key, now)
+	}
+
+	var falsePositives int
+	for key := range uint64(probes) {
+		if !f.Check(2*capacity+key, now) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / probes; rate > 2*fpRate {
+		t.Errorf("false positive rate = %v, want at most about %v", rate, fpRate)
+	}
+}
+
+func BenchmarkReplayFilter(b *testing.B) {
+	const size = 1 << 20
+
+	for _, c := range [...]struct {
+		name string
+		new  func() cache.ReplayFilter[[32]byte]
+	}{
+		{"Exact", func() cache.ReplayFilter[[32]byte] {
+			return cache.NewExactReplayFilter[[32]byte](time.Minute, 0)
+		}},
+		{"Bloom", func() cache.ReplayFilter[[32]byte] {
+			return cache.NewBloomReplayFilter[[32]byte](time.Minute, 2*size, 1e-6)
+		}},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			f := c.new()
+			now := time.Now()
+			var salt [32]byte
+			rand.Read(salt[8:])
+			for i := range uint64(size) {
+				binary.LittleEndian.PutUint64(salt[:], i)
+				f.Check(salt, now)
+			}
+
+			b.Run("Fresh", func(b *testing.B) {
+				i := uint64(size)
+				for b.Loop() {
+					binary.LittleEndian.PutUint64(salt[:], i)
+					f.Check(salt, now)
+					i++
+				}
+			})
+
+			b.Run("Replay", func(b *testing.B) {
+				var i uint64
+				for b.Loop() {
+					binary.LittleEndian.PutUint64(salt[:], i%size)
+					f.Check(salt, now)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkBloomReplayFilterSessionID(b *testing.B) {
+	const size = 1 << 20
+
+	f := cache.NewBloomReplayFilter[uint64](time.Minute, 2*size, 1e-6)
+	b.ReportMetric(float64(f.SizeBytes()), "filter-bytes")
+	now := time.Now()
+	var sid uint64
+	for b.Loop() {
+		f.Check(sid, now)
+		sid++
+	}
+}
@@ -0,0 +1,252 @@
+package cache
+
+import (
+	"context"
+	"hash/maphash"
+	"iter"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ShardedExpirationCache is an expiration cache split into shards by a hash of the key.
+// Each shard is an [*ExpirationCache] with its own lock and expiration order,
+// so operations on keys in different shards do not contend with each other.
+//
+// The capacity is split evenly across the shards. When a shard is full, insertions into it
+// evict the shard's earliest-expiring entry, which is not necessarily the earliest in the whole cache.
+//
+// The cost budget is split the same way, and each shard enforces its own share.
+// An entry must fit in its shard's share, so the largest entry the cache accepts
+// is [ShardedExpirationCache.MaxEntryCost], not the whole budget.
+type ShardedExpirationCache[K comparable, V any] struct {
+	seed     maphash.Seed
+	shards   []*ExpirationCache[K, V]
+	capacity int
+	maxCost  int64
+}
+
+// NewShardedExpirationCache returns a new sharded expiration cache with the given total capacity and number of shards.
+// If capacity is not positive, the cache will be effectively unbounded.
+// If shards is not positive, the number of shards defaults to [runtime.GOMAXPROCS].
+func NewShardedExpirationCache[K comparable, V any](capacity, shards int) *ShardedExpirationCache[K, V] {
+	return ExpirationCacheConfig[K, V]{Capacity: capacity}.NewShardedCache(shards)
+}
+
+// NewShardedCache returns a new sharded expiration cache with the config and the given number of shards.
+// Capacity and MaxCost are split evenly across the shards. The other options apply to each shard.
+//
+// If shards is not positive, the number of shards defaults to [runtime.GOMAXPROCS].
+// The number of shards never exceeds a positive capacity or a positive MaxCost,
+// so that each shard holds at least one entry, and has a cost budget of at least 1.
+func (cfg ExpirationCacheConfig[K, V]) NewShardedCache(shards int) *ShardedExpirationCache[K, V] {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+
+	capacity := cfg.Capacity
+	if capacity > 0 {
+		shards = min(shards, capacity)
+	}
+	if cfg.MaxCost > 0 {
+		shards = int(min(int64(shards), cfg.MaxCost))
+	}
+
+	c := ShardedExpirationCache[K, V]{
+		seed:     maphash.MakeSeed(),
+		shards:   make([]*ExpirationCache[K, V], shards),
+		capacity: capacity,
+		maxCost:  max(cfg.MaxCost, 0),
+	}
+
+	shardCfg := cfg
+	for i := range c.shards {
+		if capacity > 0 {
+			shardCfg.Capacity = capacity / shards
+			if i < capacity%shards {
+				shardCfg.Capacity++
+			}
+		}
+		if cfg.MaxCost > 0 {
+			shardCfg.MaxCost = cfg.MaxCost / int64(shards)
+			if int64(i) < cfg.MaxCost%int64(shards) {
+				shardCfg.MaxCost++
+			}
+		}
+		c.shards[i] = shardCfg.NewCache()
+	}
+
+	if capacity <= 0 {
+		c.capacity = c.shards[0].capacity
+	}
+	return &c
+}
+
+// shard returns the shard that owns the given key.
+func (c *ShardedExpirationCache[K, V]) shard(key K) *ExpirationCache[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+// Shards returns the number of shards.
+func (c *ShardedExpirationCache[K, V]) Shards() int {
+	return len(c.shards)
+}
+
+// Len returns the number of entries in the cache.
+//
+// The shards are counted one after another, so the result may be inconsistent under concurrent writes.
+func (c *ShardedExpirationCache[K, V]) Len() int {
+	var length int
+	for _, s := range c.shards {
+		length += s.Len()
+	}
+	return length
+}
+
+// Capacity returns the maximum number of entries the cache can hold.
+func (c *ShardedExpirationCache[K, V]) Capacity() int {
+	return c.capacity
+}
+
+// Contains returns whether the cache contains the given key.
+func (c *ShardedExpirationCache[K, V]) Contains(key K) bool {
+	return c.shard(key).Contains(key)
+}
+
+// TryContains is like Contains, but it immediately returns false if the key's shard is contended.
+func (c *ShardedExpirationCache[K, V]) TryContains(key K) bool {
+	return c.shard(key).TryContains(key)
+}
+
+// Get returns the value associated with the given key, if it exists and is not expired.
+func (c *ShardedExpirationCache[K, V]) Get(key K, now time.Time) (value V, ok bool) {
+	return c.shard(key).Get(key, now)
+}
+
+// GetEntry returns the entry associated with the given key, if it exists and is not expired.
+func (c *ShardedExpirationCache[K, V]) GetEntry(key K, now time.Time) (entry *Entry[K, V], ok bool) {
+	return c.shard(key).GetEntry(key, now)
+}
+
+// SetFromHead is like [ExpirationCache.SetFromHead], but only prunes and evicts entries in the key's shard.
+func (c *ShardedExpirationCache[K, V]) SetFromHead(key K, value V, now, expiresAt time.Time) {
+	c.shard(key).SetFromHead(key, value, now, expiresAt)
+}
+
+// SetFromTail is like [ExpirationCache.SetFromTail], but only prunes and evicts entries in the key's shard.
+func (c *ShardedExpirationCache[K, V]) SetFromTail(key K, value V, now, expiresAt time.Time) {
+	c.shard(key).SetFromTail(key, value, now, expiresAt)
+}
+
+// Touch sets the expiration time of the entry for the given key without changing its value,
+// and returns whether the entry exists and is not expired. See [ExpirationCache.Touch].
+func (c *ShardedExpirationCache[K, V]) Touch(key K, now, expiresAt time.Time) bool {
+	return c.shard(key).Touch(key, now, expiresAt)
+}
+
+// GetOrLoad is like [ExpirationCache.GetOrLoad]. Concurrent loads for keys in different shards do not contend.
+func (c *ShardedExpirationCache[K, V]) GetOrLoad(key K, now time.Time, loader func(key K) (value V, expiresAt time.Time, err error)) (V, error) {
+	return c.shard(key).GetOrLoad(key, now, loader)
+}
+
+// Remove deletes the value associated with the given key and returns whether the key was found.
+func (c *ShardedExpirationCache[K, V]) Remove(key K) bool {
+	return c.shard(key).Remove(key)
+}
+
+// Clear removes all entries from the cache.
+func (c *ShardedExpirationCache[K, V]) Clear() {
+	for _, s := range c.shards {
+		s.Clear()
+	}
+}
+
+// RunJanitor runs a janitor on each shard until ctx is canceled.
+// See [ExpirationCache.RunJanitor] for details.
+func (c *ShardedExpirationCache[K, V]) RunJanitor(ctx context.Context, clock Clock) {
+	var wg sync.WaitGroup
+	for _, s := range c.shards {
+		wg.Go(func() {
+			s.RunJanitor(ctx, clock)
+		})
+	}
+	wg.Wait()
+}
+
+// All returns an iterator over all entries in the cache,
+// starting from the earliest expiration to the latest expiration across all shards.
+//
+// An ongoing iterator blocks concurrent writes to all shards until it completes.
+func (c *ShardedExpirationCache[K, V]) All() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.rlockAll()
+		defer c.runlockAll()
+		c.merge((*ExpirationCache[K, V]).ascend, func(a, b *expirationNode[K, V]) bool {
+			return a.expiresAt.Before(b.expiresAt)
+		}, yield)
+	}
+}
+
+// Backward returns an iterator over all entries in the cache,
+// starting from the latest expiration to the earliest expiration across all shards.
+//
+// An ongoing iterator blocks concurrent writes to all shards until it completes.
+func (c *ShardedExpirationCache[K, V]) Backward() iter.Seq2[K, V] {
+	return func(yield func(K, V) bool) {
+		c.rlockAll()
+		defer c.runlockAll()
+		c.merge((*ExpirationCache[K, V]).descend, func(a, b *expirationNode[K, V]) bool {
+			return a.expiresAt.After(b.expiresAt)
+		}, yield)
+	}
+}
+
+// rlockAll acquires the read locks of all shards in order.
+func (c *ShardedExpirationCache[K, V]) rlockAll() {
+	for _, s := range c.shards {
+		s.mu.RLock()
+	}
+}
+
+// runlockAll releases the read locks of all shards.
+func (c *ShardedExpirationCache[K, V]) runlockAll() {
+	for _, s := range c.shards {
+		s.mu.RUnlock()
+	}
+}
+
+// merge merges the per-shard node sequences returned by seq into a single ordered sequence,
+// where before reports whether a node must be yielded before another.
+// The caller must hold the read locks of all shards.
+func (c *ShardedExpirationCache[K, V]) merge(
+	seq func(*ExpirationCache[K, V]) iter.Seq[*expirationNode[K, V]],
+	before func(a, b *expirationNode[K, V]) bool,
+	yield func(K, V) bool,
+) {
+	nexts := make([]func() (*expirationNode[K, V], bool), len(c.shards))
+	heads := make([]*expirationNode[K, V], len(c.shards))
+	for i, s := range c.shards {
+		next, stop := iter.Pull(seq(s))
+		defer stop()
+		nexts[i] = next
+		heads[i], _ = next()
+	}
+
+	for {
+		best := -1
+		for i, node := range heads {
+			if node != nil && (best == -1 || before(node, heads[best])) {
+				best = i
+			}
+		}
+		if best == -1 {
+			return
+		}
+
+		node := heads[best]
+		if !yield(node.Key, node.Value) {
+			return
+		}
+		heads[best], _ = nexts[best]()
+	}
+}
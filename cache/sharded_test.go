@@ -0,0 +1,171 @@
+package cache_test
+
+import (
+	"math"
+	mrand "math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+func TestShardedExpirationCache(t *testing.T) {
+	for _, ordering := range [...]cache.ExpirationOrdering{cache.ListOrdering, cache.HeapOrdering} {
+		t.Run(ordering.String(), func(t *testing.T) {
+			testShardedExpirationCache(t, cache.ExpirationCacheConfig[int, int]{Ordering: ordering}.NewShardedCache(4))
+		})
+	}
+}
+
+func testShardedExpirationCache(t *testing.T, c *cache.ShardedExpirationCache[int, int]) {
+	const count = 100
+
+	if got := c.Shards(); got != 4 {
+		t.Errorf("c.Shards() = %d, want 4", got)
+	}
+	if got := c.Capacity(); got != math.MaxInt {
+		t.Errorf("c.Capacity() = %d, want %d", got, math.MaxInt)
+	}
+
+	now := time.Now()
+	r := mrand.New(mrand.NewPCG(1, 2))
+	offsets := r.Perm(count)
+	for key, offset := range offsets {
+		c.SetFromTail(key, -key, now, now.Add(time.Duration(offset+1)*time.Second))
+	}
+	if got := c.Len(); got != count {
+		t.Errorf("c.Len() = %d, want %d", got, count)
+	}
+
+	// Keys ordered by expiration time.
+	want := make([]cache.Entry[int, int], count)
+	for key, offset := range offsets {
+		want[offset] = cache.Entry[int, int]{Key: key, Value: -key}
+	}
+
+	if got := slices.Collect(entries(c.All())); !slices.Equal(got, want) {
+		t.Errorf("c.All() = %v, want %v", got, want)
+	}
+	if got := slices.Collect(entries(c.Backward())); !slicesReverseEqual(got, want) {
+		t.Errorf("c.Backward() = %v, want reverse of %v", got, want)
+	}
+
+	// Stopping early must release all shard locks.
+	for range c.All() {
+		break
+	}
+
+	for key := range count {
+		if value, ok := c.Get(key, now); value != -key || !ok {
+			t.Errorf("c.Get(%d) = %d, %v, want %d, true", key, value, ok, -key)
+		}
+		if !c.TryContains(key) {
+			t.Errorf("c.TryContains(%d) = false, want true", key)
+		}
+	}
+
+	// Setting expires entries in the key's shard.
+	now = now.Add(count / 2 * time.Second)
+	for key := range count {
+		c.SetFromTail(key, key, now, now.Add(time.Duration(offsets[key]+1)*time.Second))
+	}
+	for key, offset := range offsets {
+		want[offset] = cache.Entry[int, int]{Key: key, Value: key}
+	}
+	if got := slices.Collect(entries(c.All())); !slices.Equal(got, want) {
+		t.Errorf("c.All() = %v, want %v", got, want)
+	}
+
+	if !c.Remove(0) {
+		t.Error("c.Remove(0) = false, want true")
+	}
+	if c.Contains(0) {
+		t.Error("c.Contains(0) = true, want false")
+	}
+
+	c.Clear()
+	if got := c.Len(); got != 0 {
+		t.Errorf("c.Len() = %d, want 0", got)
+	}
+}
+
+func TestShardedExpirationCacheCapacity(t *testing.T) {
+	c := cache.NewShardedExpirationCache[int, int](10, 4)
+	if got := c.Capacity(); got != 10 {
+		t.Errorf("c.Capacity() = %d, want 10", got)
+	}
+
+	now := time.Now()
+	for key := range 1000 {
+		c.SetFromTail(key, key, now, now.Add(time.Duration(key+1)*time.Second))
+	}
+	if got := c.Len(); got > 10 {
+		t.Errorf("c.Len() = %d, want at most 10", got)
+	}
+
+	// Each shard must be able to hold at least one entry.
+	c = cache.NewShardedExpirationCache[int, int](2, 4)
+	if got := c.Shards(); got != 2 {
+		t.Errorf("c.Shards() = %d, want 2", got)
+	}
+}
+
+// expirationCacheSetGetter is the subset of methods shared by
+// [cache.ExpirationCache] and [cache.ShardedExpirationCache] used by the parallel benchmarks.
+type expirationCacheSetGetter interface {
+	Get(key int, now time.Time) (int, bool)
+	SetFromTail(key, value int, now, expiresAt time.Time)
+}
+
+func BenchmarkExpirationCacheParallel(b *testing.B) {
+	const size = 1 << 16
+
+	for _, c := range [...]struct {
+		name string
+		new  func() expirationCacheSetGetter
+	}{
+		{"Single", func() expirationCacheSetGetter { return cache.NewExpirationCache[int, int](size) }},
+		{"Sharded", func() expirationCacheSetGetter { return cache.NewShardedExpirationCache[int, int](size, 0) }},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			for _, w := range [...]struct {
+				name       string
+				setPercent int
+			}{
+				{"Get", 0},
+				{"Mixed", 10},
+				{"Set", 100},
+			} {
+				b.Run(w.name, func(b *testing.B) {
+					benchmarkExpirationCacheParallel(b, c.new(), size, w.setPercent)
+				})
+			}
+		})
+	}
+}
+
+func benchmarkExpirationCacheParallel(b *testing.B, c expirationCacheSetGetter, size, setPercent int) {
+	now := time.Now()
+	base := now.Add(time.Hour)
+	for key := range size {
+		c.SetFromTail(key, key, now, base.Add(time.Duration(key)*time.Millisecond))
+	}
+
+	var seq atomic.Uint64
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := mrand.New(mrand.NewPCG(uint64(seq.Add(1)), 0))
+		i := size
+		for pb.Next() {
+			key := r.IntN(size)
+			if r.IntN(100) < setPercent {
+				c.SetFromTail(key, key, now, base.Add(time.Duration(i)*time.Millisecond))
+				i++
+			} else {
+				c.Get(key, now)
+			}
+		}
+	})
+}
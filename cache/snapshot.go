@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// Codec encodes and decodes keys or values of type T in a cache snapshot.
+type Codec[T any] interface {
+	// Append appends the binary encoding of v to b and returns the extended buffer.
+	Append(b []byte, v T) ([]byte, error)
+
+	// Decode decodes a value from its binary encoding.
+	// Decode must not retain b after returning.
+	Decode(b []byte) (T, error)
+}
+
+const (
+	snapshotMagic   = "CGPXC"
+	snapshotVersion = 1
+)
+
+var (
+	// ErrInvalidSnapshot is returned when the input is not a valid snapshot.
+	ErrInvalidSnapshot = errors.New("cache: invalid snapshot")
+
+	// ErrUnsupportedSnapshotVersion is returned when the snapshot was written in an unknown format version.
+	ErrUnsupportedSnapshotVersion = errors.New("cache: unsupported snapshot version")
+)
+
+// WriteSnapshot writes all entries in the cache to w, in expiration order.
+// Keys and values are encoded by keyCodec and valueCodec, and expiration times are kept as absolute times.
+//
+// The snapshot format is:
+//
+//	magic   = "CGPXC"
+//	version = byte (1)
+//	count   = uvarint
+//	entries = count * entry
+//	entry   = seconds (int64 BE) + nanoseconds (uint32 BE) + key length (uvarint) + key + value length (uvarint) + value
+//
+// The cache is read-locked while writing, which blocks concurrent writes until WriteSnapshot returns.
+func (c *ExpirationCache[K, V]) WriteSnapshot(w io.Writer, keyCodec Codec[K], valueCodec Codec[V]) error {
+	bw := bufio.NewWriter(w)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	b := make([]byte, 0, 64)
+	b = append(b, snapshotMagic...)
+	b = append(b, snapshotVersion)
+	b = binary.AppendUvarint(b, uint64(len(c.nodeByKey)))
+	if _, err := bw.Write(b); err != nil {
+		return err
+	}
+
+	var field []byte
+	for node := range c.ascend() {
+		b = binary.BigEndian.AppendUint64(b[:0], uint64(node.expiresAt.Unix()))
+		b = binary.BigEndian.AppendUint32(b, uint32(node.expiresAt.Nanosecond()))
+
+		var err error
+		field, err = keyCodec.Append(field[:0], node.Key)
+		if err != nil {
+			return fmt.Errorf("failed to encode key: %w", err)
+		}
+		b = binary.AppendUvarint(b, uint64(len(field)))
+		b = append(b, field...)
+
+		field, err = valueCodec.Append(field[:0], node.Value)
+		if err != nil {
+			return fmt.Errorf("failed to encode value: %w", err)
+		}
+		b = binary.AppendUvarint(b, uint64(len(field)))
+		b = append(b, field...)
+
+		if _, err = bw.Write(b); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// ReadSnapshot reads a snapshot written by [ExpirationCache.WriteSnapshot] from r,
+// and inserts its entries into the cache with SetMany. Entries already expired at now are dropped.
+// It returns the number of unexpired entries read. This may be more than the number of entries kept,
+// as later entries replace earlier ones with the same key, and capacity or cost limits may evict some right away.
+//
+// The whole snapshot is decoded before any entry is inserted,
+// so the cache is left unchanged if the snapshot is invalid.
+// Malformed and truncated snapshots return an error that wraps [ErrInvalidSnapshot].
+func (c *ExpirationCache[K, V]) ReadSnapshot(r io.Reader, now time.Time, keyCodec Codec[K], valueCodec Codec[V]) (int, error) {
+	br := bufio.NewReader(r)
+
+	var header [len(snapshotMagic) + 1]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return 0, snapshotReadError(err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrInvalidSnapshot
+	}
+	if version := header[len(snapshotMagic)]; version != snapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedSnapshotVersion, version)
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, snapshotReadError(err)
+	}
+
+	var (
+		entries []ExpiringEntry[K, V]
+		buf     bytes.Buffer
+		fixed   [12]byte
+	)
+
+	for range count {
+		if _, err = io.ReadFull(br, fixed[:]); err != nil {
+			return 0, snapshotReadError(err)
+		}
+		sec := int64(binary.BigEndian.Uint64(fixed[:]))
+		nsec := binary.BigEndian.Uint32(fixed[8:])
+		if nsec >= uint32(time.Second) {
+			return 0, fmt.Errorf("%w: nanoseconds out of range: %d", ErrInvalidSnapshot, nsec)
+		}
+
+		if err = readSnapshotField(br, &buf); err != nil {
+			return 0, err
+		}
+		key, err := keyCodec.Decode(buf.Bytes())
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode key: %w", err)
+		}
+
+		if err = readSnapshotField(br, &buf); err != nil {
+			return 0, err
+		}
+		value, err := valueCodec.Decode(buf.Bytes())
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode value: %w", err)
+		}
+
+		expiresAt := time.Unix(sec, int64(nsec))
+		if !expiresAt.After(now) {
+			continue
+		}
+		entries = append(entries, ExpiringEntry[K, V]{Entry[K, V]{key, value}, expiresAt})
+	}
+
+	c.SetMany(entries, now)
+	return len(entries), nil
+}
+
+// readSnapshotField reads a length-prefixed field from br into buf, replacing its contents.
+func readSnapshotField(br *bufio.Reader, buf *bytes.Buffer) error {
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		return snapshotReadError(err)
+	}
+	if length > math.MaxInt {
+		return fmt.Errorf("%w: field length out of range: %d", ErrInvalidSnapshot, length)
+	}
+	buf.Reset()
+	// Copy instead of allocating the full length upfront, so that a corrupted length
+	// in a truncated snapshot does not cause a huge allocation.
+	if _, err = io.CopyN(buf, br, int64(length)); err != nil {
+		return snapshotReadError(err)
+	}
+	return nil
+}
+
+// snapshotReadError converts a premature EOF into an error that wraps both [ErrInvalidSnapshot] and [io.ErrUnexpectedEOF].
+func snapshotReadError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, io.ErrUnexpectedEOF)
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package cache_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+// varintCodec encodes ints as varints.
+type varintCodec struct{}
+
+func (varintCodec) Append(b []byte, v int) ([]byte, error) {
+	return binary.AppendVarint(b, int64(v)), nil
+}
+
+func (varintCodec) Decode(b []byte) (int, error) {
+	v, n := binary.Varint(b)
+	if n <= 0 || n != len(b) {
+		return 0, errors.New("invalid varint")
+	}
+	return int(v), nil
+}
+
+func TestExpirationCacheSnapshot(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			src := o.new(0)
+			now := time.Now()
+			src.SetFromTail(1, -1, now, now.Add(time.Second))
+			src.SetFromTail(2, -2, now, now.Add(2*time.Second+time.Nanosecond))
+			src.SetFromTail(3, -3, now, now.Add(3*time.Second))
+
+			var buf bytes.Buffer
+			if err := src.WriteSnapshot(&buf, varintCodec{}, varintCodec{}); err != nil {
+				t.Fatalf("src.WriteSnapshot() = %v", err)
+			}
+			snapshot := buf.Bytes()
+
+			dst := o.new(0)
+			n, err := dst.ReadSnapshot(bytes.NewReader(snapshot), now, varintCodec{}, varintCodec{})
+			if n != 3 || err != nil {
+				t.Fatalf("dst.ReadSnapshot() = %d, %v, want 3, nil", n, err)
+			}
+			assertExpirationCacheLenCapacityContent(t, dst, []cache.Entry[int, int]{{1, -1}, {2, -2}, {3, -3}}, dst.Capacity(), now)
+
+			// Expiration times are kept as absolute times, so entries expired at load time are dropped.
+			now = now.Add(2 * time.Second)
+			dst = o.new(0)
+			n, err = dst.ReadSnapshot(bytes.NewReader(snapshot), now, varintCodec{}, varintCodec{})
+			if n != 2 || err != nil {
+				t.Fatalf("dst.ReadSnapshot() = %d, %v, want 2, nil", n, err)
+			}
+			assertExpirationCacheLenCapacityContent(t, dst, []cache.Entry[int, int]{{2, -2}, {3, -3}}, dst.Capacity(), now)
+			if _, ok := dst.Get(2, now.Add(time.Nanosecond)); ok {
+				t.Error("dst.Get(2) = _, true, want false")
+			}
+
+			// Truncated snapshots are rejected without modifying the cache.
+			for i := range len(snapshot) {
+				dst = o.new(0)
+				if _, err = dst.ReadSnapshot(bytes.NewReader(snapshot[:i]), now, varintCodec{}, varintCodec{}); !errors.Is(err, cache.ErrInvalidSnapshot) || !errors.Is(err, io.ErrUnexpectedEOF) {
+					t.Errorf("dst.ReadSnapshot(snapshot[:%d]) = %v, want %v and %v", i, err, cache.ErrInvalidSnapshot, io.ErrUnexpectedEOF)
+				}
+				if dst.Len() != 0 {
+					t.Errorf("dst.Len() = %d after failed read, want 0", dst.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestExpirationCacheReadSnapshotErrors(t *testing.T) {
+	c := cache.NewExpirationCache[int, int](0)
+	now := time.Now()
+
+	if _, err := c.ReadSnapshot(bytes.NewReader([]byte("NOTASNAPSHOT")), now, varintCodec{}, varintCodec{}); !errors.Is(err, cache.ErrInvalidSnapshot) {
+		t.Errorf("c.ReadSnapshot(bad magic) = %v, want %v", err, cache.ErrInvalidSnapshot)
+	}
+	if _, err := c.ReadSnapshot(bytes.NewReader([]byte("CGPXC\x02\x00")), now, varintCodec{}, varintCodec{}); !errors.Is(err, cache.ErrUnsupportedSnapshotVersion) {
+		t.Errorf("c.ReadSnapshot(version 2) = %v, want %v", err, cache.ErrUnsupportedSnapshotVersion)
+	}
+	if _, err := c.ReadSnapshot(bytes.NewReader(nil), now, varintCodec{}, varintCodec{}); !errors.Is(err, cache.ErrInvalidSnapshot) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("c.ReadSnapshot(empty) = %v, want %v and %v", err, cache.ErrInvalidSnapshot, io.ErrUnexpectedEOF)
+	}
+	// One entry is declared, but its key is cut short.
+	if _, err := c.ReadSnapshot(bytes.NewReader([]byte("CGPXC\x01\x01\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x00\x02\x02")), now, varintCodec{}, varintCodec{}); !errors.Is(err, cache.ErrInvalidSnapshot) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("c.ReadSnapshot(truncated key) = %v, want %v and %v", err, cache.ErrInvalidSnapshot, io.ErrUnexpectedEOF)
+	}
+	if c.Len() != 0 {
+		t.Errorf("c.Len() = %d after failed reads, want 0", c.Len())
+	}
+}
+
+func FuzzExpirationCacheReadSnapshot(f *testing.F) {
+	now := time.Unix(1_700_000_000, 0)
+	c := cache.NewExpirationCache[int, int](0)
+	c.SetFromTail(1, -1, now, now.Add(time.Second))
+	c.SetFromTail(2, -2, now, now.Add(time.Hour))
+	var buf bytes.Buffer
+	if err := c.WriteSnapshot(&buf, varintCodec{}, varintCodec{}); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte("CGPXC\x01\x00"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		c := cache.NewExpirationCache[int, int](0)
+		if _, err := c.ReadSnapshot(bytes.NewReader(b), now, varintCodec{}, varintCodec{}); err != nil {
+			return
+		}
+
+		// A successfully read snapshot must survive a round trip.
+		var buf bytes.Buffer
+		if err := c.WriteSnapshot(&buf, varintCodec{}, varintCodec{}); err != nil {
+			t.Fatalf("c.WriteSnapshot() = %v", err)
+		}
+		c2 := cache.NewExpirationCache[int, int](0)
+		if _, err := c2.ReadSnapshot(&buf, now, varintCodec{}, varintCodec{}); err != nil {
+			t.Fatalf("c2.ReadSnapshot() = %v", err)
+		}
+		want := slices.Collect(entries(c.All()))
+		if got := slices.Collect(entries(c2.All())); !slices.Equal(got, want) {
+			t.Errorf("round trip: c2.All() = %v, want %v", got, want)
+		}
+	})
+}
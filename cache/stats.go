@@ -0,0 +1,112 @@
+package cache
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// ExpirationCacheStats is a snapshot of the counters of an [ExpirationCache].
+//
+// ExpirationCacheStats implements [slog.LogValuer], so it can be logged directly as an attribute value.
+type ExpirationCacheStats struct {
+	// Hits is the number of lookups that found an unexpired entry.
+	Hits uint64
+
+	// Misses is the number of lookups that did not find an unexpired entry.
+	// It includes lookups counted by ExpiredOnRead.
+	Misses uint64
+
+	// ExpiredOnRead is the number of lookups that found an entry that had expired but was not yet pruned.
+	ExpiredOnRead uint64
+
+	// CapacityEvictions is the number of entries evicted to make room for new entries.
+	CapacityEvictions uint64
+
+	// Expirations is the number of expired entries pruned from the cache.
+	Expirations uint64
+
+	// Replacements is the number of set operations that overwrote an existing entry.
+	Replacements uint64
+}
+
+// HitRatio returns the ratio of hits to all lookups, or 0 if there were no lookups.
+func (s ExpirationCacheStats) HitRatio() float64 {
+	total := s.Hits + s.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(total)
+}
+
+// LogValue implements [slog.LogValuer].
+func (s ExpirationCacheStats) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Uint64("hits", s.Hits),
+		slog.Uint64("misses", s.Misses),
+		slog.Uint64("expiredOnRead", s.ExpiredOnRead),
+		slog.Uint64("capacityEvictions", s.CapacityEvictions),
+		slog.Uint64("expirations", s.Expirations),
+		slog.Uint64("replacements", s.Replacements),
+		slog.Float64("hitRatio", s.HitRatio()),
+	)
+}
+
+// add adds the counters of other to s.
+func (s *ExpirationCacheStats) add(other ExpirationCacheStats) {
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.ExpiredOnRead += other.ExpiredOnRead
+	s.CapacityEvictions += other.CapacityEvictions
+	s.Expirations += other.Expirations
+	s.Replacements += other.Replacements
+}
+
+// expirationCacheCounters holds the live counters behind [ExpirationCacheStats].
+type expirationCacheCounters struct {
+	hits              atomic.Uint64
+	misses            atomic.Uint64
+	expiredOnRead     atomic.Uint64
+	capacityEvictions atomic.Uint64
+	expirations       atomic.Uint64
+	replacements      atomic.Uint64
+}
+
+// Stats returns a snapshot of the cache's counters.
+//
+// The counters are read one after another, so the snapshot may be inconsistent under concurrent use.
+func (c *ExpirationCache[K, V]) Stats() ExpirationCacheStats {
+	return ExpirationCacheStats{
+		Hits:              c.counters.hits.Load(),
+		Misses:            c.counters.misses.Load(),
+		ExpiredOnRead:     c.counters.expiredOnRead.Load(),
+		CapacityEvictions: c.counters.capacityEvictions.Load(),
+		Expirations:       c.counters.expirations.Load(),
+		Replacements:      c.counters.replacements.Load(),
+	}
+}
+
+// Stats returns the sum of the counters of all shards.
+func (c *ShardedExpirationCache[K, V]) Stats() ExpirationCacheStats {
+	var stats ExpirationCacheStats
+	for _, s := range c.shards {
+		stats.add(s.Stats())
+	}
+	return stats
+}
+
+// countLookup updates the lookup counters for a node found by a lookup, and returns whether it is usable.
+func (c *ExpirationCache[K, V]) countLookup(node *expirationNode[K, V], ok bool, now time.Time) bool {
+	switch {
+	case !ok:
+		c.counters.misses.Add(1)
+		return false
+	case !node.expiresAt.After(now):
+		c.counters.misses.Add(1)
+		c.counters.expiredOnRead.Add(1)
+		return false
+	default:
+		c.counters.hits.Add(1)
+		return true
+	}
+}
@@ -0,0 +1,73 @@
+package cache_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+func TestExpirationCacheStats(t *testing.T) {
+	for _, o := range expirationCacheOrderings {
+		t.Run(o.name, func(t *testing.T) {
+			c := o.new(2)
+			now := time.Now()
+			c.SetFromTail(1, -1, now, now.Add(time.Second))
+			c.SetFromTail(2, -2, now, now.Add(2*time.Second))
+			c.SetFromTail(2, 2, now, now.Add(2*time.Second))
+			c.SetFromTail(3, -3, now, now.Add(3*time.Second))
+
+			c.Get(1, now)
+			c.Get(2, now)
+			c.GetEntry(3, now)
+			now = now.Add(2 * time.Second)
+			c.Get(2, now)
+			c.SetFromTail(4, -4, now, now.Add(time.Second))
+
+			want := cache.ExpirationCacheStats{
+				Hits:              2,
+				Misses:            2,
+				ExpiredOnRead:     1,
+				CapacityEvictions: 1,
+				Expirations:       1,
+				Replacements:      1,
+			}
+			if got := c.Stats(); got != want {
+				t.Errorf("c.Stats() = %+v, want %+v", got, want)
+			}
+			if got := want.HitRatio(); got != 0.5 {
+				t.Errorf("HitRatio() = %v, want 0.5", got)
+			}
+		})
+	}
+}
+
+func TestShardedExpirationCacheStats(t *testing.T) {
+	c := cache.NewShardedExpirationCache[int, int](0, 4)
+	now := time.Now()
+	for key := range 10 {
+		c.SetFromTail(key, key, now, now.Add(time.Second))
+	}
+	for key := range 20 {
+		c.Get(key, now)
+	}
+
+	want := cache.ExpirationCacheStats{Hits: 10, Misses: 10}
+	if got := c.Stats(); got != want {
+		t.Errorf("c.Stats() = %+v, want %+v", got, want)
+	}
+}
+
+func TestExpirationCacheStatsLogValue(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	logger.Info("cache stats", "stats", cache.ExpirationCacheStats{Hits: 3, Misses: 1, Expirations: 2})
+
+	const want = "stats.hits=3 stats.misses=1 stats.expiredOnRead=0 stats.capacityEvictions=0 stats.expirations=2 stats.replacements=0 stats.hitRatio=0.75"
+	if got := buf.String(); !strings.Contains(got, want) {
+		t.Errorf("log output = %q, want it to contain %q", got, want)
+	}
+}
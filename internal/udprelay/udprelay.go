@@ -0,0 +1,116 @@
+// Package udprelay provides the UDP socket helpers shared by the relay commands.
+package udprelay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+)
+
+// BufferSize is the size of UDP packet buffers, large enough for any UDP payload.
+const BufferSize = 65535
+
+// Dial returns a UDP socket connected to address.
+func Dial(ctx context.Context, address string) (*net.UDPConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected connection type %T", conn)
+	}
+	return udpConn, nil
+}
+
+const (
+	// readErrorMinBackoff is the wait after the first of consecutive read errors.
+	// The wait doubles on each further error, up to readErrorMaxBackoff.
+	readErrorMinBackoff = 5 * time.Millisecond
+
+	// readErrorMaxBackoff is the maximum wait between consecutive read errors.
+	readErrorMaxBackoff = time.Second
+
+	// maxConsecutiveReadErrors is the number of consecutive read errors after which ReadLoop gives up.
+	maxConsecutiveReadErrors = 16
+)
+
+// Backoff paces retries after consecutive read errors, so that a persistent error does not spin a read loop.
+// The first wait is 5ms, and each further wait doubles, up to 1s.
+//
+// The zero value is ready to use.
+type Backoff struct {
+	wait time.Duration
+	errs int
+}
+
+// Fail records a read error, and returns the number of consecutive errors.
+func (b *Backoff) Fail() int {
+	b.wait = min(max(2*b.wait, readErrorMinBackoff), readErrorMaxBackoff)
+	b.errs++
+	return b.errs
+}
+
+// Reset forgets the recorded errors, after a successful read.
+func (b *Backoff) Reset() {
+	b.wait, b.errs = 0, 0
+}
+
+// Wait waits before retrying the read that last failed, and returns false if ctx is canceled first.
+func (b *Backoff) Wait(ctx context.Context) bool {
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ReadLoop reads packets from conn and calls handle with each, until ctx is canceled.
+// It closes conn before returning.
+//
+// Read errors are retried with [Backoff].
+// After [maxConsecutiveReadErrors] consecutive errors, the last one is returned.
+func ReadLoop(ctx context.Context, logger *tslog.Logger, conn *net.UDPConn, handle func(b []byte, from netip.AddrPort)) error {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	var (
+		buf     = make([]byte, BufferSize)
+		backoff Backoff
+	)
+	for {
+		n, from, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			errs := backoff.Fail()
+			if errs >= maxConsecutiveReadErrors {
+				return err
+			}
+			logger.Warn("Failed to read UDP packet", tslog.Int("consecutiveErrors", errs), tslog.Err(err))
+			if !backoff.Wait(ctx) {
+				return nil
+			}
+			continue
+		}
+		backoff.Reset()
+		handle(buf[:n], from)
+	}
+}
@@ -0,0 +1,76 @@
+package udprelay
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+)
+
+func TestReadLoop(t *testing.T) {
+	logger := tslog.Config{Level: slog.LevelDebug, NoColor: true}.NewLogger(t.Output())
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP() failed: %v", err)
+	}
+
+	client, err := Dial(t.Context(), conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Dial() failed: %v", err)
+	}
+	defer client.Close()
+	if _, err = client.Write([]byte("hello")); err != nil {
+		t.Fatalf("client.Write() failed: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	var got string
+	err = ReadLoop(ctx, logger, conn, func(b []byte, from netip.AddrPort) {
+		got = string(b)
+		cancel()
+	})
+	if err != nil {
+		t.Errorf("ReadLoop() = %v, want nil", err)
+	}
+	if got != "hello" {
+		t.Errorf("handled packet = %q, want %q", got, "hello")
+	}
+	if err = conn.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("conn.Close() after ReadLoop() = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var b Backoff
+	want := readErrorMinBackoff
+	for i := 1; i <= 10; i++ {
+		if errs := b.Fail(); errs != i {
+			t.Errorf("b.Fail() = %d, want %d", errs, i)
+		}
+		if b.wait != want {
+			t.Errorf("wait after %d errors = %v, want %v", i, b.wait, want)
+		}
+		want = min(2*want, readErrorMaxBackoff)
+	}
+
+	b.Reset()
+	if errs := b.Fail(); errs != 1 || b.wait != readErrorMinBackoff {
+		t.Errorf("after b.Reset(), b.Fail() = %d with wait %v, want 1 with wait %v", errs, b.wait, readErrorMinBackoff)
+	}
+	if !b.Wait(t.Context()) {
+		t.Error("b.Wait() = false, want true")
+	}
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	b.wait = time.Hour
+	if b.Wait(ctx) {
+		t.Error("b.Wait(canceled) = true, want false")
+	}
+}
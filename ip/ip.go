@@ -43,6 +43,15 @@ func AddrPortv4Mappedv6(addrPort netip.AddrPort) netip.AddrPort {
 	return addrPort
 }
 
+// AddrPortUnmap converts an IPv4-mapped IPv6 address to an IPv4 address.
+// This function does nothing if addrPort is not an IPv4-mapped IPv6 address.
+func AddrPortUnmap(addrPort netip.AddrPort) netip.AddrPort {
+	if addrPort.Addr().Is4In6() {
+		return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	}
+	return addrPort
+}
+
 var z6noz unsafe.Pointer
 
 func init() {
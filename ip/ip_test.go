@@ -67,6 +67,30 @@ func BenchmarkAddrPortv4Mappedv6Unsafe(b *testing.B) {
 	})
 }
 
+func BenchmarkAddrPortUnmap(b *testing.B) {
+	b.Run("Is4", func(b *testing.B) {
+		for b.Loop() {
+			AddrPortUnmap(addrPort4)
+		}
+	})
+
+	b.Run("Is4In6", func(b *testing.B) {
+		for b.Loop() {
+			AddrPortUnmap(addrPort4in6)
+		}
+	})
+}
+
+func TestAddrPortUnmap(t *testing.T) {
+	if ap := AddrPortUnmap(addrPort4in6); ap != addrPort4 {
+		t.Errorf("AddrPortUnmap(%s) returned %s, expected %s.", addrPort4in6, ap, addrPort4)
+	}
+
+	if ap := AddrPortUnmap(addrPort4); ap != addrPort4 {
+		t.Errorf("AddrPortUnmap(%s) returned %s, expected %s.", addrPort4, ap, addrPort4)
+	}
+}
+
 func TestAddrPortv4Mappedv6Unsafe(t *testing.T) {
 	app := (*addrPortHeader)(unsafe.Pointer(&addrPort4))
 	t.Logf("addrPort4.z: %p", app.addr.z)
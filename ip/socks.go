@@ -0,0 +1,198 @@
+package ip
+
+import (
+	"errors"
+	"net/netip"
+	"strconv"
+	"unsafe"
+)
+
+// SOCKS address types (ATYP).
+const (
+	SocksAddrTypeIPv4       = 1
+	SocksAddrTypeDomainName = 3
+	SocksAddrTypeIPv6       = 4
+)
+
+// Encoded lengths of SOCKS addresses: ATYP + address + port.
+const (
+	SocksAddrIPv4Len = 1 + 4 + 2
+	SocksAddrIPv6Len = 1 + 16 + 2
+
+	// SocksAddrMaxLen is the maximum length of an encoded SOCKS address, which has a 255-byte domain name.
+	SocksAddrMaxLen = 1 + 1 + 255 + 2
+)
+
+var (
+	// ErrSocksAddrTooShort is returned when parsing a truncated SOCKS address.
+	ErrSocksAddrTooShort = errors.New("SOCKS address too short")
+
+	// ErrUnknownSocksAddrType is returned when parsing a SOCKS address with an unknown ATYP.
+	ErrUnknownSocksAddrType = errors.New("unknown SOCKS address type")
+
+	// ErrEmptyDomainName is returned for a SOCKS address with an empty domain name.
+	ErrEmptyDomainName = errors.New("empty domain name")
+
+	// ErrDomainNameTooLong is returned when a domain name does not fit in a SOCKS address.
+	ErrDomainNameTooLong = errors.New("domain name too long")
+)
+
+// SocksAddr is an address in SOCKS format: either an IP address and port, or a domain name and port.
+// The zero value is an invalid address.
+//
+// IP addresses are always normalized by [AddrPortUnmap],
+// so an IPv4-mapped IPv6 address is encoded as, and compares equal to, the IPv4 address.
+type SocksAddr struct {
+	addrPort netip.AddrPort
+	domain   string
+}
+
+// SocksAddrFromAddrPort returns a [SocksAddr] for the IP address and port.
+func SocksAddrFromAddrPort(addrPort netip.AddrPort) SocksAddr {
+	return SocksAddr{addrPort: AddrPortUnmap(addrPort)}
+}
+
+// SocksAddrFromDomainPort returns a [SocksAddr] for the domain name and port.
+// The domain name must be between 1 and 255 bytes long.
+func SocksAddrFromDomainPort(domain string, port uint16) (SocksAddr, error) {
+	switch {
+	case len(domain) == 0:
+		return SocksAddr{}, ErrEmptyDomainName
+	case len(domain) > 255:
+		return SocksAddr{}, ErrDomainNameTooLong
+	}
+	return SocksAddr{
+		addrPort: netip.AddrPortFrom(netip.Addr{}, port),
+		domain:   domain,
+	}, nil
+}
+
+// IsValid returns whether the address is valid.
+func (a SocksAddr) IsValid() bool {
+	return a.addrPort.Addr().IsValid() || a.domain != ""
+}
+
+// IsDomain returns whether the address is a domain name.
+func (a SocksAddr) IsDomain() bool {
+	return a.domain != ""
+}
+
+// AddrPort returns the IP address and port. It returns the zero value if the address is a domain name.
+func (a SocksAddr) AddrPort() netip.AddrPort {
+	if a.domain != "" {
+		return netip.AddrPort{}
+	}
+	return a.addrPort
+}
+
+// Domain returns the domain name, or an empty string if the address is an IP address.
+func (a SocksAddr) Domain() string {
+	return a.domain
+}
+
+// Port returns the port.
+func (a SocksAddr) Port() uint16 {
+	return a.addrPort.Port()
+}
+
+// String returns the string representation of the address, in host:port form.
+func (a SocksAddr) String() string {
+	if a.domain != "" {
+		return a.domain + ":" + strconv.FormatUint(uint64(a.addrPort.Port()), 10)
+	}
+	return a.addrPort.String()
+}
+
+// EncodedLen returns the length of the address in SOCKS format.
+func (a SocksAddr) EncodedLen() int {
+	switch {
+	case a.domain != "":
+		return 1 + 1 + len(a.domain) + 2
+	case a.addrPort.Addr().Is4():
+		return SocksAddrIPv4Len
+	default:
+		return SocksAddrIPv6Len
+	}
+}
+
+// Append appends the address in SOCKS format to b and returns the extended buffer.
+// The address must be valid.
+func (a SocksAddr) Append(b []byte) []byte {
+	switch {
+	case a.domain != "":
+		b = append(b, SocksAddrTypeDomainName, byte(len(a.domain)))
+		b = append(b, a.domain...)
+	case a.addrPort.Addr().Is4():
+		ip4 := a.addrPort.Addr().As4()
+		b = append(b, SocksAddrTypeIPv4)
+		b = append(b, ip4[:]...)
+	default:
+		ip16 := a.addrPort.Addr().As16()
+		b = append(b, SocksAddrTypeIPv6)
+		b = append(b, ip16[:]...)
+	}
+	port := a.addrPort.Port()
+	return append(b, byte(port>>8), byte(port))
+}
+
+// ParseSocksAddr parses a SOCKS address from the beginning of b,
+// and returns the address and the number of bytes consumed.
+//
+// Parsing an IP address does not allocate. A domain name is copied into a new string.
+func ParseSocksAddr(b []byte) (SocksAddr, int, error) {
+	a, n, err := ParseSocksAddrUnsafe(b)
+	if a.domain != "" {
+		a.domain = string(b[2 : n-2])
+	}
+	return a, n, err
+}
+
+// ParseSocksAddrUnsafe is like [ParseSocksAddr], but does not allocate for domain names:
+// the returned domain name shares memory with b.
+// The address must not be used after b is modified.
+func ParseSocksAddrUnsafe(b []byte) (SocksAddr, int, error) {
+	if len(b) == 0 {
+		return SocksAddr{}, 0, ErrSocksAddrTooShort
+	}
+
+	var (
+		a SocksAddr
+		n int
+	)
+
+	switch b[0] {
+	case SocksAddrTypeIPv4:
+		n = SocksAddrIPv4Len
+		if len(b) < n {
+			return SocksAddr{}, 0, ErrSocksAddrTooShort
+		}
+		a.addrPort = netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[1:5])), uint16(b[5])<<8|uint16(b[6]))
+
+	case SocksAddrTypeDomainName:
+		if len(b) < 2 {
+			return SocksAddr{}, 0, ErrSocksAddrTooShort
+		}
+		domainLen := int(b[1])
+		if domainLen == 0 {
+			return SocksAddr{}, 0, ErrEmptyDomainName
+		}
+		n = 1 + 1 + domainLen + 2
+		if len(b) < n {
+			return SocksAddr{}, 0, ErrSocksAddrTooShort
+		}
+		a.addrPort = netip.AddrPortFrom(netip.Addr{}, uint16(b[n-2])<<8|uint16(b[n-1]))
+		a.domain = unsafe.String(&b[2], domainLen)
+
+	case SocksAddrTypeIPv6:
+		n = SocksAddrIPv6Len
+		if len(b) < n {
+			return SocksAddr{}, 0, ErrSocksAddrTooShort
+		}
+		a.addrPort = AddrPortUnmap(netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[1:17])), uint16(b[17])<<8|uint16(b[18])))
+
+	default:
+		return SocksAddr{}, 0, ErrUnknownSocksAddrType
+	}
+
+	return a, n, nil
+}
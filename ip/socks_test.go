@@ -0,0 +1,236 @@
+package ip
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+var (
+	socksAddr4      = SocksAddrFromAddrPort(netip.MustParseAddrPort("1.1.1.1:53"))
+	socksAddr6      = SocksAddrFromAddrPort(netip.MustParseAddrPort("[2606:4700:4700::1111]:853"))
+	socksAddrDomain = mustSocksAddrFromDomainPort("example.com", 443)
+)
+
+func mustSocksAddrFromDomainPort(domain string, port uint16) SocksAddr {
+	a, err := SocksAddrFromDomainPort(domain, port)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func TestSocksAddrAppendParse(t *testing.T) {
+	for _, c := range [...]struct {
+		name    string
+		addr    SocksAddr
+		encoded []byte
+		want    string
+	}{
+		{
+			name:    "IPv4",
+			addr:    socksAddr4,
+			encoded: []byte{1, 1, 1, 1, 1, 0, 53},
+			want:    "1.1.1.1:53",
+		},
+		{
+			name:    "IPv4Mapped",
+			addr:    SocksAddrFromAddrPort(netip.MustParseAddrPort("[::ffff:1.1.1.1]:53")),
+			encoded: []byte{1, 1, 1, 1, 1, 0, 53},
+			want:    "1.1.1.1:53",
+		},
+		{
+			name:    "IPv6",
+			addr:    socksAddr6,
+			encoded: []byte{4, 0x26, 0x06, 0x47, 0x00, 0x47, 0x00, 0, 0, 0, 0, 0, 0, 0, 0, 0x11, 0x11, 0x03, 0x55},
+			want:    "[2606:4700:4700::1111]:853",
+		},
+		{
+			name:    "Domain",
+			addr:    socksAddrDomain,
+			encoded: append(append([]byte{3, 11}, "example.com"...), 0x01, 0xbb),
+			want:    "example.com:443",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.addr.EncodedLen(); got != len(c.encoded) {
+				t.Errorf("c.addr.EncodedLen() = %d, want %d", got, len(c.encoded))
+			}
+
+			b := c.addr.Append([]byte{0xff})
+			if !bytes.Equal(b[1:], c.encoded) {
+				t.Errorf("c.addr.Append() = %v, want %v", b[1:], c.encoded)
+			}
+
+			for _, parse := range [...]func([]byte) (SocksAddr, int, error){ParseSocksAddr, ParseSocksAddrUnsafe} {
+				addr, n, err := parse(append(c.encoded, "payload"...))
+				if err != nil {
+					t.Fatalf("ParseSocksAddr() failed: %v", err)
+				}
+				if n != len(c.encoded) {
+					t.Errorf("ParseSocksAddr() n = %d, want %d", n, len(c.encoded))
+				}
+				if addr != c.addr {
+					t.Errorf("ParseSocksAddr() = %v, want %v", addr, c.addr)
+				}
+				if got := addr.String(); got != c.want {
+					t.Errorf("addr.String() = %q, want %q", got, c.want)
+				}
+			}
+
+			for i := range len(c.encoded) {
+				if _, _, err := ParseSocksAddr(c.encoded[:i]); !errors.Is(err, ErrSocksAddrTooShort) {
+					t.Errorf("ParseSocksAddr(c.encoded[:%d]) error = %v, want %v", i, err, ErrSocksAddrTooShort)
+				}
+			}
+		})
+	}
+}
+
+func TestSocksAddrAccessors(t *testing.T) {
+	if got := socksAddr4.AddrPort(); got != netip.MustParseAddrPort("1.1.1.1:53") {
+		t.Errorf("socksAddr4.AddrPort() = %v, want 1.1.1.1:53", got)
+	}
+	if socksAddr4.IsDomain() || socksAddr4.Domain() != "" {
+		t.Errorf("socksAddr4 is a domain name: %q", socksAddr4.Domain())
+	}
+	if !socksAddrDomain.IsDomain() || socksAddrDomain.Domain() != "example.com" {
+		t.Errorf("socksAddrDomain.Domain() = %q, want %q", socksAddrDomain.Domain(), "example.com")
+	}
+	if got := socksAddrDomain.AddrPort(); got.IsValid() {
+		t.Errorf("socksAddrDomain.AddrPort() = %v, want zero value", got)
+	}
+	if got := socksAddrDomain.Port(); got != 443 {
+		t.Errorf("socksAddrDomain.Port() = %d, want 443", got)
+	}
+	if (SocksAddr{}).IsValid() {
+		t.Error("SocksAddr{}.IsValid() = true, want false")
+	}
+}
+
+func TestSocksAddrErrors(t *testing.T) {
+	if _, err := SocksAddrFromDomainPort("", 53); !errors.Is(err, ErrEmptyDomainName) {
+		t.Errorf("SocksAddrFromDomainPort(\"\") error = %v, want %v", err, ErrEmptyDomainName)
+	}
+	if _, err := SocksAddrFromDomainPort(strings.Repeat("a", 256), 53); !errors.Is(err, ErrDomainNameTooLong) {
+		t.Errorf("SocksAddrFromDomainPort(256 bytes) error = %v, want %v", err, ErrDomainNameTooLong)
+	}
+	if _, _, err := ParseSocksAddr([]byte{2, 0, 0}); !errors.Is(err, ErrUnknownSocksAddrType) {
+		t.Errorf("ParseSocksAddr(ATYP 2) error = %v, want %v", err, ErrUnknownSocksAddrType)
+	}
+	if _, _, err := ParseSocksAddr([]byte{3, 0, 0, 53}); !errors.Is(err, ErrEmptyDomainName) {
+		t.Errorf("ParseSocksAddr(empty domain) error = %v, want %v", err, ErrEmptyDomainName)
+	}
+}
+
+func TestSocksAddrAllocs(t *testing.T) {
+	b := make([]byte, 0, SocksAddrMaxLen)
+	for _, c := range [...]struct {
+		name       string
+		addr       SocksAddr
+		parse      func([]byte) (SocksAddr, int, error)
+		wantAllocs float64
+	}{
+		{"IPv4", socksAddr4, ParseSocksAddr, 0},
+		{"IPv6", socksAddr6, ParseSocksAddr, 0},
+		{"Domain", socksAddrDomain, ParseSocksAddr, 1},
+		{"DomainUnsafe", socksAddrDomain, ParseSocksAddrUnsafe, 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if got := testing.AllocsPerRun(100, func() {
+				b = c.addr.Append(b[:0])
+			}); got != 0 {
+				t.Errorf("c.addr.Append() allocs = %v, want 0", got)
+			}
+			if got := testing.AllocsPerRun(100, func() {
+				c.parse(b)
+			}); got != c.wantAllocs {
+				t.Errorf("parse allocs = %v, want %v", got, c.wantAllocs)
+			}
+		})
+	}
+}
+
+func FuzzParseSocksAddr(f *testing.F) {
+	f.Add([]byte{1, 1, 1, 1, 1, 0, 53})
+	f.Add([]byte{3, 3, 'f', 'o', 'o', 0, 80})
+	f.Add([]byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4, 0, 1})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		addr, n, err := ParseSocksAddr(b)
+		unsafeAddr, unsafeN, unsafeErr := ParseSocksAddrUnsafe(b)
+		if addr != unsafeAddr || n != unsafeN || err != unsafeErr {
+			t.Fatalf("ParseSocksAddr() = %v, %d, %v, ParseSocksAddrUnsafe() = %v, %d, %v", addr, n, err, unsafeAddr, unsafeN, unsafeErr)
+		}
+		if err != nil {
+			return
+		}
+		if n > len(b) {
+			t.Fatalf("ParseSocksAddr() n = %d, want at most %d", n, len(b))
+		}
+		if !addr.IsValid() {
+			t.Fatal("ParseSocksAddr() returned an invalid address without error")
+		}
+		if ap := addr.AddrPort(); ap.Addr().Is4In6() {
+			t.Fatalf("ParseSocksAddr() returned IPv4-mapped IPv6 address %v", ap)
+		}
+
+		// Re-encoding parses back to the same address.
+		// It may be shorter, as IPv4-mapped IPv6 addresses are encoded as IPv4.
+		encoded := addr.Append(nil)
+		if len(encoded) != addr.EncodedLen() || len(encoded) > n {
+			t.Fatalf("len(addr.Append()) = %d, addr.EncodedLen() = %d, want at most %d", len(encoded), addr.EncodedLen(), n)
+		}
+		addr2, _, err := ParseSocksAddr(encoded)
+		if err != nil {
+			t.Fatalf("ParseSocksAddr(addr.Append()) failed: %v", err)
+		}
+		if addr2 != addr {
+			t.Fatalf("ParseSocksAddr(addr.Append()) = %v, want %v", addr2, addr)
+		}
+	})
+}
+
+func BenchmarkSocksAddrAppend(b *testing.B) {
+	buf := make([]byte, 0, SocksAddrMaxLen)
+	for _, c := range [...]struct {
+		name string
+		addr SocksAddr
+	}{
+		{"IPv4", socksAddr4},
+		{"IPv6", socksAddr6},
+		{"Domain", socksAddrDomain},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			for b.Loop() {
+				buf = c.addr.Append(buf[:0])
+			}
+		})
+	}
+}
+
+func BenchmarkParseSocksAddr(b *testing.B) {
+	for _, c := range [...]struct {
+		name string
+		addr SocksAddr
+	}{
+		{"IPv4", socksAddr4},
+		{"IPv6", socksAddr6},
+		{"IPv4Mapped", SocksAddr{addrPort: addrPort4in6}},
+		{"Domain", socksAddrDomain},
+	} {
+		buf := c.addr.Append(nil)
+		b.Run(c.name, func(b *testing.B) {
+			for b.Loop() {
+				ParseSocksAddr(buf)
+			}
+		})
+		b.Run(c.name+"Unsafe", func(b *testing.B) {
+			for b.Loop() {
+				ParseSocksAddrUnsafe(buf)
+			}
+		})
+	}
+}
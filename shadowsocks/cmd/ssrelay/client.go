@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+	"github.com/database64128/cubic-go-playground/internal/udprelay"
+	"github.com/database64128/cubic-go-playground/ip"
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/shadowsocks"
+)
+
+// client tunnels local TCP connections and UDP packets to a fixed target through a shadowsocks server.
+type client struct {
+	logger         *tslog.Logger
+	serverAddress  string
+	target         ip.SocksAddr
+	tcpCipher      *shadowsocks.TCPCipher
+	udpConfig      shadowsocks.UDPConfig
+	udpIdleTimeout time.Duration
+}
+
+// newClient returns a new client with the config.
+func (cfg *relayConfig) newClient(logger *tslog.Logger) (*client, error) {
+	if cfg.ServerAddress == "" {
+		return nil, errors.New("missing server address")
+	}
+
+	target, err := parseTarget(cfg.TargetAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	psks, err := parsePSKs(cfg.PSK)
+	if err != nil {
+		return nil, err
+	}
+	identityPSKs, userPSK := psks[:len(psks)-1], psks[len(psks)-1]
+
+	var (
+		tcpCipher *shadowsocks.TCPCipher
+		udpCipher shadowsocks.UDPCipher
+	)
+	if len(identityPSKs) == 0 {
+		if tcpCipher, err = shadowsocks.NewTCPCipher(cfg.Method, userPSK); err != nil {
+			return nil, err
+		}
+		if udpCipher, err = shadowsocks.NewUDPCipher(cfg.Method, userPSK); err != nil {
+			return nil, err
+		}
+	} else {
+		if tcpCipher, err = shadowsocks.NewTCPClientCipherWithIdentity(cfg.Method, identityPSKs, userPSK); err != nil {
+			return nil, err
+		}
+		if udpCipher, err = shadowsocks.NewUDPClientCipherWithIdentity(cfg.Method, identityPSKs, userPSK); err != nil {
+			return nil, err
+		}
+	}
+
+	return &client{
+		logger:        logger,
+		serverAddress: cfg.ServerAddress,
+		target:        target,
+		tcpCipher:     tcpCipher,
+		udpConfig: shadowsocks.UDPConfig{
+			Cipher:      udpCipher,
+			IdleTimeout: cfg.UDPIdleTimeout,
+		},
+		udpIdleTimeout: cfg.udpIdleTimeout(),
+	}, nil
+}
+
+// parseTarget parses a host:port target address, which may have a domain name as the host.
+func parseTarget(s string) (ip.SocksAddr, error) {
+	if s == "" {
+		return ip.SocksAddr{}, errors.New("missing target address")
+	}
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return ip.SocksAddrFromAddrPort(addrPort), nil
+	}
+	host, portString, err := net.SplitHostPort(s)
+	if err != nil {
+		return ip.SocksAddr{}, err
+	}
+	port, err := net.LookupPort("tcp", portString)
+	if err != nil {
+		return ip.SocksAddr{}, err
+	}
+	return ip.SocksAddrFromDomainPort(host, uint16(port))
+}
+
+const (
+	// tcpInitialPayloadWaitTimeout is how long the client waits for the first bytes from a local connection,
+	// so that they can be sent in the request header. If nothing arrives in time, for example because
+	// the target speaks first, the request header is sent with padding and no payload.
+	tcpInitialPayloadWaitTimeout = 250 * time.Millisecond
+
+	// tcpInitialPayloadWaitBufferSize is the size of the buffer for the first bytes from a local connection.
+	tcpInitialPayloadWaitBufferSize = 1440
+)
+
+// serveTCP implements [relay.serveTCP].
+//
+// The first bytes from each local connection are sent in the request header,
+// before the response is read, which would otherwise force a request header without payload.
+func (c *client) serveTCP(ctx context.Context, ln *net.TCPListener) error {
+	var dialer net.Dialer
+	return acceptLoop(ctx, c.logger, ln, func(conn *net.TCPConn) {
+		logger := c.logger.WithAttrs(tslog.AddrPort("clientAddress", conn.RemoteAddr().(*net.TCPAddr).AddrPort()))
+
+		serverConn, err := dialer.DialContext(ctx, "tcp", c.serverAddress)
+		if err != nil {
+			logger.Warn("Failed to connect to server", slog.String("serverAddress", c.serverAddress), tslog.Err(err))
+			return
+		}
+		defer serverConn.Close()
+		stop := context.AfterFunc(ctx, func() {
+			serverConn.Close()
+		})
+		defer stop()
+
+		ssConn := c.tcpCipher.NewClientConn(serverConn, c.target)
+		if err = sendInitialPayload(conn, ssConn); err != nil {
+			logger.Warn("Failed to send initial payload", tslog.Err(err))
+			return
+		}
+
+		logger.Debug("Relaying TCP connection", slog.String("target", c.target.String()))
+		relayTCP(logger, conn, ssConn)
+	})
+}
+
+// sendInitialPayload waits up to [tcpInitialPayloadWaitTimeout] for the first bytes from conn,
+// and writes them to ssConn, which sends them in the request header.
+// If conn sends nothing in time or reaches EOF, nothing is written.
+func sendInitialPayload(conn *net.TCPConn, ssConn *shadowsocks.TCPClientConn) error {
+	buf := make([]byte, tcpInitialPayloadWaitBufferSize)
+	conn.SetReadDeadline(time.Now().Add(tcpInitialPayloadWaitTimeout))
+	n, err := conn.Read(buf)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil && err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	if n == 0 {
+		return nil
+	}
+	_, err = ssConn.Write(buf[:n])
+	return err
+}
+
+// clientUDPSession is the tunnel of a local UDP client.
+type clientUDPSession struct {
+	ss         *shadowsocks.UDPClient
+	serverConn *net.UDPConn
+	buf        []byte
+}
+
+// serveUDP implements [relay.serveUDP].
+//
+// Each local client address gets its own shadowsocks session and server socket,
+// tracked in a NAT table and closed after the idle timeout.
+func (c *client) serveUDP(ctx context.Context, conn *net.UDPConn) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	nat := cache.ExpirationCacheConfig[netip.AddrPort, *clientUDPSession]{
+		IdleTimeout: c.udpIdleTimeout,
+		OnEvict: func(entry cache.Entry[netip.AddrPort, *clientUDPSession], reason cache.EvictionReason) {
+			c.logger.Debug("Closing UDP session",
+				tslog.AddrPort("clientAddress", entry.Key),
+				tslog.Uint("sessionID", entry.Value.ss.SessionID()),
+				slog.String("reason", reason.String()),
+			)
+			entry.Value.serverConn.Close()
+		},
+	}.NewCache()
+	defer nat.Clear()
+
+	janitorCtx, cancelJanitor := context.WithCancel(ctx)
+	defer cancelJanitor()
+	wg.Go(func() {
+		nat.RunJanitor(janitorCtx, nil)
+	})
+
+	return udprelay.ReadLoop(ctx, c.logger, conn, func(b []byte, clientAddr netip.AddrPort) {
+		// The listener may report the same client as IPv4 or IPv4-mapped IPv6, depending on the socket.
+		key := ip.AddrPortv4Mappedv6(clientAddr)
+
+		s, err := nat.GetOrLoadNow(key, func(key netip.AddrPort) (*clientUDPSession, time.Time, error) {
+			serverConn, err := udprelay.Dial(ctx, c.serverAddress)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			s := &clientUDPSession{
+				ss:         c.udpConfig.NewClient(),
+				serverConn: serverConn,
+			}
+			c.logger.Debug("Started UDP session",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.Uint("sessionID", s.ss.SessionID()),
+			)
+			wg.Go(func() {
+				c.relayUDPReplies(ctx, conn, s, clientAddr)
+			})
+			return s, nat.Clock().Now().Add(c.udpIdleTimeout), nil
+		})
+		if err != nil {
+			c.logger.Warn("Failed to start UDP session", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+			return
+		}
+
+		s.buf, err = s.ss.Seal(s.buf[:0], c.target, b, time.Now())
+		if err != nil {
+			c.logger.Warn("Failed to seal UDP packet", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+			return
+		}
+		if _, err = s.serverConn.Write(s.buf); err != nil {
+			c.logger.Warn("Failed to send UDP packet to server", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+		}
+	})
+}
+
+// relayUDPReplies opens packets from the server and sends their payloads to the local client,
+// until the server socket is closed or ctx is canceled.
+//
+// Read errors are retried with [udprelay.Backoff]. The loop never gives up on them,
+// as the socket is closed when the session is evicted.
+func (c *client) relayUDPReplies(ctx context.Context, conn *net.UDPConn, s *clientUDPSession, clientAddr netip.AddrPort) {
+	var (
+		buf     = make([]byte, udprelay.BufferSize)
+		backoff udprelay.Backoff
+	)
+	for {
+		n, err := s.serverConn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			c.logger.Debug("Failed to read UDP packet from server",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.Int("consecutiveErrors", backoff.Fail()),
+				tslog.Err(err),
+			)
+			if !backoff.Wait(ctx) {
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+
+		_, payload, err := s.ss.Open(buf[:n], time.Now())
+		if err != nil {
+			c.logger.Debug("Dropped UDP packet from server", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+			continue
+		}
+
+		if _, err = conn.WriteToUDPAddrPort(payload, clientAddr); err != nil {
+			c.logger.Debug("Failed to send UDP packet to client", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/shadowsocks"
+)
+
+var (
+	mode           string
+	method         string
+	psk            string
+	usersPath      string
+	listenAddress  string
+	serverAddress  string
+	targetAddress  string
+	udpIdleTimeout time.Duration
+	logNoColor     bool
+	logNoTime      bool
+	logKVPairs     bool
+	logJSON        bool
+	logLevel       slog.Level
+)
+
+func init() {
+	flag.StringVar(&mode, "mode", "", "Relay mode, one of: client, server")
+	flag.StringVar(&method, "method", shadowsocks.Method2022Blake3Aes256Gcm, "Shadowsocks 2022 method")
+	flag.StringVar(&psk, "psk", "", "Base64-encoded PSK. Clients of multi-user servers use iPSK1:...:iPSKn:uPSK, servers with -users use their identity PSK")
+	flag.StringVar(&usersPath, "users", "", "Server: path to a JSON file of users, as an array of {\"name\": ..., \"psk\": ...}. Reloaded on SIGHUP")
+	flag.StringVar(&listenAddress, "listen", "", "TCP and UDP address to listen on")
+	flag.StringVar(&serverAddress, "server", "", "Client: address of the shadowsocks server")
+	flag.StringVar(&targetAddress, "target", "", "Client: address the tunnel forwards to, through the server")
+	flag.DurationVar(&udpIdleTimeout, "udpIdleTimeout", shadowsocks.DefaultUDPIdleTimeout, "How long an idle UDP session is kept")
+	flag.BoolVar(&logNoColor, "logNoColor", false, "Disable colors in log output")
+	flag.BoolVar(&logNoTime, "logNoTime", false, "Disable timestamps in log output")
+	flag.BoolVar(&logKVPairs, "logKVPairs", false, "Use key=value pairs in log output")
+	flag.BoolVar(&logJSON, "logJSON", false, "Use JSON in log output")
+	flag.TextVar(&logLevel, "logLevel", slog.LevelInfo, "Log level, one of: DEBUG, INFO, WARN, ERROR")
+}
+
+func main() {
+	flag.Parse()
+
+	logCfg := tslog.Config{
+		Level:          logLevel,
+		NoColor:        logNoColor,
+		NoTime:         logNoTime,
+		UseTextHandler: logKVPairs,
+		UseJSONHandler: logJSON,
+	}
+	logger := logCfg.NewLogger(os.Stderr)
+
+	cfg := relayConfig{
+		Method:         method,
+		PSK:            psk,
+		UsersPath:      usersPath,
+		ServerAddress:  serverAddress,
+		TargetAddress:  targetAddress,
+		UDPIdleTimeout: udpIdleTimeout,
+	}
+
+	var r relay
+	switch mode {
+	case "client":
+		c, err := cfg.newClient(logger)
+		if err != nil {
+			logger.Error("Failed to create client", tslog.Err(err))
+			os.Exit(1)
+		}
+		r = c
+	case "server":
+		s, err := cfg.newServer(logger)
+		if err != nil {
+			logger.Error("Failed to create server", tslog.Err(err))
+			os.Exit(1)
+		}
+		if usersPath != "" {
+			go reloadUsersOnSIGHUP(logger, s, usersPath)
+		}
+		r = s
+	default:
+		logger.Error("Invalid mode, must be client or server", slog.String("mode", mode))
+		os.Exit(1)
+	}
+
+	ln, err := net.Listen("tcp", listenAddress)
+	if err != nil {
+		logger.Error("Failed to listen on TCP", slog.String("address", listenAddress), tslog.Err(err))
+		os.Exit(1)
+	}
+
+	pc, err := net.ListenPacket("udp", listenAddress)
+	if err != nil {
+		logger.Error("Failed to listen on UDP", slog.String("address", listenAddress), tslog.Err(err))
+		os.Exit(1)
+	}
+
+	logger.Info("Started relay",
+		slog.String("mode", mode),
+		slog.String("method", method),
+		slog.String("address", listenAddress),
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		if err := r.serveTCP(ctx, ln.(*net.TCPListener)); err != nil {
+			logger.Error("Failed to serve TCP", tslog.Err(err))
+			stop()
+		}
+	})
+	wg.Go(func() {
+		if err := r.serveUDP(ctx, pc.(*net.UDPConn)); err != nil {
+			logger.Error("Failed to serve UDP", tslog.Err(err))
+			stop()
+		}
+	})
+	wg.Wait()
+
+	logger.Info("Stopped relay")
+}
+
+// reloadUsersOnSIGHUP reloads the server's users from path on each SIGHUP.
+func reloadUsersOnSIGHUP(logger *tslog.Logger, s *server, path string) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	for range sigCh {
+		if err := s.loadUsers(path); err != nil {
+			logger.Warn("Failed to reload users", slog.String("path", path), tslog.Err(err))
+			continue
+		}
+		logger.Info("Reloaded users", slog.String("path", path))
+	}
+}
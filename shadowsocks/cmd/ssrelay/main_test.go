@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/internal/udprelay"
+	"github.com/database64128/cubic-go-playground/ip"
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/shadowsocks"
+)
+
+func newTestLogger(t *testing.T) *tslog.Logger {
+	return tslog.Config{
+		Level:   slog.LevelDebug,
+		NoColor: true,
+	}.NewLogger(t.Output())
+}
+
+func newTestPSK(t *testing.T, keyLength int) string {
+	t.Helper()
+	psk := make([]byte, keyLength)
+	rand.Read(psk)
+	return base64.StdEncoding.EncodeToString(psk)
+}
+
+// listenLoopback returns a TCP listener and a UDP socket on the same loopback port.
+func listenLoopback(t *testing.T) (*net.TCPListener, *net.UDPConn) {
+	t.Helper()
+	for range 10 {
+		ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatalf("net.ListenTCP() failed: %v", err)
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: ln.Addr().(*net.TCPAddr).Port})
+		if err != nil {
+			// The port is taken for UDP. Try another one.
+			ln.Close()
+			continue
+		}
+		return ln, conn
+	}
+	t.Fatal("failed to find a free loopback port for both TCP and UDP")
+	return nil, nil
+}
+
+// startEcho starts TCP and UDP echo servers on the loopback address, and returns their address.
+func startEcho(t *testing.T) string {
+	ln, conn := listenLoopback(t)
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		conn.Close()
+		wg.Wait()
+	})
+
+	wg.Go(func() {
+		for {
+			c, err := ln.AcceptTCP()
+			if err != nil {
+				return
+			}
+			wg.Go(func() {
+				defer c.Close()
+				io.Copy(c, c)
+				c.CloseWrite()
+			})
+		}
+	})
+
+	wg.Go(func() {
+		buf := make([]byte, udprelay.BufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			conn.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	})
+
+	return ln.Addr().String()
+}
+
+// startRelay starts serving TCP and UDP with r on the loopback address, and returns its address.
+func startRelay(t *testing.T, r relay) string {
+	ln, conn := listenLoopback(t)
+	ctx, cancel := context.WithCancel(t.Context())
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	wg.Go(func() {
+		if err := r.serveTCP(ctx, ln); err != nil {
+			t.Errorf("serveTCP() failed: %v", err)
+		}
+	})
+	wg.Go(func() {
+		if err := r.serveUDP(ctx, conn); err != nil {
+			t.Errorf("serveUDP() failed: %v", err)
+		}
+	})
+
+	return ln.Addr().String()
+}
+
+// startClientServer starts a server with serverCfg and a client with clientCfg that tunnels to an echo target,
+// and returns the client address.
+func startClientServer(t *testing.T, serverCfg, clientCfg relayConfig) string {
+	t.Helper()
+	logger := newTestLogger(t)
+
+	s, err := serverCfg.newServer(logger.WithAttrs(slog.String("relay", "server")))
+	if err != nil {
+		t.Fatalf("newServer() failed: %v", err)
+	}
+	clientCfg.ServerAddress = startRelay(t, s)
+	clientCfg.TargetAddress = startEcho(t)
+
+	c, err := clientCfg.newClient(logger.WithAttrs(slog.String("relay", "client")))
+	if err != nil {
+		t.Fatalf("newClient() failed: %v", err)
+	}
+	return startRelay(t, c)
+}
+
+func testTCPEcho(t *testing.T, address string, size int) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	request := make([]byte, size)
+	rand.Read(request)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := conn.Write(request)
+		if err == nil {
+			err = conn.(*net.TCPConn).CloseWrite()
+		}
+		errCh <- err
+	}()
+
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("io.ReadAll() failed: %v", err)
+	}
+	if err = <-errCh; err != nil {
+		t.Fatalf("conn.Write() failed: %v", err)
+	}
+	if !bytes.Equal(response, request) {
+		t.Errorf("TCP echo returned %d bytes different from the %d-byte request", len(response), len(request))
+	}
+}
+
+func testUDPEcho(t *testing.T, address string) {
+	t.Helper()
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, udprelay.BufferSize)
+	for _, size := range [...]int{0, 1, 1200} {
+		request := make([]byte, size)
+		rand.Read(request)
+
+		// UDP may drop packets, even on loopback, so retry until the echo comes back.
+		var n int
+		for attempt := 0; ; attempt++ {
+			if attempt == 10 {
+				t.Fatalf("no UDP echo for %d-byte packet", size)
+			}
+			if _, err = conn.Write(request); err != nil {
+				t.Fatalf("conn.Write() failed: %v", err)
+			}
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			if n, err = conn.Read(buf); err == nil {
+				break
+			}
+		}
+		if !bytes.Equal(buf[:n], request) {
+			t.Errorf("UDP echo = %x, want %x", buf[:n], request)
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	for _, c := range [...]struct {
+		method    string
+		keyLength int
+	}{
+		{shadowsocks.Method2022Blake3Aes128Gcm, 16},
+		{shadowsocks.Method2022Blake3Aes256Gcm, 32},
+		{shadowsocks.Method2022Blake3Chacha20Poly1305, 32},
+	} {
+		t.Run(c.method, func(t *testing.T) {
+			cfg := relayConfig{
+				Method: c.method,
+				PSK:    newTestPSK(t, c.keyLength),
+			}
+			address := startClientServer(t, cfg, cfg)
+
+			t.Run("TCP", func(t *testing.T) {
+				for _, size := range [...]int{0, 1, 1 << 20} {
+					testTCPEcho(t, address, size)
+				}
+			})
+			t.Run("UDP", func(t *testing.T) {
+				testUDPEcho(t, address)
+			})
+		})
+	}
+}
+
+func TestClientTCPInitialPayloadInHeader(t *testing.T) {
+	logger := newTestLogger(t)
+	cfg := relayConfig{
+		Method:        shadowsocks.Method2022Blake3Aes256Gcm,
+		PSK:           newTestPSK(t, 32),
+		TargetAddress: "192.0.2.1:80",
+	}
+	psk, err := base64.StdEncoding.DecodeString(cfg.PSK)
+	if err != nil {
+		t.Fatalf("base64.StdEncoding.DecodeString() failed: %v", err)
+	}
+	serverCipher, err := shadowsocks.NewTCPCipher(cfg.Method, psk)
+	if err != nil {
+		t.Fatalf("shadowsocks.NewTCPCipher() failed: %v", err)
+	}
+
+	serverLn, serverUDPConn := listenLoopback(t)
+	defer serverLn.Close()
+	serverUDPConn.Close()
+
+	cfg.ServerAddress = serverLn.Addr().String()
+	c, err := cfg.newClient(logger.WithAttrs(slog.String("relay", "client")))
+	if err != nil {
+		t.Fatalf("newClient() failed: %v", err)
+	}
+	conn, err := net.Dial("tcp", startRelay(t, c))
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	if _, err = conn.Write(request); err != nil {
+		t.Fatalf("conn.Write() failed: %v", err)
+	}
+
+	serverConn, err := serverLn.AcceptTCP()
+	if err != nil {
+		t.Fatalf("serverLn.AcceptTCP() failed: %v", err)
+	}
+	defer serverConn.Close()
+	serverConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	ssConn := serverCipher.NewServerConn(serverConn, nil)
+	target, err := ssConn.Handshake()
+	if err != nil {
+		t.Fatalf("ssConn.Handshake() failed: %v", err)
+	}
+	if got := target.String(); got != cfg.TargetAddress {
+		t.Errorf("ssConn.Handshake() = %s, want %s", got, cfg.TargetAddress)
+	}
+
+	// The request must have arrived in the header. With the socket's read deadline in the past,
+	// any read that needs another chunk from the socket fails.
+	serverConn.SetReadDeadline(time.Now())
+	got := make([]byte, len(request))
+	if _, err = io.ReadFull(ssConn, got); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v, the request was not sent in the header", err)
+	}
+	if !bytes.Equal(got, request) {
+		t.Errorf("initial payload = %q, want %q", got, request)
+	}
+}
+
+func TestServeTCPCancelWithOpenConnection(t *testing.T) {
+	logger := newTestLogger(t)
+	cfg := relayConfig{
+		Method: shadowsocks.Method2022Blake3Aes256Gcm,
+		PSK:    newTestPSK(t, 32),
+	}
+
+	s, err := cfg.newServer(logger.WithAttrs(slog.String("relay", "server")))
+	if err != nil {
+		t.Fatalf("newServer() failed: %v", err)
+	}
+	serverLn, serverUDPConn := listenLoopback(t)
+	serverUDPConn.Close()
+
+	cfg.ServerAddress = serverLn.Addr().String()
+	cfg.TargetAddress = startEcho(t)
+	c, err := cfg.newClient(logger.WithAttrs(slog.String("relay", "client")))
+	if err != nil {
+		t.Fatalf("newClient() failed: %v", err)
+	}
+	clientLn, clientUDPConn := listenLoopback(t)
+	clientUDPConn.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, r := range [...]struct {
+		name string
+		ln   *net.TCPListener
+		r    relay
+	}{
+		{"server", serverLn, s},
+		{"client", clientLn, c},
+	} {
+		wg.Go(func() {
+			if err := r.r.serveTCP(ctx, r.ln); err != nil {
+				t.Errorf("%s serveTCP() failed: %v", r.name, err)
+			}
+		})
+	}
+
+	conn, err := net.Dial("tcp", clientLn.Addr().String())
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Wait for the echo, so that the connection is relayed all the way to the target.
+	request := []byte("hello")
+	if _, err = conn.Write(request); err != nil {
+		t.Fatalf("conn.Write() failed: %v", err)
+	}
+	response := make([]byte, len(request))
+	if _, err = io.ReadFull(conn, response); err != nil {
+		t.Fatalf("io.ReadFull() failed: %v", err)
+	}
+
+	// The connection is still open, and must not keep serveTCP from returning.
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("serveTCP() did not return after cancellation with an open connection")
+	}
+}
+
+// listenLocalhostUDP returns a UDP socket on the first address localhost resolves to,
+// which is where the server sends packets to a localhost target.
+func listenLocalhostUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	addrs, err := net.DefaultResolver.LookupNetIP(t.Context(), "ip", "localhost")
+	if err != nil || len(addrs) == 0 {
+		t.Skipf("failed to resolve localhost: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(addrs[0].Unmap(), 0)))
+	if err != nil {
+		t.Fatalf("net.ListenUDP() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return conn
+}
+
+func TestServerSendUDPToTarget(t *testing.T) {
+	s := &server{logger: newTestLogger(t)}
+	targetConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatalf("net.ListenUDP() failed: %v", err)
+	}
+	defer targetConn.Close()
+	session := &serverUDPSession{targetConn: targetConn}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	receiver := listenLocalhostUDP(t)
+	port := receiver.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+	buf := make([]byte, udprelay.BufferSize)
+	receive := func(want string) {
+		t.Helper()
+		receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := receiver.Read(buf)
+		if err != nil {
+			t.Fatalf("receiver.Read() failed: %v", err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("receiver.Read() = %q, want %q", got, want)
+		}
+	}
+
+	s.sendUDPToTarget(t.Context(), &wg, session, ip.SocksAddrFromAddrPort(receiver.LocalAddr().(*net.UDPAddr).AddrPort()), []byte("ip"))
+	receive("ip")
+
+	// Packets sent while the domain is being resolved are queued, and arrive in order once it is resolved.
+	target, err := ip.SocksAddrFromDomainPort("localhost", port)
+	if err != nil {
+		t.Fatalf("ip.SocksAddrFromDomainPort() failed: %v", err)
+	}
+	for _, payload := range [...]string{"first", "second", "third"} {
+		s.sendUDPToTarget(t.Context(), &wg, session, target, []byte(payload))
+	}
+	for _, want := range [...]string{"first", "second", "third"} {
+		receive(want)
+	}
+
+	// Later packets go straight to the resolved address.
+	s.sendUDPToTarget(t.Context(), &wg, session, target, []byte("resolved"))
+	receive("resolved")
+}
+
+func TestRelayUDPDomainTargetFirstPacket(t *testing.T) {
+	logger := newTestLogger(t)
+	cfg := relayConfig{
+		Method: shadowsocks.Method2022Blake3Aes256Gcm,
+		PSK:    newTestPSK(t, 32),
+	}
+
+	s, err := cfg.newServer(logger.WithAttrs(slog.String("relay", "server")))
+	if err != nil {
+		t.Fatalf("newServer() failed: %v", err)
+	}
+	receiver := listenLocalhostUDP(t)
+	cfg.ServerAddress = startRelay(t, s)
+	cfg.TargetAddress = net.JoinHostPort("localhost", strconv.Itoa(receiver.LocalAddr().(*net.UDPAddr).Port))
+
+	c, err := cfg.newClient(logger.WithAttrs(slog.String("relay", "client")))
+	if err != nil {
+		t.Fatalf("newClient() failed: %v", err)
+	}
+	conn, err := net.Dial("udp", startRelay(t, c))
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Send exactly one datagram, with no retries: it must not be lost to the lookup of the target.
+	request := []byte("hello")
+	if _, err = conn.Write(request); err != nil {
+		t.Fatalf("conn.Write() failed: %v", err)
+	}
+	buf := make([]byte, udprelay.BufferSize)
+	receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := receiver.Read(buf)
+	if err != nil {
+		t.Fatalf("receiver.Read() failed: %v", err)
+	}
+	if !bytes.Equal(buf[:n], request) {
+		t.Errorf("receiver.Read() = %q, want %q", buf[:n], request)
+	}
+}
+
+func TestRelayMultiUser(t *testing.T) {
+	const method = shadowsocks.Method2022Blake3Aes256Gcm
+	identityPSK := newTestPSK(t, 32)
+	users := []userConfig{
+		{Name: "alice", PSK: newTestPSK(t, 32)},
+		{Name: "bob", PSK: newTestPSK(t, 32)},
+	}
+
+	data, err := json.Marshal(users)
+	if err != nil {
+		t.Fatalf("json.Marshal() failed: %v", err)
+	}
+	usersPath := filepath.Join(t.TempDir(), "users.json")
+	if err = os.WriteFile(usersPath, data, 0o600); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	for _, u := range users {
+		t.Run(u.Name, func(t *testing.T) {
+			address := startClientServer(t,
+				relayConfig{Method: method, PSK: identityPSK, UsersPath: usersPath},
+				relayConfig{Method: method, PSK: identityPSK + ":" + u.PSK},
+			)
+			testTCPEcho(t, address, 4096)
+			testUDPEcho(t, address)
+		})
+	}
+}
+
+func TestRelayConfigErrors(t *testing.T) {
+	logger := newTestLogger(t)
+	psk := newTestPSK(t, 32)
+
+	for _, c := range [...]struct {
+		name string
+		cfg  relayConfig
+	}{
+		{"MissingPSK", relayConfig{Method: shadowsocks.Method2022Blake3Aes256Gcm, ServerAddress: "127.0.0.1:1", TargetAddress: "127.0.0.1:2"}},
+		{"BadPSK", relayConfig{Method: shadowsocks.Method2022Blake3Aes256Gcm, PSK: "!", ServerAddress: "127.0.0.1:1", TargetAddress: "127.0.0.1:2"}},
+		{"WrongPSKLength", relayConfig{Method: shadowsocks.Method2022Blake3Aes128Gcm, PSK: psk, ServerAddress: "127.0.0.1:1", TargetAddress: "127.0.0.1:2"}},
+		{"MissingServer", relayConfig{Method: shadowsocks.Method2022Blake3Aes256Gcm, PSK: psk, TargetAddress: "127.0.0.1:2"}},
+		{"MissingTarget", relayConfig{Method: shadowsocks.Method2022Blake3Aes256Gcm, PSK: psk, ServerAddress: "127.0.0.1:1"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := c.cfg.newClient(logger); err == nil {
+				t.Error("newClient() succeeded")
+			}
+		})
+	}
+
+	if _, err := (&relayConfig{Method: shadowsocks.Method2022Blake3Aes256Gcm, PSK: psk + ":" + psk}).newServer(logger); err == nil {
+		t.Error("newServer() succeeded with two PSKs")
+	}
+}
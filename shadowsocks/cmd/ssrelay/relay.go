@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/shadowsocks"
+)
+
+// relayConfig is the configuration of a relay client or server.
+type relayConfig struct {
+	// Method is the shadowsocks 2022 method.
+	Method string
+
+	// PSK is the base64-encoded PSK.
+	// For a client of a multi-user server, it is a colon-separated list of identity PSKs followed by the user PSK.
+	// For a server with UsersPath, it is the server's identity PSK.
+	PSK string
+
+	// UsersPath is the path to the users file of a multi-user server.
+	UsersPath string
+
+	// ServerAddress is the address of the server a client connects to.
+	ServerAddress string
+
+	// TargetAddress is the address a client tunnels connections and packets to, through the server.
+	TargetAddress string
+
+	// UDPIdleTimeout is how long an idle UDP session is kept.
+	UDPIdleTimeout time.Duration
+}
+
+// udpIdleTimeout returns the UDP idle timeout, or [shadowsocks.DefaultUDPIdleTimeout] if it is not positive.
+func (cfg *relayConfig) udpIdleTimeout() time.Duration {
+	if cfg.UDPIdleTimeout <= 0 {
+		return shadowsocks.DefaultUDPIdleTimeout
+	}
+	return cfg.UDPIdleTimeout
+}
+
+// relay serves TCP connections and UDP packets until the context is canceled.
+type relay interface {
+	serveTCP(ctx context.Context, ln *net.TCPListener) error
+	serveUDP(ctx context.Context, conn *net.UDPConn) error
+}
+
+// parsePSKs decodes a colon-separated list of base64-encoded PSKs.
+func parsePSKs(s string) ([][]byte, error) {
+	if s == "" {
+		return nil, errors.New("missing PSK")
+	}
+	parts := strings.Split(s, ":")
+	psks := make([][]byte, len(parts))
+	for i, part := range parts {
+		psk, err := base64.StdEncoding.DecodeString(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode PSK %d: %w", i, err)
+		}
+		psks[i] = psk
+	}
+	return psks, nil
+}
+
+// acceptLoop accepts connections from ln and handles each in a new goroutine,
+// until ctx is canceled. It closes ln, and waits for the handlers to return.
+//
+// When ctx is canceled, accepted connections are closed to unblock their handlers.
+// Handlers must close the connections they open themselves on cancellation.
+func acceptLoop(ctx context.Context, logger *tslog.Logger, ln *net.TCPListener, handle func(conn *net.TCPConn)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	stop := context.AfterFunc(ctx, func() {
+		ln.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			logger.Warn("Failed to accept TCP connection", tslog.Err(err))
+			continue
+		}
+
+		wg.Go(func() {
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() {
+				conn.Close()
+			})
+			defer stop()
+			handle(conn)
+		})
+	}
+}
+
+// halfCloseConn is a connection whose writing side can be shut down.
+type halfCloseConn interface {
+	io.ReadWriter
+	CloseWrite() error
+}
+
+// relayTCP copies data between left and right in both directions,
+// shutting down the writing side of each when the other side reaches EOF.
+// It returns when both directions are done. The caller closes the connections.
+func relayTCP(logger *tslog.Logger, left, right halfCloseConn) {
+	var wg sync.WaitGroup
+	wg.Go(func() {
+		copyAndCloseWrite(logger, "left to right", right, left)
+	})
+	copyAndCloseWrite(logger, "right to left", left, right)
+	wg.Wait()
+}
+
+func copyAndCloseWrite(logger *tslog.Logger, direction string, dst, src halfCloseConn) {
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		logger.Debug("Failed to relay TCP stream",
+			slog.String("direction", direction),
+			tslog.Int("bytes", n),
+			tslog.Err(err),
+		)
+	}
+	if err = dst.CloseWrite(); err != nil {
+		logger.Debug("Failed to close write", slog.String("direction", direction), tslog.Err(err))
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+	"github.com/database64128/cubic-go-playground/internal/udprelay"
+	"github.com/database64128/cubic-go-playground/ip"
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/shadowsocks"
+)
+
+// tcpHandshakeTimeout is how long the server waits for the request header of a TCP connection.
+const tcpHandshakeTimeout = 30 * time.Second
+
+// server relays shadowsocks TCP connections and UDP packets to their targets.
+type server struct {
+	logger         *tslog.Logger
+	users          *shadowsocks.UserTable
+	tcpCipher      *shadowsocks.TCPCipher
+	saltFilter     shadowsocks.SaltFilter
+	udpServer      *shadowsocks.UDPServer
+	udpIdleTimeout time.Duration
+}
+
+// newServer returns a new server with the config.
+// If the config has a users file, the server is a multi-user server with the users in the file.
+func (cfg *relayConfig) newServer(logger *tslog.Logger) (*server, error) {
+	psks, err := parsePSKs(cfg.PSK)
+	if err != nil {
+		return nil, err
+	}
+	if len(psks) != 1 {
+		return nil, errors.New("server takes exactly one PSK")
+	}
+	psk := psks[0]
+
+	s := server{
+		logger:         logger,
+		saltFilter:     shadowsocks.NewSaltFilter(),
+		udpIdleTimeout: cfg.udpIdleTimeout(),
+	}
+
+	var (
+		udpCipher     shadowsocks.UDPCipher
+		udpUserCipher *shadowsocks.UDPUserCipher
+	)
+	if cfg.UsersPath == "" {
+		if s.tcpCipher, err = shadowsocks.NewTCPCipher(cfg.Method, psk); err != nil {
+			return nil, err
+		}
+		if udpCipher, err = shadowsocks.NewUDPCipher(cfg.Method, psk); err != nil {
+			return nil, err
+		}
+	} else {
+		// The UDP session table is unbounded, so are the session subkey caches of users.
+		if s.users, err = shadowsocks.NewUserTable(cfg.Method, 0); err != nil {
+			return nil, err
+		}
+		if err = s.loadUsers(cfg.UsersPath); err != nil {
+			return nil, err
+		}
+		if s.tcpCipher, err = shadowsocks.NewTCPServerCipherWithUsers(cfg.Method, psk, s.users); err != nil {
+			return nil, err
+		}
+		if udpUserCipher, err = shadowsocks.NewUDPServerCipherWithUsers(cfg.Method, psk, s.users); err != nil {
+			return nil, err
+		}
+	}
+
+	s.udpServer = shadowsocks.UDPConfig{
+		Cipher:      udpCipher,
+		UserCipher:  udpUserCipher,
+		IdleTimeout: cfg.UDPIdleTimeout,
+	}.NewServer()
+	return &s, nil
+}
+
+// userConfig is a user in the users file.
+type userConfig struct {
+	Name string `json:"name"`
+	PSK  string `json:"psk"`
+}
+
+// loadUsers replaces the users of a multi-user server with the users in the JSON file at path.
+func (s *server) loadUsers(path string) error {
+	if s.users == nil {
+		return errors.New("not a multi-user server")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var configs []userConfig
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return err
+	}
+
+	users := make([]shadowsocks.User, len(configs))
+	for i, uc := range configs {
+		psk, err := base64.StdEncoding.DecodeString(uc.PSK)
+		if err != nil {
+			return fmt.Errorf("failed to decode PSK of user %q: %w", uc.Name, err)
+		}
+		users[i] = shadowsocks.User{Name: uc.Name, PSK: psk}
+	}
+	return s.users.Store(users)
+}
+
+// userAttr returns a log attribute with the name of the user, if any.
+func userAttr(user *shadowsocks.User) slog.Attr {
+	if user == nil {
+		return slog.Attr{}
+	}
+	return slog.String("user", user.Name)
+}
+
+// serveTCP implements [relay.serveTCP].
+func (s *server) serveTCP(ctx context.Context, ln *net.TCPListener) error {
+	var dialer net.Dialer
+	return acceptLoop(ctx, s.logger, ln, func(conn *net.TCPConn) {
+		logger := s.logger.WithAttrs(tslog.AddrPort("clientAddress", conn.RemoteAddr().(*net.TCPAddr).AddrPort()))
+
+		ssConn := s.tcpCipher.NewServerConn(conn, s.saltFilter)
+		conn.SetReadDeadline(time.Now().Add(tcpHandshakeTimeout))
+		target, err := ssConn.Handshake()
+		if err != nil {
+			logger.Warn("Failed to handshake", tslog.Err(err))
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		logger = logger.WithAttrs(slog.String("target", target.String()), userAttr(ssConn.User()))
+
+		targetConn, err := dialer.DialContext(ctx, "tcp", target.String())
+		if err != nil {
+			logger.Warn("Failed to connect to target", tslog.Err(err))
+			return
+		}
+		defer targetConn.Close()
+		stop := context.AfterFunc(ctx, func() {
+			targetConn.Close()
+		})
+		defer stop()
+
+		logger.Debug("Relaying TCP connection")
+		relayTCP(logger, ssConn, targetConn.(*net.TCPConn))
+	})
+}
+
+const (
+	// udpMaxResolvedDomains is the maximum number of domain targets a UDP session remembers the addresses of.
+	udpMaxResolvedDomains = 64
+
+	// udpMaxPendingPackets is the maximum number of packets a UDP session queues for a domain target being resolved.
+	udpMaxPendingPackets = 16
+)
+
+// serverUDPSession is the state of a client session: the socket to targets, and the last client address.
+type serverUDPSession struct {
+	targetConn *net.UDPConn
+	clientAddr atomic.Pointer[netip.AddrPort]
+
+	// ss is the shadowsocks session. It is replaced if the shadowsocks session expires before the NAT entry.
+	ss atomic.Pointer[shadowsocks.UDPServerSession]
+
+	// resolvedMu protects resolved and the domain targets in it.
+	resolvedMu sync.Mutex
+	// resolved maps the domain targets of the session to their resolution state.
+	resolved map[string]*udpDomainTarget
+}
+
+// udpDomainTarget is a domain target of a UDP session.
+type udpDomainTarget struct {
+	// addr is the address of the domain, or the zero address while the domain is being resolved.
+	addr netip.Addr
+
+	// pending are the packets to the domain queued while it is being resolved.
+	pending []udpPendingPacket
+}
+
+// udpPendingPacket is a packet queued for a domain target being resolved.
+type udpPendingPacket struct {
+	port    uint16
+	payload []byte
+}
+
+// serveUDP implements [relay.serveUDP].
+//
+// Each client session gets its own socket to targets, tracked in a NAT table by client session ID,
+// and closed after the idle timeout. Replies go to the address of the last packet of the session.
+func (s *server) serveUDP(ctx context.Context, conn *net.UDPConn) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	nat := cache.ExpirationCacheConfig[uint64, *serverUDPSession]{
+		IdleTimeout: s.udpIdleTimeout,
+		OnEvict: func(entry cache.Entry[uint64, *serverUDPSession], reason cache.EvictionReason) {
+			s.logger.Debug("Closing UDP session",
+				tslog.Uint("sessionID", entry.Key),
+				slog.String("reason", reason.String()),
+			)
+			entry.Value.targetConn.Close()
+		},
+	}.NewCache()
+	defer nat.Clear()
+
+	janitorCtx, cancelJanitor := context.WithCancel(ctx)
+	defer cancelJanitor()
+	wg.Go(func() {
+		nat.RunJanitor(janitorCtx, nil)
+	})
+	wg.Go(func() {
+		s.udpServer.Sessions().RunJanitor(janitorCtx)
+	})
+
+	return udprelay.ReadLoop(ctx, s.logger, conn, func(b []byte, clientAddr netip.AddrPort) {
+		ss, target, payload, err := s.udpServer.Open(b, time.Now())
+		if err != nil {
+			s.logger.Debug("Dropped UDP packet from client", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+			return
+		}
+
+		session, err := nat.GetOrLoadNow(ss.ClientSessionID(), func(sessionID uint64) (*serverUDPSession, time.Time, error) {
+			targetConn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			session := &serverUDPSession{
+				targetConn: targetConn,
+			}
+			session.clientAddr.Store(&clientAddr)
+			session.ss.Store(ss)
+			s.logger.Debug("Started UDP session",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.Uint("sessionID", sessionID),
+				userAttr(ss.User()),
+			)
+			wg.Go(func() {
+				s.relayUDPReplies(ctx, conn, session)
+			})
+			return session, nat.Clock().Now().Add(s.udpIdleTimeout), nil
+		})
+		if err != nil {
+			s.logger.Warn("Failed to start UDP session", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+			return
+		}
+
+		session.ss.Store(ss)
+
+		// Follow the client across address changes, such as NAT rebinding.
+		if last := session.clientAddr.Load(); !ip.AddrPortMappedEqual(*last, clientAddr) {
+			session.clientAddr.Store(&clientAddr)
+			s.logger.Debug("UDP session client address changed",
+				tslog.Uint("sessionID", ss.ClientSessionID()),
+				tslog.AddrPort("oldClientAddress", *last),
+				tslog.AddrPort("clientAddress", clientAddr),
+			)
+		}
+
+		s.sendUDPToTarget(ctx, &wg, session, target, payload)
+	})
+}
+
+// relayUDPReplies seals packets from targets and sends them to the client of the session,
+// until the target socket is closed or ctx is canceled.
+//
+// Read errors are retried with [udprelay.Backoff]. The loop never gives up on them,
+// as the socket is closed when the session is evicted.
+func (s *server) relayUDPReplies(ctx context.Context, conn *net.UDPConn, session *serverUDPSession) {
+	var (
+		buf     = make([]byte, udprelay.BufferSize)
+		sealBuf []byte
+		backoff udprelay.Backoff
+	)
+	for {
+		n, from, err := session.targetConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Debug("Failed to read UDP packet from target",
+				tslog.Uint("sessionID", session.ss.Load().ClientSessionID()),
+				tslog.Int("consecutiveErrors", backoff.Fail()),
+				tslog.Err(err),
+			)
+			if !backoff.Wait(ctx) {
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+
+		source := ip.SocksAddrFromAddrPort(from)
+		sealBuf, err = s.udpServer.Seal(sealBuf[:0], session.ss.Load(), source, buf[:n], time.Now())
+		if err != nil {
+			s.logger.Warn("Failed to seal UDP packet", tslog.Err(err))
+			continue
+		}
+
+		clientAddr := *session.clientAddr.Load()
+		if _, err = conn.WriteToUDPAddrPort(sealBuf, clientAddr); err != nil {
+			s.logger.Debug("Failed to send UDP packet to client", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+		}
+	}
+}
+
+// sendUDPToTarget sends payload to target from the target socket of the session.
+//
+// Domain names are resolved in the background, once per session, so that lookups never block the read loop.
+// Up to [udpMaxPendingPackets] packets to a domain name are queued while it is being resolved,
+// and sent in order when the lookup completes. If the lookup fails, the queued packets are dropped,
+// and the next packet to the domain name retries the lookup.
+func (s *server) sendUDPToTarget(ctx context.Context, wg *sync.WaitGroup, session *serverUDPSession, target ip.SocksAddr, payload []byte) {
+	if !target.IsDomain() {
+		s.writeUDPToTarget(session, payload, target.AddrPort())
+		return
+	}
+	domain := target.Domain()
+
+	session.resolvedMu.Lock()
+	defer session.resolvedMu.Unlock()
+
+	if dt, ok := session.resolved[domain]; ok {
+		if dt.addr.IsValid() {
+			s.writeUDPToTarget(session, payload, netip.AddrPortFrom(dt.addr, target.Port()))
+			return
+		}
+		if len(dt.pending) >= udpMaxPendingPackets {
+			s.logger.Debug("Dropped UDP packet to target being resolved", slog.String("target", target.String()))
+			return
+		}
+		dt.pending = append(dt.pending, udpPendingPacket{target.Port(), slices.Clone(payload)})
+		return
+	}
+
+	if session.resolved == nil || len(session.resolved) >= udpMaxResolvedDomains {
+		session.resolved = make(map[string]*udpDomainTarget)
+	}
+	dt := &udpDomainTarget{
+		pending: []udpPendingPacket{{target.Port(), slices.Clone(payload)}},
+	}
+	session.resolved[domain] = dt
+
+	wg.Go(func() {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", domain)
+		if err == nil && len(addrs) == 0 {
+			err = errors.New("no addresses")
+		}
+
+		session.resolvedMu.Lock()
+		defer session.resolvedMu.Unlock()
+
+		pending := dt.pending
+		dt.pending = nil
+
+		if err != nil {
+			if session.resolved[domain] == dt {
+				delete(session.resolved, domain)
+			}
+			s.logger.Debug("Failed to resolve UDP target",
+				slog.String("domain", domain),
+				tslog.Int("droppedPackets", len(pending)),
+				tslog.Err(err),
+			)
+			return
+		}
+
+		// Flush while holding the lock, so that newer packets to the domain cannot overtake the queued ones.
+		dt.addr = addrs[0].Unmap()
+		for _, p := range pending {
+			s.writeUDPToTarget(session, p.payload, netip.AddrPortFrom(dt.addr, p.port))
+		}
+	})
+}
+
+// writeUDPToTarget sends payload to targetAddr from the target socket of the session.
+func (s *server) writeUDPToTarget(session *serverUDPSession, payload []byte, targetAddr netip.AddrPort) {
+	if _, err := session.targetConn.WriteToUDPAddrPort(payload, targetAddr); err != nil {
+		s.logger.Debug("Failed to send UDP packet to target", tslog.AddrPort("target", targetAddr), tslog.Err(err))
+	}
+}
@@ -0,0 +1,389 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+
+	"lukechampine.com/blake3"
+)
+
+// identityHeaderLength is the length of an identity header, which is one AES block.
+const identityHeaderLength = aes.BlockSize
+
+var (
+	// ErrIdentityHeadersUnsupported is returned when identity headers are requested for a method that does not support them.
+	// Only the 2022-blake3-aes-*-gcm methods support identity headers.
+	ErrIdentityHeadersUnsupported = errors.New("method does not support identity headers")
+
+	// ErrUnknownUser is returned when an identity header does not match any user.
+	ErrUnknownUser = errors.New("unknown user")
+
+	// ErrUserMismatch is returned when a packet of an existing session identifies a different user.
+	ErrUserMismatch = errors.New("session user mismatch")
+)
+
+// identityHash returns the identity of a PSK: the first 16 bytes of its BLAKE3 hash.
+func identityHash(psk []byte) [identityHeaderLength]byte {
+	h := blake3.Sum256(psk)
+	return [identityHeaderLength]byte(h[:identityHeaderLength])
+}
+
+// identitySubkeyBlock returns the block cipher that encrypts the TCP identity header with the given identity PSK and salt.
+func identitySubkeyBlock(ipsk, salt []byte) (cipher.Block, error) {
+	keyMaterial := make([]byte, 0, len(ipsk)+len(salt))
+	keyMaterial = append(keyMaterial, ipsk...)
+	keyMaterial = append(keyMaterial, salt...)
+
+	subkey := make([]byte, len(ipsk))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 identity subkey", keyMaterial)
+	return aes.NewCipher(subkey)
+}
+
+// identityPSKKeyLength returns the key length of an AES method that supports identity headers.
+func identityPSKKeyLength(method string) (int, error) {
+	switch method {
+	case Method2022Blake3Aes128Gcm:
+		return 16, nil
+	case Method2022Blake3Aes256Gcm:
+		return 32, nil
+	case Method2022Blake3Chacha20Poly1305:
+		return 0, fmt.Errorf("%w: %s", ErrIdentityHeadersUnsupported, method)
+	default:
+		return 0, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+}
+
+// checkIdentityPSKs checks that the method supports identity headers, and that all PSKs have the right length.
+func checkIdentityPSKs(method string, identityPSKs [][]byte, userPSK []byte) error {
+	keyLength, err := identityPSKKeyLength(method)
+	if err != nil {
+		return err
+	}
+	for _, psk := range append(slices.Clip(identityPSKs), userPSK) {
+		if len(psk) != keyLength {
+			return &PSKLengthError{Method: method, Length: len(psk)}
+		}
+	}
+	return nil
+}
+
+// User is a user of a multi-user server, identified by its PSK.
+type User struct {
+	Name string
+	PSK  []byte
+}
+
+// serverUser is a user with the ciphers the server uses for the user's sessions.
+type serverUser struct {
+	User
+	udp *aesUDPCipher
+}
+
+// UserTable maps identity headers to the users of a multi-user server.
+// Users can be replaced atomically while the table is in use.
+//
+// UserTable is safe for concurrent use.
+type UserTable struct {
+	method      string
+	maxSessions int
+	users       atomic.Pointer[map[[identityHeaderLength]byte]*serverUser]
+}
+
+// NewUserTable returns a new empty user table for the method.
+//
+// maxSessions should be the [UDPConfig.MaxSessions] of the server. Each user caches the session subkeys
+// of up to that many sessions, since a single user may own every session the server tracks,
+// and a smaller cache would make such a server derive the subkey again on every packet.
+// Subkeys are only cached after they authenticate a packet, so if maxSessions is not positive,
+// the caches are left unbounded like the session table, and shrink as sessions go idle.
+func NewUserTable(method string, maxSessions int) (*UserTable, error) {
+	if _, err := identityPSKKeyLength(method); err != nil {
+		return nil, err
+	}
+	t := UserTable{method: method, maxSessions: maxSessions}
+	t.users.Store(&map[[identityHeaderLength]byte]*serverUser{})
+	return &t, nil
+}
+
+// Store atomically replaces all users in the table.
+// It returns an error, and leaves the table unchanged, if any PSK has the wrong length or is shared by two users.
+//
+// Users whose name and PSK are unchanged keep their cached session subkeys.
+func (t *UserTable) Store(users []User) error {
+	old := *t.users.Load()
+	m := make(map[[identityHeaderLength]byte]*serverUser, len(users))
+
+	for _, u := range users {
+		id := identityHash(u.PSK)
+		if _, ok := m[id]; ok {
+			return fmt.Errorf("duplicate PSK for user %q", u.Name)
+		}
+
+		if su, ok := old[id]; ok && su.Name == u.Name && subtle.ConstantTimeCompare(su.PSK, u.PSK) == 1 {
+			m[id] = su
+			continue
+		}
+
+		udp, err := newAESUDPCipher(t.method, u.PSK, t.maxSessions)
+		if err != nil {
+			return fmt.Errorf("bad PSK for user %q: %w", u.Name, err)
+		}
+		m[id] = &serverUser{
+			User: User{Name: u.Name, PSK: slices.Clone(u.PSK)},
+			udp:  udp,
+		}
+	}
+
+	t.users.Store(&m)
+	return nil
+}
+
+// Len returns the number of users in the table.
+func (t *UserTable) Len() int {
+	return len(*t.users.Load())
+}
+
+// Lookup returns the user whose PSK has the given identity hash.
+func (t *UserTable) Lookup(identity [16]byte) (*User, bool) {
+	su, ok := t.lookup(identity)
+	if !ok {
+		return nil, false
+	}
+	return &su.User, true
+}
+
+func (t *UserTable) lookup(identity [identityHeaderLength]byte) (*serverUser, bool) {
+	su, ok := (*t.users.Load())[identity]
+	return su, ok
+}
+
+// eihClientUDPCipher seals client packets with identity headers.
+//
+// The separate header is encrypted with the first identity PSK, and followed by one identity header per identity PSK.
+// Each identity header is the identity hash of the next PSK in the chain, XORed with the plaintext separate header,
+// and encrypted with the identity PSK. The message is sealed with the user PSK, as in single-user mode.
+// Server packets carry no identity headers, and are opened with the user PSK.
+type eihClientUDPCipher struct {
+	*aesUDPCipher
+	headerBlock    cipher.Block
+	identityBlocks []cipher.Block
+	identityHashes [][identityHeaderLength]byte
+}
+
+// NewUDPClientCipherWithIdentity returns a client [UDPCipher] that identifies the user to multi-user servers.
+//
+// identityPSKs are the identity PSKs of the servers along the path, starting from the first hop,
+// and userPSK is the user's PSK on the last server.
+func NewUDPClientCipherWithIdentity(method string, identityPSKs [][]byte, userPSK []byte) (UDPCipher, error) {
+	if err := checkIdentityPSKs(method, identityPSKs, userPSK); err != nil {
+		return nil, err
+	}
+	if len(identityPSKs) == 0 {
+		return newAESUDPCipher(method, userPSK, defaultSubkeyCacheCapacity)
+	}
+
+	userCipher, err := newAESUDPCipher(method, userPSK, defaultSubkeyCacheCapacity)
+	if err != nil {
+		return nil, err
+	}
+
+	c := eihClientUDPCipher{
+		aesUDPCipher:   userCipher,
+		identityBlocks: make([]cipher.Block, len(identityPSKs)),
+		identityHashes: make([][identityHeaderLength]byte, len(identityPSKs)),
+	}
+	for i, ipsk := range identityPSKs {
+		if c.identityBlocks[i], err = aes.NewCipher(ipsk); err != nil {
+			return nil, err
+		}
+		next := userPSK
+		if i+1 < len(identityPSKs) {
+			next = identityPSKs[i+1]
+		}
+		c.identityHashes[i] = identityHash(next)
+	}
+	c.headerBlock = c.identityBlocks[0]
+	return &c, nil
+}
+
+// HeaderLength implements [UDPCipher.HeaderLength].
+func (c *eihClientUDPCipher) HeaderLength() int {
+	return separateHeaderLength + len(c.identityBlocks)*identityHeaderLength
+}
+
+// Overhead implements [UDPCipher.Overhead].
+func (c *eihClientUDPCipher) Overhead() int {
+	return c.HeaderLength() + 16
+}
+
+// SealPacket implements [UDPCipher.SealPacket].
+func (c *eihClientUDPCipher) SealPacket(b []byte, sessionID, packetID uint64) ([]byte, error) {
+	headerLen := c.HeaderLength()
+	if len(b) < headerLen {
+		return nil, ErrPacketTooShort
+	}
+
+	aead, err := c.sessionAEAD(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var header [separateHeaderLength]byte
+	binary.BigEndian.PutUint64(header[:], sessionID)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+	b = aead.Seal(b[:headerLen], header[4:], b[headerLen:], nil)
+
+	for i, block := range c.identityBlocks {
+		eih := b[separateHeaderLength+i*identityHeaderLength:][:identityHeaderLength]
+		subtle.XORBytes(eih, c.identityHashes[i][:], header[:])
+		block.Encrypt(eih, eih)
+	}
+	c.headerBlock.Encrypt(b[:separateHeaderLength], header[:])
+	return b, nil
+}
+
+// UDPUserCipher opens client packets on a multi-user server.
+// It finds the user by the identity header, and opens the packet with the user's PSK.
+//
+// It is not a [UDPCipher]: it cannot seal packets, as replies must be sealed with the PSK
+// of the session's user, which [UDPServer] tracks. Set it as [UDPConfig.UserCipher].
+//
+// UDPUserCipher is safe for concurrent use.
+type UDPUserCipher struct {
+	method string
+	block  cipher.Block
+	users  *UserTable
+}
+
+// NewUDPServerCipherWithUsers returns a [UDPUserCipher] for a multi-user server
+// with the given identity PSK, whose users are looked up in users.
+func NewUDPServerCipherWithUsers(method string, identityPSK []byte, users *UserTable) (*UDPUserCipher, error) {
+	if err := checkIdentityPSKs(method, nil, identityPSK); err != nil {
+		return nil, err
+	}
+	if users.method != method {
+		return nil, fmt.Errorf("user table method %s does not match %s", users.method, method)
+	}
+	block, err := aes.NewCipher(identityPSK)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPUserCipher{
+		method: method,
+		block:  block,
+		users:  users,
+	}, nil
+}
+
+// Method returns the method name.
+func (c *UDPUserCipher) Method() string {
+	return c.method
+}
+
+// openUserPacket is like [UDPCipher.OpenPacket], but also returns the user identified by the identity header.
+func (c *UDPUserCipher) openUserPacket(b []byte) (sessionID, packetID uint64, message []byte, user *serverUser, err error) {
+	const headerLen = separateHeaderLength + identityHeaderLength
+	if len(b) < headerLen+16 {
+		return 0, 0, nil, nil, ErrPacketTooShort
+	}
+
+	var header, identity [separateHeaderLength]byte
+	c.block.Decrypt(header[:], b[:separateHeaderLength])
+	c.block.Decrypt(identity[:], b[separateHeaderLength:headerLen])
+	subtle.XORBytes(identity[:], identity[:], header[:])
+
+	user, ok := c.users.lookup(identity)
+	if !ok {
+		return 0, 0, nil, nil, ErrUnknownUser
+	}
+
+	sessionID = binary.BigEndian.Uint64(header[:])
+	packetID = binary.BigEndian.Uint64(header[8:])
+	message, err = user.udp.openSession(sessionID, b[headerLen:headerLen], header[4:], b[headerLen:])
+	if err != nil {
+		return 0, 0, nil, nil, err
+	}
+	return sessionID, packetID, message, user, nil
+}
+
+// NewTCPClientCipherWithIdentity returns a client [TCPCipher] that identifies the user to multi-user servers.
+// See [NewUDPClientCipherWithIdentity] for the meaning of the PSKs.
+func NewTCPClientCipherWithIdentity(method string, identityPSKs [][]byte, userPSK []byte) (*TCPCipher, error) {
+	if err := checkIdentityPSKs(method, identityPSKs, userPSK); err != nil {
+		return nil, err
+	}
+	c, err := NewTCPCipher(method, userPSK)
+	if err != nil {
+		return nil, err
+	}
+	for i, ipsk := range identityPSKs {
+		next := userPSK
+		if i+1 < len(identityPSKs) {
+			next = identityPSKs[i+1]
+		}
+		c.identities = append(c.identities, tcpIdentity{
+			psk:  slices.Clone(ipsk),
+			hash: identityHash(next),
+		})
+	}
+	return c, nil
+}
+
+// NewTCPServerCipherWithUsers returns a server [TCPCipher] for a multi-user server
+// with the given identity PSK, whose users are looked up in users.
+func NewTCPServerCipherWithUsers(method string, identityPSK []byte, users *UserTable) (*TCPCipher, error) {
+	if err := checkIdentityPSKs(method, nil, identityPSK); err != nil {
+		return nil, err
+	}
+	if users.method != method {
+		return nil, fmt.Errorf("user table method %s does not match %s", users.method, method)
+	}
+	c, err := NewTCPCipher(method, identityPSK)
+	if err != nil {
+		return nil, err
+	}
+	c.users = users
+	return c, nil
+}
+
+// tcpIdentity is an identity PSK of a client TCP cipher, and the identity hash of the next PSK in the chain.
+type tcpIdentity struct {
+	psk  []byte
+	hash [identityHeaderLength]byte
+}
+
+// appendIdentityHeaders appends the identity headers for the salt to b.
+func (c *TCPCipher) appendIdentityHeaders(b, salt []byte) ([]byte, error) {
+	for _, id := range c.identities {
+		block, err := identitySubkeyBlock(id.psk, salt)
+		if err != nil {
+			return nil, err
+		}
+		start := len(b)
+		b = append(b, id.hash[:]...)
+		block.Encrypt(b[start:], b[start:])
+	}
+	return b, nil
+}
+
+// lookupUser decrypts the identity header with the identity subkey for the salt, and returns the identified user.
+func (c *TCPCipher) lookupUser(eih, salt []byte) (*serverUser, error) {
+	block, err := identitySubkeyBlock(c.psk, salt)
+	if err != nil {
+		return nil, err
+	}
+	var identity [identityHeaderLength]byte
+	block.Decrypt(identity[:], eih)
+
+	user, ok := c.users.lookup(identity)
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return user, nil
+}
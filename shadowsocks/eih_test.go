@@ -0,0 +1,340 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestPSK(keyLength int) []byte {
+	psk := make([]byte, keyLength)
+	rand.Read(psk)
+	return psk
+}
+
+func newTestUserTable(t *testing.T, method string, users []User) *UserTable {
+	t.Helper()
+	table, err := NewUserTable(method, 0)
+	if err != nil {
+		t.Fatalf("NewUserTable(%q) failed: %v", method, err)
+	}
+	if err = table.Store(users); err != nil {
+		t.Fatalf("table.Store() failed: %v", err)
+	}
+	return table
+}
+
+func TestUDPIdentityHeaders(t *testing.T) {
+	for _, m := range udpCipherMethods[:2] {
+		t.Run(m.method, func(t *testing.T) {
+			ipsk := newTestPSK(m.keyLength)
+			users := []User{
+				{Name: "alice", PSK: newTestPSK(m.keyLength)},
+				{Name: "bob", PSK: newTestPSK(m.keyLength)},
+			}
+			table := newTestUserTable(t, m.method, users)
+
+			serverCipher, err := NewUDPServerCipherWithUsers(m.method, ipsk, table)
+			if err != nil {
+				t.Fatalf("NewUDPServerCipherWithUsers() failed: %v", err)
+			}
+			server := UDPConfig{UserCipher: serverCipher}.NewServer()
+
+			for _, u := range users {
+				clientCipher, err := NewUDPClientCipherWithIdentity(m.method, [][]byte{ipsk}, u.PSK)
+				if err != nil {
+					t.Fatalf("NewUDPClientCipherWithIdentity() failed: %v", err)
+				}
+				client := UDPConfig{Cipher: clientCipher}.NewClient()
+
+				packet, err := client.Seal(nil, tcpTestTarget, []byte(u.Name), time.Now())
+				if err != nil {
+					t.Fatalf("client.Seal() failed: %v", err)
+				}
+				session, _, payload, err := server.Open(packet, time.Now())
+				if err != nil {
+					t.Fatalf("server.Open() failed: %v", err)
+				}
+				if got := session.User(); got == nil || got.Name != u.Name {
+					t.Errorf("session.User() = %v, want %q", got, u.Name)
+				}
+				if string(payload) != u.Name {
+					t.Errorf("server.Open() payload = %q, want %q", payload, u.Name)
+				}
+
+				reply, err := server.Seal(nil, session, tcpTestTarget, payload, time.Now())
+				if err != nil {
+					t.Fatalf("server.Seal() failed: %v", err)
+				}
+				if _, payload, err = client.Open(reply, time.Now()); err != nil {
+					t.Fatalf("client.Open() failed: %v", err)
+				}
+				if string(payload) != u.Name {
+					t.Errorf("client.Open() payload = %q, want %q", payload, u.Name)
+				}
+			}
+
+			t.Run("UnknownUser", func(t *testing.T) {
+				clientCipher, err := NewUDPClientCipherWithIdentity(m.method, [][]byte{ipsk}, newTestPSK(m.keyLength))
+				if err != nil {
+					t.Fatalf("NewUDPClientCipherWithIdentity() failed: %v", err)
+				}
+				packet, err := UDPConfig{Cipher: clientCipher}.NewClient().Seal(nil, tcpTestTarget, nil, time.Now())
+				if err != nil {
+					t.Fatalf("client.Seal() failed: %v", err)
+				}
+				if _, _, _, err = server.Open(packet, time.Now()); !errors.Is(err, ErrUnknownUser) {
+					t.Errorf("server.Open() error = %v, want %v", err, ErrUnknownUser)
+				}
+			})
+
+			t.Run("Reload", func(t *testing.T) {
+				clientCipher, err := NewUDPClientCipherWithIdentity(m.method, [][]byte{ipsk}, users[1].PSK)
+				if err != nil {
+					t.Fatalf("NewUDPClientCipherWithIdentity() failed: %v", err)
+				}
+				client := UDPConfig{Cipher: clientCipher}.NewClient()
+
+				if err = table.Store(users[:1]); err != nil {
+					t.Fatalf("table.Store() failed: %v", err)
+				}
+				packet, err := client.Seal(nil, tcpTestTarget, nil, time.Now())
+				if err != nil {
+					t.Fatalf("client.Seal() failed: %v", err)
+				}
+				if _, _, _, err = server.Open(packet, time.Now()); !errors.Is(err, ErrUnknownUser) {
+					t.Errorf("server.Open() error = %v, want %v", err, ErrUnknownUser)
+				}
+
+				if err = table.Store(users); err != nil {
+					t.Fatalf("table.Store() failed: %v", err)
+				}
+				packet, err = client.Seal(nil, tcpTestTarget, nil, time.Now())
+				if err != nil {
+					t.Fatalf("client.Seal() failed: %v", err)
+				}
+				if _, _, _, err = server.Open(packet, time.Now()); err != nil {
+					t.Errorf("server.Open() failed: %v", err)
+				}
+			})
+
+			t.Run("SingleUserClient", func(t *testing.T) {
+				packet, err := UDPConfig{Cipher: newTestUDPCipher(t, m.method, m.keyLength)}.NewClient().Seal(nil, tcpTestTarget, nil, time.Now())
+				if err != nil {
+					t.Fatalf("client.Seal() failed: %v", err)
+				}
+				if _, _, _, err = server.Open(packet, time.Now()); err == nil {
+					t.Error("server.Open() succeeded for a packet without identity header")
+				}
+			})
+		})
+	}
+}
+
+func TestUDPIdentityHeaderChain(t *testing.T) {
+	const method = Method2022Blake3Aes128Gcm
+	ipsks := [][]byte{newTestPSK(16), newTestPSK(16)}
+	upsk := newTestPSK(16)
+
+	c, err := NewUDPClientCipherWithIdentity(method, ipsks, upsk)
+	if err != nil {
+		t.Fatalf("NewUDPClientCipherWithIdentity() failed: %v", err)
+	}
+	if got, want := c.HeaderLength(), 16+2*16; got != want {
+		t.Errorf("c.HeaderLength() = %d, want %d", got, want)
+	}
+
+	message := []byte("hello")
+	b := make([]byte, c.HeaderLength(), c.Overhead()+len(message))
+	b = append(b, message...)
+	packet, err := c.SealPacket(b, 1, 2)
+	if err != nil {
+		t.Fatalf("c.SealPacket() failed: %v", err)
+	}
+
+	// Each identity header is the hash of the next PSK XORed with the plaintext separate header,
+	// encrypted with the identity PSK.
+	var header [16]byte
+	block, _ := aes.NewCipher(ipsks[0])
+	block.Decrypt(header[:], packet[:16])
+	if sid, pid := binary.BigEndian.Uint64(header[:]), binary.BigEndian.Uint64(header[8:]); sid != 1 || pid != 2 {
+		t.Errorf("separate header = %d, %d, want 1, 2", sid, pid)
+	}
+	for i, next := range [][]byte{ipsks[1], upsk} {
+		var identity [16]byte
+		block, _ := aes.NewCipher(ipsks[i])
+		block.Decrypt(identity[:], packet[16+16*i:])
+		subtle.XORBytes(identity[:], identity[:], header[:])
+		if want := identityHash(next); identity != want {
+			t.Errorf("identity header %d = %x, want %x", i, identity, want)
+		}
+	}
+}
+
+func TestTCPIdentityHeaders(t *testing.T) {
+	for _, m := range udpCipherMethods[:2] {
+		t.Run(m.method, func(t *testing.T) {
+			ipsk := newTestPSK(m.keyLength)
+			users := []User{
+				{Name: "alice", PSK: newTestPSK(m.keyLength)},
+				{Name: "bob", PSK: newTestPSK(m.keyLength)},
+			}
+			serverCipher, err := NewTCPServerCipherWithUsers(m.method, ipsk, newTestUserTable(t, m.method, users))
+			if err != nil {
+				t.Fatalf("NewTCPServerCipherWithUsers() failed: %v", err)
+			}
+
+			for _, u := range append(users, User{Name: "mallory", PSK: newTestPSK(m.keyLength)}) {
+				clientCipher, err := NewTCPClientCipherWithIdentity(m.method, [][]byte{ipsk}, u.PSK)
+				if err != nil {
+					t.Fatalf("NewTCPClientCipherWithIdentity() failed: %v", err)
+				}
+
+				pc, ps := net.Pipe()
+				client := clientCipher.NewClientConn(pc, tcpTestTarget)
+				server := serverCipher.NewServerConn(ps, NewSaltFilter())
+
+				done := make(chan error, 1)
+				go func() {
+					defer ps.Close()
+					if _, err := server.Handshake(); err != nil {
+						done <- err
+						return
+					}
+					if got := server.User(); got == nil || got.Name != u.Name {
+						t.Errorf("server.User() = %v, want %q", got, u.Name)
+					}
+					_, err := io.CopyN(server, server, int64(len(u.Name)))
+					done <- err
+				}()
+
+				_, writeErr := client.Write([]byte(u.Name))
+				var (
+					got     []byte
+					readErr error
+				)
+				if writeErr == nil {
+					got, readErr = io.ReadAll(client)
+				}
+				pc.Close()
+				err = <-done
+
+				if u.Name == "mallory" {
+					if !errors.Is(err, ErrUnknownUser) {
+						t.Errorf("server.Handshake() error = %v, want %v", err, ErrUnknownUser)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("server failed: %v", err)
+				}
+				if writeErr != nil {
+					t.Fatalf("client.Write() failed: %v", writeErr)
+				}
+				if readErr != nil {
+					t.Fatalf("io.ReadAll(client) failed: %v", readErr)
+				}
+				if !bytes.Equal(got, []byte(u.Name)) {
+					t.Errorf("client read %q, want %q", got, u.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestUserTable(t *testing.T) {
+	const method = Method2022Blake3Aes256Gcm
+	alice := User{Name: "alice", PSK: newTestPSK(32)}
+	table := newTestUserTable(t, method, []User{alice})
+
+	u, ok := table.Lookup(identityHash(alice.PSK))
+	if !ok || u.Name != "alice" {
+		t.Fatalf("table.Lookup(alice) = %v, %v, want alice, true", u, ok)
+	}
+	if _, ok = table.Lookup(identityHash(newTestPSK(32))); ok {
+		t.Error("table.Lookup(unknown) = _, true, want false")
+	}
+
+	// Unchanged users keep their state across reloads.
+	before, _ := table.lookup(identityHash(alice.PSK))
+	if err := table.Store([]User{alice, {Name: "bob", PSK: newTestPSK(32)}}); err != nil {
+		t.Fatalf("table.Store() failed: %v", err)
+	}
+	if after, _ := table.lookup(identityHash(alice.PSK)); after != before {
+		t.Error("table.Store() replaced an unchanged user")
+	}
+	if got := table.Len(); got != 2 {
+		t.Errorf("table.Len() = %d, want 2", got)
+	}
+
+	for _, c := range [...]struct {
+		name  string
+		users []User
+	}{
+		{"DuplicatePSK", []User{alice, {Name: "eve", PSK: alice.PSK}}},
+		{"BadPSKLength", []User{{Name: "eve", PSK: newTestPSK(16)}}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if err := table.Store(c.users); err == nil {
+				t.Error("table.Store() succeeded")
+			}
+			if got := table.Len(); got != 2 {
+				t.Errorf("table.Len() = %d, want 2", got)
+			}
+		})
+	}
+}
+
+func TestUserTableSubkeyCacheCapacity(t *testing.T) {
+	const method = Method2022Blake3Aes256Gcm
+	alice := User{Name: "alice", PSK: newTestPSK(32)}
+
+	for _, c := range [...]struct {
+		maxSessions  int
+		wantCapacity int
+	}{
+		{0, math.MaxInt},
+		{1, 1},
+		{100_000, 100_000},
+	} {
+		maxSessions := c.maxSessions
+		table, err := NewUserTable(method, maxSessions)
+		if err != nil {
+			t.Fatalf("NewUserTable(%q, %d) failed: %v", method, maxSessions, err)
+		}
+		if err = table.Store([]User{alice}); err != nil {
+			t.Fatalf("table.Store() failed: %v", err)
+		}
+		su, _ := table.lookup(identityHash(alice.PSK))
+		if got := su.udp.subkeys.Capacity(); got != c.wantCapacity {
+			t.Errorf("NewUserTable(%q, %d): subkey cache capacity = %d, want %d", method, maxSessions, got, c.wantCapacity)
+		}
+	}
+}
+
+func TestIdentityHeadersUnsupported(t *testing.T) {
+	const method = Method2022Blake3Chacha20Poly1305
+	psk := newTestPSK(32)
+	if _, err := NewUserTable(method, 0); !errors.Is(err, ErrIdentityHeadersUnsupported) {
+		t.Errorf("NewUserTable() error = %v, want %v", err, ErrIdentityHeadersUnsupported)
+	}
+	if _, err := NewUDPClientCipherWithIdentity(method, [][]byte{psk}, psk); !errors.Is(err, ErrIdentityHeadersUnsupported) {
+		t.Errorf("NewUDPClientCipherWithIdentity() error = %v, want %v", err, ErrIdentityHeadersUnsupported)
+	}
+	if _, err := NewTCPClientCipherWithIdentity(method, [][]byte{psk}, psk); !errors.Is(err, ErrIdentityHeadersUnsupported) {
+		t.Errorf("NewTCPClientCipherWithIdentity() error = %v, want %v", err, ErrIdentityHeadersUnsupported)
+	}
+
+	var lengthErr *PSKLengthError
+	if _, err := NewUDPClientCipherWithIdentity(Method2022Blake3Aes128Gcm, [][]byte{psk}, psk[:16]); !errors.As(err, &lengthErr) {
+		t.Errorf("NewUDPClientCipherWithIdentity() error = %v, want %T", err, lengthErr)
+	}
+}
@@ -0,0 +1,235 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/database64128/cubic-go-playground/ip"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Legacy AEAD method names.
+const (
+	MethodAes128Gcm            = "aes-128-gcm"
+	MethodAes256Gcm            = "aes-256-gcm"
+	MethodChacha20IetfPoly1305 = "chacha20-ietf-poly1305"
+)
+
+// LegacyMaxPayloadSize is the maximum payload size of a chunk in a legacy AEAD stream.
+const LegacyMaxPayloadSize = 0x3fff
+
+// legacyZeroNonce is the nonce of legacy AEAD UDP packets, which use a fresh subkey per packet.
+var legacyZeroNonce [12]byte
+
+// EVPBytesToKey derives a key of keyLen bytes from the password, as OpenSSL's EVP_BytesToKey does
+// with MD5, one iteration, and no salt. Legacy methods use it to turn passwords into master keys.
+func EVPBytesToKey(password string, keyLen int) []byte {
+	key := make([]byte, 0, keyLen+md5.Size)
+	var prev []byte
+	for len(key) < keyLen {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		key = h.Sum(key)
+		prev = key[len(key)-md5.Size:]
+	}
+	return key[:keyLen]
+}
+
+// LegacyCipher implements the legacy shadowsocks AEAD methods.
+//
+// Each stream or packet starts with a random salt as long as the key.
+// The AEAD key is a subkey derived from the master key and the salt by HKDF-SHA1 with the info "ss-subkey".
+//
+// LegacyCipher is safe for concurrent use.
+type LegacyCipher struct {
+	method  string
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// NewLegacyCipher returns a cipher for the legacy AEAD method with the given master key.
+func NewLegacyCipher(method string, key []byte) (*LegacyCipher, error) {
+	var (
+		keyLength int
+		newAEAD   func(key []byte) (cipher.AEAD, error)
+	)
+
+	switch method {
+	case MethodAes128Gcm:
+		keyLength, newAEAD = 16, newAESGCM
+	case MethodAes256Gcm:
+		keyLength, newAEAD = 32, newAESGCM
+	case MethodChacha20IetfPoly1305:
+		keyLength, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+
+	if len(key) != keyLength {
+		return nil, &PSKLengthError{Method: method, Length: len(key)}
+	}
+
+	return &LegacyCipher{
+		method:  method,
+		key:     slices.Clone(key),
+		newAEAD: newAEAD,
+	}, nil
+}
+
+// NewLegacyCipherWithPassword returns a cipher for the legacy AEAD method,
+// with the master key derived from the password by [EVPBytesToKey].
+func NewLegacyCipherWithPassword(method, password string) (*LegacyCipher, error) {
+	var keyLength int
+	switch method {
+	case MethodAes128Gcm:
+		keyLength = 16
+	case MethodAes256Gcm, MethodChacha20IetfPoly1305:
+		keyLength = 32
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+	return NewLegacyCipher(method, EVPBytesToKey(password, keyLength))
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Method returns the method name.
+func (c *LegacyCipher) Method() string {
+	return c.method
+}
+
+// SaltSize returns the size of the salt, which is the same as the key size.
+func (c *LegacyCipher) SaltSize() int {
+	return len(c.key)
+}
+
+// sessionAEAD returns the AEAD keyed by the subkey derived from the master key and the salt.
+func (c *LegacyCipher) sessionAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(c.key))
+	if _, err := io.ReadFull(hkdf.New(sha1.New, c.key, salt, []byte("ss-subkey")), subkey); err != nil {
+		return nil, err
+	}
+	return c.newAEAD(subkey)
+}
+
+// PacketOverhead returns the number of bytes a sealed UDP packet adds to the address and payload.
+func (c *LegacyCipher) PacketOverhead() int {
+	return len(c.key) + 16
+}
+
+// SealPacket seals a UDP packet that carries payload to or from target with a random salt,
+// appends it to dst, and returns the extended buffer.
+//
+// The packet is the salt, followed by the target address and payload sealed with a zero nonce.
+func (c *LegacyCipher) SealPacket(dst []byte, target ip.SocksAddr, payload []byte) ([]byte, error) {
+	saltSize := len(c.key)
+
+	start := len(dst)
+	dst = slices.Grow(dst, c.PacketOverhead()+target.EncodedLen()+len(payload))
+	b := dst[start : start+saltSize]
+	rand.Read(b)
+
+	aead, err := c.sessionAEAD(b)
+	if err != nil {
+		return dst[:start], err
+	}
+
+	b = target.Append(b)
+	b = append(b, payload...)
+	b = aead.Seal(b[:saltSize], legacyZeroNonce[:], b[saltSize:], nil)
+	return dst[:start+len(b)], nil
+}
+
+// OpenPacket opens a UDP packet in place,
+// and returns the target address and the payload, which is a subslice of packet.
+func (c *LegacyCipher) OpenPacket(packet []byte) (target ip.SocksAddr, payload []byte, err error) {
+	saltSize := len(c.key)
+	if len(packet) < c.PacketOverhead() {
+		return ip.SocksAddr{}, nil, ErrPacketTooShort
+	}
+
+	aead, err := c.sessionAEAD(packet[:saltSize])
+	if err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+
+	plaintext, err := aead.Open(packet[saltSize:saltSize], legacyZeroNonce[:], packet[saltSize:], nil)
+	if err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+
+	target, n, err := ip.ParseSocksAddr(plaintext)
+	if err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+	return target, plaintext[n:], nil
+}
+
+// LegacyWriter writes a legacy AEAD stream. The salt is sent with the first write.
+//
+// In a request stream, the first bytes of the plaintext are the target address,
+// which the caller writes with [ip.SocksAddr.Append].
+type LegacyWriter struct {
+	chunkWriter
+}
+
+// NewWriter returns a writer that seals a stream to w with a random salt.
+func (c *LegacyCipher) NewWriter(w io.Writer) (*LegacyWriter, error) {
+	salt := make([]byte, len(c.key))
+	rand.Read(salt)
+
+	aead, err := c.sessionAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &LegacyWriter{
+		chunkWriter: newChunkWriter(w, aead, LegacyMaxPayloadSize, salt),
+	}, nil
+}
+
+// LegacyReader reads a legacy AEAD stream. The salt is read on the first read.
+type LegacyReader struct {
+	cipher *LegacyCipher
+	r      io.Reader
+	chunkReader
+}
+
+// NewReader returns a reader that opens a stream from r.
+func (c *LegacyCipher) NewReader(r io.Reader) *LegacyReader {
+	return &LegacyReader{
+		cipher: c,
+		r:      r,
+	}
+}
+
+// Read implements [io.Reader.Read].
+func (r *LegacyReader) Read(p []byte) (int, error) {
+	if r.aead == nil {
+		salt := make([]byte, len(r.cipher.key))
+		if _, err := io.ReadFull(r.r, salt); err != nil {
+			return 0, err
+		}
+
+		aead, err := r.cipher.sessionAEAD(salt)
+		if err != nil {
+			return 0, err
+		}
+		r.chunkReader = newChunkReader(r.r, aead, LegacyMaxPayloadSize)
+	}
+	return r.chunkReader.Read(p)
+}
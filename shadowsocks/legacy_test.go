@@ -0,0 +1,179 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+
+	"github.com/database64128/cubic-go-playground/ip"
+)
+
+func TestEVPBytesToKey(t *testing.T) {
+	// Generated by: openssl enc -aes-256-cbc -k <password> -nosalt -P -md md5
+	for _, c := range [...]struct {
+		password string
+		keyLen   int
+		want     string
+	}{
+		{"foobar", 16, "3858f62230ac3c915f300c664312c63f"},
+		{"foobar", 32, "3858f62230ac3c915f300c664312c63f568378529614d22ddb49237d2f60bfdf"},
+		{"barfoo!", 32, "b3adc47839e047eb228870526dc8fc30b347287ffca3045dcea06b3fdf090acb"},
+	} {
+		if got := hex.EncodeToString(EVPBytesToKey(c.password, c.keyLen)); got != c.want {
+			t.Errorf("EVPBytesToKey(%q, %d) = %s, want %s", c.password, c.keyLen, got, c.want)
+		}
+	}
+}
+
+// legacyTestVectors are sealed with the password "foobar", and the salt 10 11 .. truncated to the key length.
+// The UDP packet carries "hello" to 127.0.0.1:53.
+// The TCP stream carries "hello" and "world!" in two chunks.
+var legacyTestVectors = [...]struct {
+	method string
+	udp    string
+	tcp    string
+}{
+	{
+		method: MethodAes128Gcm,
+		udp:    "101112131415161718191a1b1c1d1e1f3cb9208bc93078cf3934a9216fc769d13634b417294d1d4f856247aa",
+		tcp:    "101112131415161718191a1b1c1d1e1f3dc3e3c83d5fd818f90aa83cec28f16571cf5c865b33d5ea6d5422388203d759737bdde0dd3b1c5ceec3972d4f1c3e6b0def1db5bf2e10d46999b978f02d87133d40d53efb4638f93dec4680235331",
+	},
+	{
+		method: MethodAes256Gcm,
+		udp:    "101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f60d200402777e85f925b541979b98482acf5eb0647e7f9d78baf72f0",
+		tcp:    "101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f61a8a3d72f5670d60533e01a60b4c08e7a0e783b939a96fa3bdef791951ba48da9139c1b537c44535c96353ecd8361ff402c938ce57f91a63721186ef1e309f787d34372ccc6218d54f4f377a72393",
+	},
+	{
+		method: MethodChacha20IetfPoly1305,
+		udp:    "101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2fb504d0373bdff22ae933930f5e6b0dd1c381e142eb723652939c7bc5",
+		tcp:    "101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2fb47eabff258a87b84efce71bd5e39565e33f7d13335482c43eaf877b1d568dd57c6a9b380e4e6e5addeaac48f336b890599c6ffe061c98d775e2ebaae6441f6e943ac06149324e792014d8fa48df96",
+	},
+}
+
+func TestLegacyCipherTestVectors(t *testing.T) {
+	for _, v := range legacyTestVectors {
+		t.Run(v.method, func(t *testing.T) {
+			c, err := NewLegacyCipherWithPassword(v.method, "foobar")
+			if err != nil {
+				t.Fatalf("NewLegacyCipherWithPassword() failed: %v", err)
+			}
+
+			udp, _ := hex.DecodeString(v.udp)
+			target, payload, err := c.OpenPacket(udp)
+			if err != nil {
+				t.Fatalf("c.OpenPacket() failed: %v", err)
+			}
+			if target.String() != "127.0.0.1:53" || string(payload) != "hello" {
+				t.Errorf("c.OpenPacket() = %v, %q, want 127.0.0.1:53, \"hello\"", target, payload)
+			}
+
+			tcp, _ := hex.DecodeString(v.tcp)
+			got, err := io.ReadAll(c.NewReader(bytes.NewReader(tcp)))
+			if err != nil {
+				t.Fatalf("io.ReadAll() failed: %v", err)
+			}
+			if string(got) != "helloworld!" {
+				t.Errorf("io.ReadAll() = %q, want %q", got, "helloworld!")
+			}
+
+			// Writing with the vector's salt produces the same stream.
+			salt := tcp[:c.SaltSize()]
+			aead, err := c.sessionAEAD(salt)
+			if err != nil {
+				t.Fatalf("c.sessionAEAD() failed: %v", err)
+			}
+			var buf bytes.Buffer
+			w := newChunkWriter(&buf, aead, LegacyMaxPayloadSize, salt)
+			w.Write([]byte("hello"))
+			w.Write([]byte("world!"))
+			if !bytes.Equal(buf.Bytes(), tcp) {
+				t.Errorf("written stream = %x, want %x", buf.Bytes(), tcp)
+			}
+		})
+	}
+}
+
+func TestLegacyCipherRoundTrip(t *testing.T) {
+	for _, v := range legacyTestVectors {
+		t.Run(v.method, func(t *testing.T) {
+			c, err := NewLegacyCipherWithPassword(v.method, "barfoo!")
+			if err != nil {
+				t.Fatalf("NewLegacyCipherWithPassword() failed: %v", err)
+			}
+
+			target := ip.SocksAddrFromAddrPort(netip.MustParseAddrPort("[::1]:443"))
+			payload := make([]byte, 1400)
+			rand.Read(payload)
+
+			packet, err := c.SealPacket([]byte("prefix"), target, payload)
+			if err != nil {
+				t.Fatalf("c.SealPacket() failed: %v", err)
+			}
+			if got := len(packet) - len("prefix"); got != c.PacketOverhead()+target.EncodedLen()+len(payload) {
+				t.Errorf("len(packet) = %d, want %d", got, c.PacketOverhead()+target.EncodedLen()+len(payload))
+			}
+			packet = packet[len("prefix"):]
+
+			for i := range packet {
+				tampered := bytes.Clone(packet)
+				tampered[i] ^= 1
+				if _, _, err := c.OpenPacket(tampered); err == nil {
+					t.Fatalf("c.OpenPacket() succeeded with byte %d flipped, want error", i)
+				}
+			}
+
+			gotTarget, gotPayload, err := c.OpenPacket(packet)
+			if err != nil {
+				t.Fatalf("c.OpenPacket() failed: %v", err)
+			}
+			if gotTarget != target || !bytes.Equal(gotPayload, payload) {
+				t.Errorf("c.OpenPacket() = %v, %x, want %v, %x", gotTarget, gotPayload, target, payload)
+			}
+
+			// A write larger than a chunk is split, and reads see the same bytes.
+			data := make([]byte, 3*LegacyMaxPayloadSize+100)
+			rand.Read(data)
+			var stream bytes.Buffer
+			w, err := c.NewWriter(&stream)
+			if err != nil {
+				t.Fatalf("c.NewWriter() failed: %v", err)
+			}
+			if n, err := w.Write(data); n != len(data) || err != nil {
+				t.Fatalf("w.Write() = %d, %v, want %d, nil", n, err, len(data))
+			}
+			sealed := bytes.Clone(stream.Bytes())
+
+			got, err := io.ReadAll(c.NewReader(&stream))
+			if err != nil {
+				t.Fatalf("io.ReadAll() failed: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("io.ReadAll() returned different data")
+			}
+
+			// Truncated streams are errors, not clean EOFs.
+			if _, err = io.ReadAll(c.NewReader(bytes.NewReader(sealed[:len(sealed)-1]))); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("io.ReadAll(truncated) error = %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+
+			sealed[len(sealed)/2] ^= 1
+			if _, err = io.ReadAll(c.NewReader(bytes.NewReader(sealed))); err == nil {
+				t.Error("io.ReadAll(tampered) succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestNewLegacyCipherErrors(t *testing.T) {
+	if _, err := NewLegacyCipherWithPassword("rc4-md5", "foobar"); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("NewLegacyCipherWithPassword(rc4-md5) error = %v, want %v", err, ErrUnknownMethod)
+	}
+	var lengthErr *PSKLengthError
+	if _, err := NewLegacyCipher(MethodAes256Gcm, key[:16]); !errors.As(err, &lengthErr) {
+		t.Errorf("NewLegacyCipher(aes-256-gcm, 16-byte key) error = %v, want %T", err, lengthErr)
+	}
+}
@@ -0,0 +1,95 @@
+package shadowsocks
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+)
+
+// Session is the receiver-side state of a UDP session.
+// It carries a sliding window filter for the session's packet IDs, and a value of type V,
+// such as the session's AEAD, which is set when the session is created and must not be modified afterwards.
+type Session[V any] struct {
+	mu     sync.Mutex
+	filter SlidingWindowFilter
+
+	// Value is the per-session value created by [SessionTable.GetOrCreate].
+	Value V
+}
+
+// AddPacketID adds the packet ID to the session's sliding window filter,
+// and returns false if the packet is a replay or too old.
+//
+// Only call AddPacketID after the packet has been authenticated,
+// otherwise forged packets can advance the window and cause valid packets to be rejected.
+func (s *Session[V]) AddPacketID(packetID uint64) bool {
+	s.mu.Lock()
+	ok := s.filter.Add(packetID)
+	s.mu.Unlock()
+	return ok
+}
+
+// SessionTable maps session IDs to sessions, and expires sessions that have been idle for too long.
+// It is safe for concurrent use.
+type SessionTable[V any] struct {
+	idleTimeout time.Duration
+	sessions    *cache.ExpirationCache[uint64, *Session[V]]
+}
+
+// NewSessionTable returns a new session table that holds at most capacity sessions,
+// and expires sessions not looked up for idleTimeout.
+//
+// If capacity is not positive, the table is unbounded.
+// When the table is full, the session closest to expiring is evicted.
+func NewSessionTable[V any](capacity int, idleTimeout time.Duration) *SessionTable[V] {
+	return &SessionTable[V]{
+		idleTimeout: idleTimeout,
+		sessions: cache.ExpirationCacheConfig[uint64, *Session[V]]{
+			Capacity:    capacity,
+			IdleTimeout: idleTimeout,
+		}.NewCache(),
+	}
+}
+
+// IdleTimeout returns the duration after which an idle session expires.
+func (t *SessionTable[V]) IdleTimeout() time.Duration {
+	return t.idleTimeout
+}
+
+// Len returns the number of sessions in the table, including expired sessions not yet pruned.
+func (t *SessionTable[V]) Len() int {
+	return t.sessions.Len()
+}
+
+// Get returns the session for the given session ID, if it exists and has not expired.
+// A successful lookup keeps the session alive for another idle timeout.
+func (t *SessionTable[V]) Get(sessionID uint64, now time.Time) (*Session[V], bool) {
+	return t.sessions.Get(sessionID, now)
+}
+
+// GetOrCreate returns the session for the given session ID.
+// If the session does not exist or has expired, a new session is created with the value returned by newValue.
+// Concurrent calls for the same session ID share one call to newValue.
+// If newValue returns an error, no session is created, and the error is returned.
+func (t *SessionTable[V]) GetOrCreate(sessionID uint64, now time.Time, newValue func(sessionID uint64) (V, error)) (*Session[V], error) {
+	return t.sessions.GetOrLoad(sessionID, now, func(sessionID uint64) (*Session[V], time.Time, error) {
+		value, err := newValue(sessionID)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return &Session[V]{Value: value}, now.Add(t.idleTimeout), nil
+	})
+}
+
+// Remove removes the session for the given session ID, and returns whether it existed.
+func (t *SessionTable[V]) Remove(sessionID uint64) bool {
+	return t.sessions.Remove(sessionID)
+}
+
+// RunJanitor removes expired sessions in the background until ctx is canceled.
+// See [cache.ExpirationCache.RunJanitor].
+func (t *SessionTable[V]) RunJanitor(ctx context.Context) {
+	t.sessions.RunJanitor(ctx, nil)
+}
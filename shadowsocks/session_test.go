@@ -0,0 +1,80 @@
+package shadowsocks
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionTable(t *testing.T) {
+	const idleTimeout = time.Minute
+
+	table := NewSessionTable[string](0, idleTimeout)
+	if got := table.IdleTimeout(); got != idleTimeout {
+		t.Errorf("table.IdleTimeout() = %v, want %v", got, idleTimeout)
+	}
+
+	var creates int
+	newValue := func(sessionID uint64) (string, error) {
+		creates++
+		if sessionID == 0 {
+			return "", errors.New("invalid session ID")
+		}
+		return "session", nil
+	}
+
+	now := time.Now()
+	if _, err := table.GetOrCreate(0, now, newValue); err == nil {
+		t.Error("table.GetOrCreate(0) succeeded, want error")
+	}
+	if _, ok := table.Get(0, now); ok {
+		t.Error("table.Get(0) = _, true after failed creation, want false")
+	}
+
+	s, err := table.GetOrCreate(1, now, newValue)
+	if err != nil {
+		t.Fatalf("table.GetOrCreate(1) failed: %v", err)
+	}
+	if s.Value != "session" {
+		t.Errorf("s.Value = %q, want %q", s.Value, "session")
+	}
+	if !s.AddPacketID(0) {
+		t.Error("s.AddPacketID(0) = false, want true")
+	}
+	if s.AddPacketID(0) {
+		t.Error("s.AddPacketID(0) = true, want false for replay")
+	}
+
+	// Lookups keep the session alive.
+	now = now.Add(idleTimeout / 2)
+	if got, err := table.GetOrCreate(1, now, newValue); got != s || err != nil {
+		t.Errorf("table.GetOrCreate(1) = %p, %v, want %p, nil", got, err, s)
+	}
+	now = now.Add(idleTimeout * 3 / 4)
+	if got, ok := table.Get(1, now); got != s || !ok {
+		t.Errorf("table.Get(1) = %p, %v, want %p, true", got, ok, s)
+	}
+	if creates != 2 {
+		t.Errorf("creates = %d, want 2", creates)
+	}
+
+	// An idle session expires, and a new one starts with a fresh filter.
+	now = now.Add(idleTimeout)
+	if _, ok := table.Get(1, now); ok {
+		t.Error("table.Get(1) = _, true for idle session, want false")
+	}
+	s, err = table.GetOrCreate(1, now, newValue)
+	if err != nil {
+		t.Fatalf("table.GetOrCreate(1) failed: %v", err)
+	}
+	if !s.AddPacketID(0) {
+		t.Error("s.AddPacketID(0) = false for new session, want true")
+	}
+
+	if !table.Remove(1) {
+		t.Error("table.Remove(1) = false, want true")
+	}
+	if got := table.Len(); got != 0 {
+		t.Errorf("table.Len() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,57 @@
+// Package shadowsocks implements the packet and stream formats of the shadowsocks protocol.
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Shadowsocks 2022 method names.
+const (
+	Method2022Blake3Aes128Gcm        = "2022-blake3-aes-128-gcm"
+	Method2022Blake3Aes256Gcm        = "2022-blake3-aes-256-gcm"
+	Method2022Blake3Chacha20Poly1305 = "2022-blake3-chacha20-poly1305"
+)
+
+// MaxTimeDiff is the maximum allowed difference between the timestamp in a message and the local time.
+const MaxTimeDiff = 30 * time.Second
+
+var (
+	// ErrPacketTooShort is returned when a packet or message is shorter than its format requires.
+	ErrPacketTooShort = errors.New("packet too short")
+
+	// ErrUnknownMethod is returned when a method name is not recognized.
+	ErrUnknownMethod = errors.New("unknown method")
+
+	// ErrBadTimestamp is returned when the timestamp in a message is too far from the local time.
+	ErrBadTimestamp = errors.New("timestamp out of range")
+
+	// ErrTypeMismatch is returned when a message has the wrong header type,
+	// such as a client message received by a client.
+	ErrTypeMismatch = errors.New("header type mismatch")
+
+	// ErrReplay is returned when a packet ID or salt has been seen before.
+	ErrReplay = errors.New("replay detected")
+)
+
+// PSKLengthError is returned when a pre-shared key has the wrong length for the method.
+type PSKLengthError struct {
+	Method string
+	Length int
+}
+
+// Error implements [error.Error].
+func (e *PSKLengthError) Error() string {
+	return fmt.Sprintf("bad PSK length %d for method %s", e.Length, e.Method)
+}
+
+// checkTimestamp returns an error if the Unix timestamp is more than [MaxTimeDiff] away from now.
+func checkTimestamp(ts uint64, now time.Time) error {
+	const maxDiff = int64(MaxTimeDiff / time.Second)
+	// Compare in seconds, so that a bogus timestamp cannot overflow a Duration.
+	if diff := int64(ts) - now.Unix(); diff < -maxDiff || diff > maxDiff {
+		return fmt.Errorf("%w: %d, local time %d", ErrBadTimestamp, ts, now.Unix())
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package shadowsocks
+
+const (
+	// swBlockBits is the number of bits in a ring block.
+	swBlockBits = 64
+
+	// swRingBlocks is the number of blocks in the ring. It must be a power of 2.
+	swRingBlocks = 64
+
+	// SlidingWindowSize is the number of counters tracked by [SlidingWindowFilter].
+	// One block of the ring is kept as a spare, so that advancing the window
+	// never clears bits that are still inside it.
+	SlidingWindowSize = (swRingBlocks - 1) * swBlockBits
+)
+
+// SlidingWindowFilter is a bitmap-based sliding window filter for packet counters,
+// as described in RFC 6479.
+//
+// It accepts packets that arrive out of order within the window,
+// and rejects duplicates and packets that fall behind the window.
+// The zero value is ready for use.
+//
+// SlidingWindowFilter is not safe for concurrent use.
+type SlidingWindowFilter struct {
+	last uint64
+	ring [swRingBlocks]uint64
+}
+
+// Reset resets the filter to its initial state.
+func (f *SlidingWindowFilter) Reset() {
+	f.last = 0
+	clear(f.ring[:])
+}
+
+// IsOk returns whether the counter is neither a duplicate nor stale, without adding it to the filter.
+func (f *SlidingWindowFilter) IsOk(counter uint64) bool {
+	if counter > f.last {
+		return true
+	}
+	if f.last-counter >= SlidingWindowSize {
+		return false
+	}
+	blockIndex := counter / swBlockBits % swRingBlocks
+	bitIndex := counter % swBlockBits
+	return f.ring[blockIndex]>>bitIndex&1 == 0
+}
+
+// MustAdd adds the counter to the filter, advancing the window if needed.
+// It does not check whether the counter is ok. Call IsOk first, or use Add.
+func (f *SlidingWindowFilter) MustAdd(counter uint64) {
+	blockIndex := counter / swBlockBits
+
+	if counter > f.last {
+		lastBlockIndex := f.last / swBlockBits
+		// Clear the blocks between the old and the new last block, including the new one.
+		diff := min(blockIndex-lastBlockIndex, swRingBlocks)
+		for i := range diff {
+			f.ring[(lastBlockIndex+i+1)%swRingBlocks] = 0
+		}
+		f.last = counter
+	}
+
+	f.ring[blockIndex%swRingBlocks] |= 1 << (counter % swBlockBits)
+}
+
+// Add adds the counter to the filter if it is ok, and returns whether it was ok.
+func (f *SlidingWindowFilter) Add(counter uint64) bool {
+	if !f.IsOk(counter) {
+		return false
+	}
+	f.MustAdd(counter)
+	return true
+}
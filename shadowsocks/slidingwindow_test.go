@@ -0,0 +1,114 @@
+package shadowsocks
+
+import "testing"
+
+func TestSlidingWindowFilter(t *testing.T) {
+	var f SlidingWindowFilter
+
+	// In-order counters, starting from 0.
+	for counter := range uint64(SlidingWindowSize) {
+		if !f.Add(counter) {
+			t.Fatalf("f.Add(%d) = false, want true", counter)
+		}
+	}
+	for counter := range uint64(SlidingWindowSize) {
+		if f.Add(counter) {
+			t.Fatalf("f.Add(%d) = true, want false for duplicate", counter)
+		}
+	}
+
+	// Jump ahead, leaving a gap that can be filled out of order.
+	last := uint64(3 * SlidingWindowSize)
+	if !f.Add(last) {
+		t.Errorf("f.Add(%d) = false, want true", last)
+	}
+	for counter := last - 1; counter > last-SlidingWindowSize; counter -= 7 {
+		if !f.IsOk(counter) {
+			t.Errorf("f.IsOk(%d) = false, want true for reordered counter", counter)
+		}
+		if !f.Add(counter) {
+			t.Errorf("f.Add(%d) = false, want true for reordered counter", counter)
+		}
+		if f.Add(counter) {
+			t.Errorf("f.Add(%d) = true, want false for duplicate", counter)
+		}
+	}
+
+	// Counters behind the window are stale.
+	for _, counter := range [...]uint64{0, SlidingWindowSize, last - SlidingWindowSize} {
+		if f.IsOk(counter) {
+			t.Errorf("f.IsOk(%d) = true, want false for stale counter", counter)
+		}
+	}
+
+	// Advancing by less than a block must not clear the current block.
+	if !f.Add(last + 1) {
+		t.Errorf("f.Add(%d) = false, want true", last+1)
+	}
+	if f.IsOk(last) {
+		t.Errorf("f.IsOk(%d) = true, want false for duplicate", last)
+	}
+
+	f.Reset()
+	if !f.Add(0) {
+		t.Error("f.Add(0) = false after Reset, want true")
+	}
+}
+
+func TestSlidingWindowFilterMatchesSet(t *testing.T) {
+	var f SlidingWindowFilter
+	seen := make(map[uint64]struct{})
+	var last uint64
+
+	// Deterministic pseudo-random walk that mostly moves forward with reordering.
+	x := uint64(1)
+	for range 100000 {
+		x ^= x << 13
+		x ^= x >> 7
+		x ^= x << 17
+		counter := last + x%256 - 192
+		if counter > last+256 {
+			// Underflow near the start.
+			counter = x % 64
+		}
+
+		_, dup := seen[counter]
+		want := !dup && (counter > last || last-counter < SlidingWindowSize)
+		if got := f.Add(counter); got != want {
+			t.Fatalf("f.Add(%d) = %v, want %v (last %d)", counter, got, want, last)
+		}
+		if want {
+			seen[counter] = struct{}{}
+			last = max(last, counter)
+		}
+	}
+}
+
+func BenchmarkSlidingWindowFilterAdd(b *testing.B) {
+	b.Run("InOrder", func(b *testing.B) {
+		var f SlidingWindowFilter
+		var counter uint64
+		for b.Loop() {
+			f.Add(counter)
+			counter++
+		}
+	})
+
+	b.Run("Reordered", func(b *testing.B) {
+		var f SlidingWindowFilter
+		var counter uint64
+		for b.Loop() {
+			// Swap each pair of counters.
+			f.Add(counter ^ 1)
+			counter++
+		}
+	})
+
+	b.Run("Replay", func(b *testing.B) {
+		var f SlidingWindowFilter
+		f.Add(0)
+		for b.Loop() {
+			f.Add(0)
+		}
+	})
+}
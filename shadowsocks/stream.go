@@ -0,0 +1,156 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// chunkLengthSize is the size of the plaintext length field of a chunk.
+const chunkLengthSize = 2
+
+// incrementNonce increments the nonce as a little-endian counter.
+func incrementNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// chunkWriter writes a stream as length-chunked AEAD frames.
+//
+// Each chunk is a sealed 2-byte big-endian payload length, followed by the sealed payload.
+// The nonce is a little-endian counter that starts at zero and is incremented after each seal.
+type chunkWriter struct {
+	w          io.Writer
+	aead       cipher.AEAD
+	nonce      []byte
+	maxPayload int
+	buf        []byte
+
+	// prefix is written before the first chunk, in the same write call.
+	prefix []byte
+}
+
+func newChunkWriter(w io.Writer, aead cipher.AEAD, maxPayload int, prefix []byte) chunkWriter {
+	return chunkWriter{
+		w:          w,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		maxPayload: maxPayload,
+		prefix:     prefix,
+	}
+}
+
+// appendSealed seals plaintext with the next nonce, appends it to b, and returns the extended buffer.
+func (w *chunkWriter) appendSealed(b, plaintext []byte) []byte {
+	b = w.aead.Seal(b, w.nonce, plaintext, nil)
+	incrementNonce(w.nonce)
+	return b
+}
+
+// appendChunks seals p as one or more chunks, appends them to b, and returns the extended buffer.
+func (w *chunkWriter) appendChunks(b, p []byte) []byte {
+	overhead := w.aead.Overhead()
+	for len(p) > 0 {
+		payload := p[:min(len(p), w.maxPayload)]
+		p = p[len(payload):]
+
+		var length [chunkLengthSize]byte
+		binary.BigEndian.PutUint16(length[:], uint16(len(payload)))
+
+		b = slices.Grow(b, chunkLengthSize+overhead+len(payload)+overhead)
+		b = w.appendSealed(b, length[:])
+		b = w.appendSealed(b, payload)
+	}
+	return b
+}
+
+// Write implements [io.Writer.Write].
+func (w *chunkWriter) Write(p []byte) (n int, err error) {
+	b := append(w.buf[:0], w.prefix...)
+	w.prefix = nil
+	b = w.appendChunks(b, p)
+	w.buf = b
+
+	if _, err = w.w.Write(b); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// chunkReader reads a stream of length-chunked AEAD frames written by a [chunkWriter].
+type chunkReader struct {
+	r          io.Reader
+	aead       cipher.AEAD
+	nonce      []byte
+	maxPayload int
+	buf        []byte
+
+	// payload is the unread part of the last opened chunk.
+	payload []byte
+}
+
+func newChunkReader(r io.Reader, aead cipher.AEAD, maxPayload int) chunkReader {
+	return chunkReader{
+		r:          r,
+		aead:       aead,
+		nonce:      make([]byte, aead.NonceSize()),
+		maxPayload: maxPayload,
+		buf:        make([]byte, maxPayload+aead.Overhead()),
+	}
+}
+
+// readSealed reads a sealed segment of n plaintext bytes, opens it with the next nonce,
+// and returns the plaintext, which is valid until the next read. n must not exceed maxPayload.
+func (r *chunkReader) readSealed(n int) ([]byte, error) {
+	sealed := r.buf[:n+r.aead.Overhead()]
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		return nil, err
+	}
+	plaintext, err := r.aead.Open(sealed[:0], r.nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sealed segment: %w", err)
+	}
+	incrementNonce(r.nonce)
+	return plaintext, nil
+}
+
+// readChunk reads and opens the next chunk, and returns its payload, which is valid until the next call.
+// It returns [io.EOF] if the stream ends cleanly at a chunk boundary.
+func (r *chunkReader) readChunk() ([]byte, error) {
+	length, err := r.readSealed(chunkLengthSize)
+	if err != nil {
+		return nil, err
+	}
+
+	payloadLen := int(binary.BigEndian.Uint16(length))
+	if payloadLen > r.maxPayload {
+		return nil, fmt.Errorf("chunk payload length %d exceeds maximum %d", payloadLen, r.maxPayload)
+	}
+
+	payload, err := r.readSealed(payloadLen)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return payload, err
+}
+
+// Read implements [io.Reader.Read].
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for len(r.payload) == 0 {
+		if r.payload, err = r.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, r.payload)
+	r.payload = r.payload[n:]
+	return n, nil
+}
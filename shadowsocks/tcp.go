@@ -0,0 +1,523 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mrand "math/rand/v2"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/database64128/cubic-go-playground/cache"
+	"github.com/database64128/cubic-go-playground/ip"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// TCPMaxPayloadSize is the maximum payload size of a chunk in a shadowsocks 2022 stream.
+const TCPMaxPayloadSize = 0xffff
+
+// DefaultSaltFilterWindow is how long a salt filter must remember salts.
+// A request is accepted if its timestamp is within [MaxTimeDiff] of the local time,
+// so a replay can arrive up to twice that long after the original request.
+const DefaultSaltFilterWindow = 2 * MaxTimeDiff
+
+const (
+	// tcpRequestFixedHeaderLength is the length of a request fixed header:
+	// type + timestamp + variable header length.
+	tcpRequestFixedHeaderLength = 1 + 8 + 2
+
+	// tcpHeaderTypeClient is the header type of request streams.
+	tcpHeaderTypeClient = 0
+
+	// tcpHeaderTypeServer is the header type of response streams.
+	tcpHeaderTypeServer = 1
+)
+
+var (
+	// ErrSaltMismatch is returned when a response does not carry the salt of the request it answers.
+	ErrSaltMismatch = errors.New("request salt mismatch")
+
+	// ErrEmptyVariableHeader is returned when a request variable header has neither padding nor payload.
+	ErrEmptyVariableHeader = errors.New("variable header has neither padding nor payload")
+)
+
+// SaltFilter remembers the salts of accepted requests, and rejects requests that reuse one.
+// Salts shorter than 32 bytes are zero-extended.
+//
+// [cache.ExactReplayFilter] and [cache.BloomReplayFilter] are suitable implementations,
+// with a window of at least [DefaultSaltFilterWindow].
+type SaltFilter = cache.ReplayFilter[[32]byte]
+
+// NewSaltFilter returns an exact salt filter with a window of [DefaultSaltFilterWindow].
+func NewSaltFilter() SaltFilter {
+	return cache.NewExactReplayFilter[[32]byte](DefaultSaltFilterWindow, 0)
+}
+
+// TCPCipher implements the stream format of the shadowsocks 2022 methods.
+//
+// Each stream starts with a random salt as long as the PSK.
+// The AEAD key is a subkey derived by BLAKE3 from the PSK and the salt.
+// The rest of the stream is sealed with a little-endian counter nonce, like legacy AEAD streams.
+// With identity headers, requests carry the identity of the user after the salt,
+// see [NewTCPClientCipherWithIdentity] and [NewTCPServerCipherWithUsers].
+//
+// TCPCipher is safe for concurrent use.
+type TCPCipher struct {
+	method  string
+	psk     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+
+	// identities are the identity PSKs of a multi-user client, see [NewTCPClientCipherWithIdentity].
+	identities []tcpIdentity
+
+	// users is the user table of a multi-user server, see [NewTCPServerCipherWithUsers].
+	// If set, psk is the server's identity PSK.
+	users *UserTable
+
+	// clock is the source of the current time for timestamps. Tests replace it with a [cache.FakeClock].
+	clock cache.Clock
+}
+
+// NewTCPCipher returns a stream cipher for the shadowsocks 2022 method with the given PSK.
+func NewTCPCipher(method string, psk []byte) (*TCPCipher, error) {
+	var (
+		keyLength int
+		newAEAD   func(key []byte) (cipher.AEAD, error)
+	)
+
+	switch method {
+	case Method2022Blake3Aes128Gcm:
+		keyLength, newAEAD = 16, newAESGCM
+	case Method2022Blake3Aes256Gcm:
+		keyLength, newAEAD = 32, newAESGCM
+	case Method2022Blake3Chacha20Poly1305:
+		keyLength, newAEAD = chacha20poly1305.KeySize, chacha20poly1305.New
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+
+	if len(psk) != keyLength {
+		return nil, &PSKLengthError{Method: method, Length: len(psk)}
+	}
+
+	return &TCPCipher{
+		method:  method,
+		psk:     slices.Clone(psk),
+		newAEAD: newAEAD,
+		clock:   cache.SystemClock{},
+	}, nil
+}
+
+// Method returns the method name.
+func (c *TCPCipher) Method() string {
+	return c.method
+}
+
+// SaltSize returns the size of the salt, which is the same as the PSK size.
+func (c *TCPCipher) SaltSize() int {
+	return len(c.psk)
+}
+
+// readSalt reads a salt from r and returns it with the chunk reader it keys with psk.
+func (c *TCPCipher) readSalt(r io.Reader, psk []byte) ([]byte, chunkReader, error) {
+	salt := make([]byte, len(c.psk))
+	if _, err := io.ReadFull(r, salt); err != nil {
+		return nil, chunkReader{}, err
+	}
+	aead, err := c.newAEAD(blake3SessionSubkey(psk, salt))
+	if err != nil {
+		return nil, chunkReader{}, err
+	}
+	return salt, newChunkReader(r, aead, TCPMaxPayloadSize), nil
+}
+
+// readRequestSalt reads the salt of a request from r, and the identity header if the cipher has a user table.
+// It returns the salt, the PSK of the request, the user if any, and the chunk reader the salt keys.
+func (c *TCPCipher) readRequestSalt(r io.Reader) (salt, psk []byte, user *serverUser, cr chunkReader, err error) {
+	if c.users == nil {
+		salt, cr, err = c.readSalt(r, c.psk)
+		return salt, c.psk, nil, cr, err
+	}
+
+	b := make([]byte, len(c.psk)+identityHeaderLength)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return nil, nil, nil, chunkReader{}, err
+	}
+	salt = b[:len(c.psk):len(c.psk)]
+
+	if user, err = c.lookupUser(b[len(c.psk):], salt); err != nil {
+		return nil, nil, nil, chunkReader{}, err
+	}
+	aead, err := c.newAEAD(blake3SessionSubkey(user.PSK, salt))
+	if err != nil {
+		return nil, nil, nil, chunkReader{}, err
+	}
+	return salt, user.PSK, user, newChunkReader(r, aead, TCPMaxPayloadSize), nil
+}
+
+// newSalt generates a random salt, appends it to b,
+// and returns the extended buffer with the chunk writer it keys with psk.
+func (c *TCPCipher) newSalt(b []byte, w io.Writer, psk []byte) ([]byte, chunkWriter, error) {
+	start := len(b)
+	b = append(b, make([]byte, len(c.psk))...)
+	rand.Read(b[start:])
+	aead, err := c.newAEAD(blake3SessionSubkey(psk, b[start:]))
+	if err != nil {
+		return nil, chunkWriter{}, err
+	}
+	return b, newChunkWriter(w, aead, TCPMaxPayloadSize, nil), nil
+}
+
+// TCPClientConn is the client side of a shadowsocks 2022 stream over a [net.Conn].
+//
+// The request header is sent with the first write, together with as much of the payload as fits.
+// Reads and writes may be called concurrently with each other.
+type TCPClientConn struct {
+	net.Conn
+	cipher *TCPCipher
+	target ip.SocksAddr
+
+	writeMu     sync.Mutex
+	w           chunkWriter
+	requestSalt []byte
+
+	r          chunkReader
+	readHeader bool
+}
+
+// NewClientConn returns a client stream to target over conn.
+func (c *TCPCipher) NewClientConn(conn net.Conn, target ip.SocksAddr) *TCPClientConn {
+	return &TCPClientConn{
+		Conn:   conn,
+		cipher: c,
+		target: target,
+	}
+}
+
+// Handshake sends the request header with padding and no payload, if no data has been written yet.
+// Use it when the server is expected to speak first.
+func (c *TCPClientConn) Handshake() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.requestSalt != nil {
+		return nil
+	}
+	_, err := c.writeRequest(nil)
+	return err
+}
+
+// Write implements [io.Writer.Write].
+func (c *TCPClientConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.requestSalt == nil {
+		return c.writeRequest(p)
+	}
+	return c.w.Write(p)
+}
+
+// writeRequest writes the salt, the request header with the initial payload, and the rest of p as chunks.
+// The caller must hold writeMu.
+func (c *TCPClientConn) writeRequest(p []byte) (int, error) {
+	b, w, err := c.cipher.newSalt(nil, c.Conn, c.cipher.psk)
+	if err != nil {
+		return 0, err
+	}
+	salt := b
+	if b, err = c.cipher.appendIdentityHeaders(b, salt); err != nil {
+		return 0, err
+	}
+
+	// Pad when there is no payload to hide the length of the header.
+	var paddingLen int
+	if len(p) == 0 {
+		paddingLen = 1 + mrand.IntN(MaxPaddingLength)
+	}
+	maxInitial := TCPMaxPayloadSize - c.target.EncodedLen() - 2 - paddingLen
+	initial := p[:min(len(p), maxInitial)]
+	varHeaderLen := c.target.EncodedLen() + 2 + paddingLen + len(initial)
+
+	var fixed [tcpRequestFixedHeaderLength]byte
+	fixed[0] = tcpHeaderTypeClient
+	binary.BigEndian.PutUint64(fixed[1:], uint64(c.cipher.clock.Now().Unix()))
+	binary.BigEndian.PutUint16(fixed[9:], uint16(varHeaderLen))
+	b = w.appendSealed(b, fixed[:])
+
+	start := len(b)
+	b = c.target.Append(b)
+	b = appendPadding(b, paddingLen)
+	b = append(b, initial...)
+	b = w.appendSealed(b[:start], b[start:])
+
+	b = w.appendChunks(b, p[len(initial):])
+
+	if _, err = c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	c.w = w
+	c.requestSalt = salt[:len(c.cipher.psk):len(c.cipher.psk)]
+	return len(p), nil
+}
+
+// Read implements [io.Reader.Read].
+// If no data has been written yet, the request header is sent first, as in Handshake.
+func (c *TCPClientConn) Read(p []byte) (int, error) {
+	if !c.readHeader {
+		if err := c.Handshake(); err != nil {
+			return 0, err
+		}
+		if err := c.readResponseHeader(); err != nil {
+			return 0, err
+		}
+		c.readHeader = true
+	}
+	return c.r.Read(p)
+}
+
+// readResponseHeader reads the response salt, fixed header, and initial payload.
+func (c *TCPClientConn) readResponseHeader() error {
+	_, r, err := c.cipher.readSalt(c.Conn, c.cipher.psk)
+	if err != nil {
+		return err
+	}
+
+	saltSize := len(c.cipher.psk)
+	fixed, err := r.readSealed(1 + 8 + saltSize + 2)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != tcpHeaderTypeServer {
+		return fmt.Errorf("%w: %d", ErrTypeMismatch, fixed[0])
+	}
+	if err = checkTimestamp(binary.BigEndian.Uint64(fixed[1:]), c.cipher.clock.Now()); err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	requestSalt := c.requestSalt
+	c.writeMu.Unlock()
+	if !bytes.Equal(fixed[9:9+saltSize], requestSalt) {
+		return ErrSaltMismatch
+	}
+	initialLen := int(binary.BigEndian.Uint16(fixed[9+saltSize:]))
+
+	if r.payload, err = r.readSealed(initialLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	c.r = r
+	return nil
+}
+
+// CloseWrite sends the request header if needed, then shuts down the writing side of the underlying connection,
+// if it supports half-close.
+func (c *TCPClientConn) CloseWrite() error {
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	return closeWrite(c.Conn)
+}
+
+// TCPServerConn is the server side of a shadowsocks 2022 stream over a [net.Conn].
+//
+// The request header is read by Handshake, or on the first read or write.
+// After Handshake returns, reads and writes may be called concurrently with each other.
+// Writes are serialized, so that concurrent first writes send the response header only once.
+type TCPServerConn struct {
+	net.Conn
+	cipher *TCPCipher
+	filter SaltFilter
+
+	handshakeOnce sync.Once
+	handshakeErr  error
+	requestSalt   []byte
+	target        ip.SocksAddr
+
+	// psk keys the response. It is the user's PSK on a multi-user server.
+	psk  []byte
+	user *User
+
+	r chunkReader
+
+	writeMu     sync.Mutex
+	w           chunkWriter
+	wroteHeader bool
+}
+
+// NewServerConn returns a server stream over conn.
+// If filter is not nil, requests that reuse a salt seen by the filter are rejected with [ErrReplay].
+func (c *TCPCipher) NewServerConn(conn net.Conn, filter SaltFilter) *TCPServerConn {
+	return &TCPServerConn{
+		Conn:   conn,
+		cipher: c,
+		filter: filter,
+	}
+}
+
+// Handshake reads and validates the request header, and returns the target address.
+// The initial payload in the header is returned by subsequent reads.
+func (c *TCPServerConn) Handshake() (ip.SocksAddr, error) {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.readRequestHeader()
+	})
+	return c.target, c.handshakeErr
+}
+
+// readRequestHeader reads the request salt, fixed header, and variable header.
+func (c *TCPServerConn) readRequestHeader() error {
+	salt, psk, user, r, err := c.cipher.readRequestSalt(c.Conn)
+	if err != nil {
+		return err
+	}
+
+	fixed, err := r.readSealed(tcpRequestFixedHeaderLength)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != tcpHeaderTypeClient {
+		return fmt.Errorf("%w: %d", ErrTypeMismatch, fixed[0])
+	}
+	now := c.cipher.clock.Now()
+	if err = checkTimestamp(binary.BigEndian.Uint64(fixed[1:]), now); err != nil {
+		return err
+	}
+	varHeaderLen := int(binary.BigEndian.Uint16(fixed[9:]))
+
+	// Only remember salts of authenticated requests, so that forged requests cannot fill the filter.
+	if c.filter != nil {
+		var key [32]byte
+		copy(key[:], salt)
+		if !c.filter.Check(key, now) {
+			return fmt.Errorf("%w: salt %x", ErrReplay, salt)
+		}
+	}
+
+	varHeader, err := r.readSealed(varHeaderLen)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	target, n, err := ip.ParseSocksAddr(varHeader)
+	if err != nil {
+		return err
+	}
+	varHeader = varHeader[n:]
+	if len(varHeader) < 2 {
+		return ErrPacketTooShort
+	}
+	paddingLen := int(binary.BigEndian.Uint16(varHeader))
+	if paddingLen > MaxPaddingLength {
+		return fmt.Errorf("padding length %d exceeds maximum %d", paddingLen, MaxPaddingLength)
+	}
+	varHeader = varHeader[2:]
+	if len(varHeader) < paddingLen {
+		return fmt.Errorf("truncated padding: %w", ErrPacketTooShort)
+	}
+	payload := varHeader[paddingLen:]
+	if paddingLen == 0 && len(payload) == 0 {
+		return ErrEmptyVariableHeader
+	}
+
+	r.payload = payload
+	c.r = r
+	c.requestSalt = salt
+	c.target = target
+	c.psk = psk
+	if user != nil {
+		c.user = &user.User
+	}
+	return nil
+}
+
+// User returns the user identified by the request on a multi-user server,
+// or nil on a single-user server. It is only valid after a successful handshake.
+func (c *TCPServerConn) User() *User {
+	return c.user
+}
+
+// Target returns the target address of the request. It is only valid after a successful handshake.
+func (c *TCPServerConn) Target() ip.SocksAddr {
+	return c.target
+}
+
+// Read implements [io.Reader.Read].
+func (c *TCPServerConn) Read(p []byte) (int, error) {
+	if _, err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Write implements [io.Writer.Write].
+// The response header is sent with the first write, together with as much of the payload as fits.
+func (c *TCPServerConn) Write(p []byte) (int, error) {
+	if _, err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.wroteHeader {
+		return c.w.Write(p)
+	}
+	return c.writeResponse(p)
+}
+
+// writeResponse writes the salt, the response header with the initial payload, and the rest of p as chunks.
+// The caller must hold writeMu.
+func (c *TCPServerConn) writeResponse(p []byte) (int, error) {
+	b, w, err := c.cipher.newSalt(nil, c.Conn, c.psk)
+	if err != nil {
+		return 0, err
+	}
+
+	initial := p[:min(len(p), TCPMaxPayloadSize)]
+
+	fixed := make([]byte, 0, 1+8+len(c.requestSalt)+2)
+	fixed = append(fixed, tcpHeaderTypeServer)
+	fixed = binary.BigEndian.AppendUint64(fixed, uint64(c.cipher.clock.Now().Unix()))
+	fixed = append(fixed, c.requestSalt...)
+	fixed = binary.BigEndian.AppendUint16(fixed, uint16(len(initial)))
+	b = w.appendSealed(b, fixed)
+	b = w.appendSealed(b, initial)
+	b = w.appendChunks(b, p[len(initial):])
+
+	if _, err = c.Conn.Write(b); err != nil {
+		return 0, err
+	}
+	c.w = w
+	c.wroteHeader = true
+	return len(p), nil
+}
+
+// CloseWrite sends the response header if needed, then shuts down the writing side of the underlying connection,
+// if it supports half-close.
+func (c *TCPServerConn) CloseWrite() error {
+	if _, err := c.Handshake(); err != nil {
+		return err
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if !c.wroteHeader {
+		if _, err := c.writeResponse(nil); err != nil {
+			return err
+		}
+	}
+	return closeWrite(c.Conn)
+}
+
+// closeWrite shuts down the writing side of conn, if it supports half-close.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+	"github.com/database64128/cubic-go-playground/ip"
+)
+
+// streamConn is a [net.Conn] that reads from r and writes to w.
+type streamConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *streamConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func newTestTCPCipher(t testing.TB, method string, keyLength int) *TCPCipher {
+	t.Helper()
+	c, err := NewTCPCipher(method, key[:keyLength])
+	if err != nil {
+		t.Fatalf("NewTCPCipher(%q) failed: %v", method, err)
+	}
+	if got := c.Method(); got != method {
+		t.Errorf("c.Method() = %q, want %q", got, method)
+	}
+	return c
+}
+
+var tcpTestTarget = ip.SocksAddrFromAddrPort(netip.MustParseAddrPort("[2001:db8::1]:443"))
+
+func TestTCPPipe(t *testing.T) {
+	for _, m := range udpCipherMethods {
+		t.Run(m.method, func(t *testing.T) {
+			c := newTestTCPCipher(t, m.method, m.keyLength)
+
+			for _, size := range [...]int{0, 1, TCPMaxPayloadSize, 3 * TCPMaxPayloadSize} {
+				request := make([]byte, size)
+				rand.Read(request)
+				response := make([]byte, size+1)
+				rand.Read(response)
+
+				pc, ps := net.Pipe()
+				client := c.NewClientConn(pc, tcpTestTarget)
+				server := c.NewServerConn(ps, NewSaltFilter())
+
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					defer ps.Close()
+
+					target, err := server.Handshake()
+					if err != nil {
+						t.Errorf("server.Handshake() failed: %v", err)
+						return
+					}
+					if target != tcpTestTarget {
+						t.Errorf("server.Handshake() = %v, want %v", target, tcpTestTarget)
+					}
+
+					got := make([]byte, size)
+					if _, err = io.ReadFull(server, got); err != nil {
+						t.Errorf("io.ReadFull(server) failed: %v", err)
+						return
+					}
+					if !bytes.Equal(got, request) {
+						t.Errorf("server read %d bytes different from the request", size)
+					}
+
+					if _, err = server.Write(response); err != nil {
+						t.Errorf("server.Write() failed: %v", err)
+					}
+				}()
+
+				if size == 0 {
+					if err := client.Handshake(); err != nil {
+						t.Fatalf("client.Handshake() failed: %v", err)
+					}
+				} else if n, err := client.Write(request); n != size || err != nil {
+					t.Fatalf("client.Write() = %d, %v, want %d, nil", n, err, size)
+				}
+
+				got, err := io.ReadAll(client)
+				if err != nil {
+					t.Fatalf("io.ReadAll(client) failed: %v", err)
+				}
+				if !bytes.Equal(got, response) {
+					t.Errorf("client read %d bytes different from the %d-byte response", len(got), len(response))
+				}
+
+				pc.Close()
+				<-done
+			}
+		})
+	}
+}
+
+func TestTCPLoopback(t *testing.T) {
+	c := newTestTCPCipher(t, Method2022Blake3Aes256Gcm, 32)
+
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenTCP() failed: %v", err)
+	}
+	defer ln.Close()
+
+	filter := NewSaltFilter()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			t.Errorf("ln.AcceptTCP() failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		// Echo until the client half-closes.
+		server := c.NewServerConn(conn, filter)
+		if _, err = io.Copy(server, server); err != nil {
+			t.Errorf("echo failed: %v", err)
+		}
+		if err = server.CloseWrite(); err != nil {
+			t.Errorf("server.CloseWrite() failed: %v", err)
+		}
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("net.DialTCP() failed: %v", err)
+	}
+	defer conn.Close()
+
+	client := c.NewClientConn(conn, tcpTestTarget)
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	go func() {
+		if _, err := client.Write(data); err != nil {
+			t.Errorf("client.Write() failed: %v", err)
+		}
+		if err := client.CloseWrite(); err != nil {
+			t.Errorf("client.CloseWrite() failed: %v", err)
+		}
+	}()
+
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("io.ReadAll(client) failed: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("echoed %d bytes different from the %d bytes sent", len(got), len(data))
+	}
+	<-done
+}
+
+func TestTCPServerConcurrentFirstWrites(t *testing.T) {
+	c := newTestTCPCipher(t, Method2022Blake3Aes256Gcm, 32)
+
+	var request, response bytes.Buffer
+	client := c.NewClientConn(&streamConn{r: &response, w: &request}, tcpTestTarget)
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("client.Write() failed: %v", err)
+	}
+
+	server := c.NewServerConn(&streamConn{r: &request, w: &response}, nil)
+	if _, err := server.Handshake(); err != nil {
+		t.Fatalf("server.Handshake() failed: %v", err)
+	}
+
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := range writers {
+		wg.Go(func() {
+			if _, err := server.Write([]byte{byte(i)}); err != nil {
+				t.Errorf("server.Write() failed: %v", err)
+			}
+		})
+	}
+	wg.Wait()
+
+	// The response header must have been sent once, followed by every write.
+	got, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("io.ReadAll(client) failed: %v", err)
+	}
+	slices.Sort(got)
+	if want := []byte{0, 1, 2, 3, 4, 5, 6, 7}; !bytes.Equal(got, want) {
+		t.Errorf("client read %v, want %v in any order", got, want)
+	}
+}
+
+// sealTestRequest returns the request stream of a client that writes payload.
+func sealTestRequest(t *testing.T, c *TCPCipher, payload []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	client := c.NewClientConn(&streamConn{w: &buf}, tcpTestTarget)
+	if _, err := client.Write(payload); err != nil {
+		t.Fatalf("client.Write() failed: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestTCPReject(t *testing.T) {
+	c := newTestTCPCipher(t, Method2022Blake3Aes256Gcm, 32)
+
+	handshake := func(request []byte, filter SaltFilter) error {
+		_, err := c.NewServerConn(&streamConn{r: bytes.NewReader(request)}, filter).Handshake()
+		return err
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		request := sealTestRequest(t, c, []byte("hello"))
+		filter := NewSaltFilter()
+		if err := handshake(request, filter); err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+		if err := handshake(request, filter); !errors.Is(err, ErrReplay) {
+			t.Errorf("replayed handshake error = %v, want %v", err, ErrReplay)
+		}
+		// Without a filter, replays are not detected.
+		if err := handshake(request, nil); err != nil {
+			t.Errorf("handshake without filter failed: %v", err)
+		}
+	})
+
+	t.Run("Timestamp", func(t *testing.T) {
+		skewed := *c
+		skewed.clock = cache.NewFakeClock(time.Now().Add(-MaxTimeDiff - time.Second))
+		if err := handshake(sealTestRequest(t, &skewed, []byte("hello")), nil); !errors.Is(err, ErrBadTimestamp) {
+			t.Errorf("handshake error = %v, want %v", err, ErrBadTimestamp)
+		}
+	})
+
+	t.Run("Tamper", func(t *testing.T) {
+		request := sealTestRequest(t, c, []byte("hello"))
+		for i := range request {
+			tampered := bytes.Clone(request)
+			tampered[i] ^= 1
+			if err := handshake(tampered, nil); err == nil {
+				t.Errorf("handshake succeeded with byte %d flipped, want error", i)
+			}
+		}
+		for i := range request {
+			if err := handshake(request[:i], nil); err == nil {
+				t.Errorf("handshake succeeded with request truncated to %d bytes, want error", i)
+			}
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		other, err := NewTCPCipher(Method2022Blake3Aes256Gcm, make([]byte, 32))
+		if err != nil {
+			t.Fatalf("NewTCPCipher() failed: %v", err)
+		}
+		if err = handshake(sealTestRequest(t, other, []byte("hello")), nil); err == nil {
+			t.Error("handshake succeeded with the wrong key, want error")
+		}
+	})
+
+	t.Run("SaltMismatch", func(t *testing.T) {
+		// The response to one request must not be accepted by another client.
+		var response bytes.Buffer
+		server := c.NewServerConn(&streamConn{
+			r: bytes.NewReader(sealTestRequest(t, c, []byte("hello"))),
+			w: &response,
+		}, nil)
+		if _, err := server.Write([]byte("world")); err != nil {
+			t.Fatalf("server.Write() failed: %v", err)
+		}
+
+		client := c.NewClientConn(&streamConn{r: &response, w: io.Discard}, tcpTestTarget)
+		if _, err := client.Read(make([]byte, 16)); !errors.Is(err, ErrSaltMismatch) {
+			t.Errorf("client.Read() error = %v, want %v", err, ErrSaltMismatch)
+		}
+	})
+
+	t.Run("TypeMismatch", func(t *testing.T) {
+		// A request stream is not a valid response.
+		client := c.NewClientConn(&streamConn{r: bytes.NewReader(sealTestRequest(t, c, []byte("hello"))), w: io.Discard}, tcpTestTarget)
+		if _, err := client.Read(make([]byte, 16)); err == nil {
+			t.Error("client.Read() succeeded on a request stream, want error")
+		}
+	})
+}
+
+func TestNewTCPCipherErrors(t *testing.T) {
+	if _, err := NewTCPCipher(MethodAes256Gcm, key); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("NewTCPCipher(aes-256-gcm) error = %v, want %v", err, ErrUnknownMethod)
+	}
+	var lengthErr *PSKLengthError
+	if _, err := NewTCPCipher(Method2022Blake3Aes128Gcm, key); !errors.As(err, &lengthErr) {
+		t.Errorf("NewTCPCipher(aes-128, 32-byte key) error = %v, want %T", err, lengthErr)
+	}
+}
+
+func BenchmarkTCPClientWrite(b *testing.B) {
+	for _, m := range udpCipherMethods {
+		b.Run(m.method, func(b *testing.B) {
+			b.SetBytes(TCPMaxPayloadSize)
+
+			c := newTestTCPCipher(b, m.method, m.keyLength)
+			client := c.NewClientConn(&streamConn{w: io.Discard}, tcpTestTarget)
+			payload := make([]byte, TCPMaxPayloadSize)
+			rand.Read(payload)
+
+			for b.Loop() {
+				if _, err := client.Write(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
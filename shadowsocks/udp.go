@@ -0,0 +1,559 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand/v2"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+	"github.com/database64128/cubic-go-playground/ip"
+	"lukechampine.com/blake3"
+)
+
+const (
+	// UDPHeaderTypeClient is the header type of messages sent by a client.
+	UDPHeaderTypeClient = 0
+
+	// UDPHeaderTypeServer is the header type of messages sent by a server.
+	UDPHeaderTypeServer = 1
+
+	// MaxPaddingLength is the maximum length of the padding in a UDP message.
+	MaxPaddingLength = 900
+
+	// DefaultUDPIdleTimeout is the default idle timeout of UDP sessions.
+	DefaultUDPIdleTimeout = 5 * time.Minute
+
+	// separateHeaderLength is the length of the session ID and packet ID in a separate header.
+	separateHeaderLength = 8 + 8
+
+	// clientMessageHeaderLength is the length of the fixed part of a client message header:
+	// type + timestamp + padding length.
+	clientMessageHeaderLength = 1 + 8 + 2
+
+	// serverMessageHeaderLength is the length of the fixed part of a server message header:
+	// type + timestamp + client session ID + padding length.
+	serverMessageHeaderLength = 1 + 8 + 8 + 2
+)
+
+// UDPCipher protects shadowsocks 2022 UDP packets with the crypto of a specific method.
+//
+// A sealed packet consists of a header of HeaderLength bytes, followed by the message,
+// followed by Overhead - HeaderLength bytes of authentication tag.
+// The session ID and packet ID are carried in the packet, authenticated or encrypted as the method defines.
+//
+// Implementations must be safe for concurrent use.
+type UDPCipher interface {
+	// Method returns the method name.
+	Method() string
+
+	// HeaderLength returns the number of bytes before the message in a sealed packet.
+	HeaderLength() int
+
+	// Overhead returns the number of bytes a sealed packet adds to the message.
+	Overhead() int
+
+	// SealPacket seals the packet in place.
+	// b[:HeaderLength()] is reserved for the header and is overwritten, and b[HeaderLength():] holds the message.
+	// The returned packet is b extended by Overhead() - HeaderLength() bytes,
+	// in place if b has enough spare capacity.
+	SealPacket(b []byte, sessionID, packetID uint64) ([]byte, error)
+
+	// OpenPacket authenticates and decrypts the packet in place,
+	// and returns its session ID, packet ID, and message, which is a subslice of b.
+	OpenPacket(b []byte) (sessionID, packetID uint64, message []byte, err error)
+}
+
+// NewUDPCipher returns a [UDPCipher] for the given shadowsocks 2022 method and pre-shared key.
+func NewUDPCipher(method string, psk []byte) (UDPCipher, error) {
+	switch method {
+	case Method2022Blake3Aes128Gcm, Method2022Blake3Aes256Gcm:
+		return newAESUDPCipher(method, psk, defaultSubkeyCacheCapacity)
+	case Method2022Blake3Chacha20Poly1305:
+		return newXChaChaUDPCipher(psk)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownMethod, method)
+	}
+}
+
+const (
+	// defaultSubkeyCacheCapacity is the maximum number of session subkeys cached by a UDP cipher
+	// from [NewUDPCipher] or [NewUDPClientCipherWithIdentity]. Ciphers of multi-user servers
+	// are sized by [NewUserTable] instead.
+	defaultSubkeyCacheCapacity = 4096
+
+	// subkeyCacheIdleTimeout is how long an unused session subkey stays cached.
+	subkeyCacheIdleTimeout = time.Minute
+)
+
+// aesUDPCipher implements the separate header construction of 2022-blake3-aes-*-gcm.
+//
+// The session ID and packet ID form a 16-byte separate header, encrypted as one AES block with the PSK.
+// The message is sealed by AES-GCM with a per-session subkey derived by BLAKE3 from the PSK and the session ID,
+// with the last 12 bytes of the plaintext separate header as the nonce.
+type aesUDPCipher struct {
+	method  string
+	psk     []byte
+	block   cipher.Block
+	subkeys *cache.ExpirationCache[uint64, cipher.AEAD]
+}
+
+// newAESUDPCipher returns a new aesUDPCipher that caches the subkeys of up to subkeyCacheCapacity sessions.
+// If subkeyCacheCapacity is not positive, the cache is bounded only by the idle timeout.
+func newAESUDPCipher(method string, psk []byte, subkeyCacheCapacity int) (*aesUDPCipher, error) {
+	keyLength := 32
+	if method == Method2022Blake3Aes128Gcm {
+		keyLength = 16
+	}
+	if len(psk) != keyLength {
+		return nil, &PSKLengthError{Method: method, Length: len(psk)}
+	}
+
+	block, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+
+	return &aesUDPCipher{
+		method: method,
+		psk:    slices.Clone(psk),
+		block:  block,
+		subkeys: cache.ExpirationCacheConfig[uint64, cipher.AEAD]{
+			Capacity:    subkeyCacheCapacity,
+			IdleTimeout: subkeyCacheIdleTimeout,
+		}.NewCache(),
+	}, nil
+}
+
+// Method implements [UDPCipher.Method].
+func (c *aesUDPCipher) Method() string {
+	return c.method
+}
+
+// HeaderLength implements [UDPCipher.HeaderLength].
+func (c *aesUDPCipher) HeaderLength() int {
+	return separateHeaderLength
+}
+
+// Overhead implements [UDPCipher.Overhead].
+func (c *aesUDPCipher) Overhead() int {
+	return separateHeaderLength + 16
+}
+
+// SealPacket implements [UDPCipher.SealPacket].
+func (c *aesUDPCipher) SealPacket(b []byte, sessionID, packetID uint64) ([]byte, error) {
+	if len(b) < separateHeaderLength {
+		return nil, ErrPacketTooShort
+	}
+
+	aead, err := c.sessionAEAD(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := b[:separateHeaderLength]
+	binary.BigEndian.PutUint64(header, sessionID)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+
+	message := b[separateHeaderLength:]
+	b = aead.Seal(b[:separateHeaderLength], header[4:], message, nil)
+
+	c.block.Encrypt(b[:separateHeaderLength], b[:separateHeaderLength])
+	return b, nil
+}
+
+// OpenPacket implements [UDPCipher.OpenPacket].
+func (c *aesUDPCipher) OpenPacket(b []byte) (sessionID, packetID uint64, message []byte, err error) {
+	if len(b) < separateHeaderLength+16 {
+		return 0, 0, nil, ErrPacketTooShort
+	}
+
+	var header [separateHeaderLength]byte
+	c.block.Decrypt(header[:], b[:separateHeaderLength])
+	sessionID = binary.BigEndian.Uint64(header[:])
+	packetID = binary.BigEndian.Uint64(header[8:])
+
+	message, err = c.openSession(sessionID, b[separateHeaderLength:separateHeaderLength], header[4:], b[separateHeaderLength:])
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return sessionID, packetID, message, nil
+}
+
+// sessionAEAD returns the AEAD for sealing packets of the session, derived from the PSK and the session ID,
+// reusing a cached one if the session was seen recently. Opening packets goes through openSession instead.
+func (c *aesUDPCipher) sessionAEAD(sessionID uint64) (cipher.AEAD, error) {
+	return c.subkeys.GetOrLoadNow(sessionID, func(sessionID uint64) (cipher.AEAD, time.Time, error) {
+		aead, err := newBlake3AESGCM(c.psk, sessionID)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return aead, c.subkeys.Clock().Now().Add(subkeyCacheIdleTimeout), nil
+	})
+}
+
+// openSession authenticates and decrypts ciphertext with the AEAD of the session, and appends the plaintext to dst.
+//
+// A cached AEAD is reused, but an AEAD derived on a cache miss is only cached after it has authenticated the packet,
+// so that forged packets with random session IDs cannot fill the cache and evict the subkeys of real sessions.
+func (c *aesUDPCipher) openSession(sessionID uint64, dst, nonce, ciphertext []byte) ([]byte, error) {
+	if aead, ok := c.subkeys.GetNow(sessionID); ok {
+		return aead.Open(dst, nonce, ciphertext, nil)
+	}
+
+	aead, err := newBlake3AESGCM(c.psk, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	message, err := aead.Open(dst, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.subkeys.SetFromTailTTL(sessionID, aead, subkeyCacheIdleTimeout)
+	return message, nil
+}
+
+// newBlake3AESGCM returns an AES-GCM AEAD keyed by the session subkey
+// derived from psk and the big-endian session ID.
+func newBlake3AESGCM(psk []byte, sessionID uint64) (cipher.AEAD, error) {
+	var sid [8]byte
+	binary.BigEndian.PutUint64(sid[:], sessionID)
+	return newAESGCM(blake3SessionSubkey(psk, sid[:]))
+}
+
+// blake3SessionSubkey derives a session subkey as long as psk from psk and the salt or session ID.
+func blake3SessionSubkey(psk, salt []byte) []byte {
+	keyMaterial := make([]byte, 0, len(psk)+len(salt))
+	keyMaterial = append(keyMaterial, psk...)
+	keyMaterial = append(keyMaterial, salt...)
+
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", keyMaterial)
+	return subkey
+}
+
+// PaddingPolicy decides whether a UDP message to or from the given target address is padded.
+type PaddingPolicy func(target ip.SocksAddr) bool
+
+// NoPadding never pads messages.
+func NoPadding(ip.SocksAddr) bool {
+	return false
+}
+
+// PadAll pads all messages.
+func PadAll(ip.SocksAddr) bool {
+	return true
+}
+
+// PadPlainDNS pads messages to and from port 53, which are likely plaintext DNS with telling lengths.
+func PadPlainDNS(target ip.SocksAddr) bool {
+	return target.Port() == 53
+}
+
+// paddingLength returns a random padding length in [1, MaxPaddingLength] if the policy pads the target, or 0 otherwise.
+func paddingLength(policy PaddingPolicy, target ip.SocksAddr) int {
+	if !policy(target) {
+		return 0
+	}
+	return 1 + mrand.IntN(MaxPaddingLength)
+}
+
+// UDPConfig is the configuration of a shadowsocks 2022 UDP client or server.
+type UDPConfig struct {
+	// Cipher is the cipher that protects packets.
+	// It must not be nil, except on a multi-user server, which uses UserCipher instead.
+	Cipher UDPCipher
+
+	// UserCipher, if not nil, makes the server a multi-user server.
+	// It opens client packets, and replies are sealed with the PSK of each session's user.
+	// Clients ignore it.
+	UserCipher *UDPUserCipher
+
+	// PaddingPolicy decides which messages are padded.
+	// If nil, [PadPlainDNS] is used.
+	PaddingPolicy PaddingPolicy
+
+	// MaxSessions is the maximum number of remote sessions tracked for replay protection.
+	// If not positive, the number of sessions is unbounded.
+	MaxSessions int
+
+	// IdleTimeout is how long an idle remote session is tracked.
+	// If not positive, [DefaultUDPIdleTimeout] is used.
+	IdleTimeout time.Duration
+}
+
+func (cfg *UDPConfig) paddingPolicy() PaddingPolicy {
+	if cfg.PaddingPolicy == nil {
+		return PadPlainDNS
+	}
+	return cfg.PaddingPolicy
+}
+
+func (cfg *UDPConfig) idleTimeout() time.Duration {
+	if cfg.IdleTimeout <= 0 {
+		return DefaultUDPIdleTimeout
+	}
+	return cfg.IdleTimeout
+}
+
+// UDPClient is the client side of a shadowsocks 2022 UDP session.
+// It seals packets to the server under a random session ID,
+// and opens packets from the server, rejecting replays.
+//
+// UDPClient is safe for concurrent use.
+type UDPClient struct {
+	cipher         UDPCipher
+	paddingPolicy  PaddingPolicy
+	sessionID      uint64
+	packetID       atomic.Uint64
+	serverSessions *SessionTable[struct{}]
+}
+
+// NewClient returns a new UDP client session with a random session ID.
+func (cfg UDPConfig) NewClient() *UDPClient {
+	c := UDPClient{
+		cipher:         cfg.Cipher,
+		paddingPolicy:  cfg.paddingPolicy(),
+		sessionID:      randomSessionID(),
+		serverSessions: NewSessionTable[struct{}](cfg.MaxSessions, cfg.idleTimeout()),
+	}
+	return &c
+}
+
+// SessionID returns the client session ID.
+func (c *UDPClient) SessionID() uint64 {
+	return c.sessionID
+}
+
+// Seal seals a packet that carries payload to target, appends it to dst, and returns the extended buffer.
+// now is used as the message timestamp.
+func (c *UDPClient) Seal(dst []byte, target ip.SocksAddr, payload []byte, now time.Time) ([]byte, error) {
+	paddingLen := paddingLength(c.paddingPolicy, target)
+	messageLen := clientMessageHeaderLength + paddingLen + target.EncodedLen() + len(payload)
+
+	start := len(dst)
+	dst = slices.Grow(dst, c.cipher.Overhead()+messageLen)
+	b := dst[start : start+c.cipher.HeaderLength()]
+	b = append(b, UDPHeaderTypeClient)
+	b = binary.BigEndian.AppendUint64(b, uint64(now.Unix()))
+	b = appendPadding(b, paddingLen)
+	b = target.Append(b)
+	b = append(b, payload...)
+
+	b, err := c.cipher.SealPacket(b, c.sessionID, c.packetID.Add(1)-1)
+	if err != nil {
+		return dst[:start], err
+	}
+	return dst[:start+len(b)], nil
+}
+
+// Open opens a packet from the server in place,
+// and returns the address the payload came from, and the payload, which is a subslice of packet.
+func (c *UDPClient) Open(packet []byte, now time.Time) (source ip.SocksAddr, payload []byte, err error) {
+	serverSessionID, packetID, message, err := c.cipher.OpenPacket(packet)
+	if err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+
+	if len(message) < serverMessageHeaderLength {
+		return ip.SocksAddr{}, nil, ErrPacketTooShort
+	}
+	if message[0] != UDPHeaderTypeServer {
+		return ip.SocksAddr{}, nil, fmt.Errorf("%w: %d", ErrTypeMismatch, message[0])
+	}
+	if err = checkTimestamp(binary.BigEndian.Uint64(message[1:]), now); err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+	if clientSessionID := binary.BigEndian.Uint64(message[9:]); clientSessionID != c.sessionID {
+		return ip.SocksAddr{}, nil, fmt.Errorf("client session ID mismatch: got %016x, want %016x", clientSessionID, c.sessionID)
+	}
+
+	session, err := c.serverSessions.GetOrCreate(serverSessionID, now, func(uint64) (struct{}, error) {
+		return struct{}{}, nil
+	})
+	if err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+	if !session.AddPacketID(packetID) {
+		return ip.SocksAddr{}, nil, fmt.Errorf("%w: server session %016x packet %d", ErrReplay, serverSessionID, packetID)
+	}
+
+	return parseMessageBody(message[serverMessageHeaderLength-2:])
+}
+
+// UDPServer is the server side of shadowsocks 2022 UDP.
+// It opens packets from clients, tracking each client session for replay protection,
+// and seals packets back to clients under a random server session ID per client session.
+//
+// UDPServer is safe for concurrent use.
+type UDPServer struct {
+	cipher        UDPCipher
+	userCipher    *UDPUserCipher
+	paddingPolicy PaddingPolicy
+	sessions      *SessionTable[*UDPServerSession]
+}
+
+// UDPServerSession is the server's state for a client session.
+type UDPServerSession struct {
+	clientSessionID uint64
+	serverSessionID uint64
+	packetID        atomic.Uint64
+
+	// cipher seals packets to the client. On a multi-user server, it is keyed by the user's PSK.
+	cipher UDPCipher
+	user   *serverUser
+}
+
+// User returns the user of the session on a multi-user server, or nil on a single-user server.
+func (s *UDPServerSession) User() *User {
+	if s.user == nil {
+		return nil
+	}
+	return &s.user.User
+}
+
+// ClientSessionID returns the client session ID.
+func (s *UDPServerSession) ClientSessionID() uint64 {
+	return s.clientSessionID
+}
+
+// ServerSessionID returns the server session ID paired with the client session.
+func (s *UDPServerSession) ServerSessionID() uint64 {
+	return s.serverSessionID
+}
+
+// NewServer returns a new UDP server.
+func (cfg UDPConfig) NewServer() *UDPServer {
+	return &UDPServer{
+		cipher:        cfg.Cipher,
+		userCipher:    cfg.UserCipher,
+		paddingPolicy: cfg.paddingPolicy(),
+		sessions:      NewSessionTable[*UDPServerSession](cfg.MaxSessions, cfg.idleTimeout()),
+	}
+}
+
+// Sessions returns the table of client sessions.
+// Run its janitor to remove idle sessions in the background.
+func (s *UDPServer) Sessions() *SessionTable[*UDPServerSession] {
+	return s.sessions
+}
+
+// Open opens a packet from a client in place,
+// and returns the client session, the target address, and the payload, which is a subslice of packet.
+func (s *UDPServer) Open(packet []byte, now time.Time) (session *UDPServerSession, target ip.SocksAddr, payload []byte, err error) {
+	var (
+		clientSessionID, packetID uint64
+		message                   []byte
+		user                      *serverUser
+		replyCipher               = s.cipher
+	)
+	if s.userCipher != nil {
+		clientSessionID, packetID, message, user, err = s.userCipher.openUserPacket(packet)
+		if user != nil {
+			replyCipher = user.udp
+		}
+	} else {
+		clientSessionID, packetID, message, err = s.cipher.OpenPacket(packet)
+	}
+	if err != nil {
+		return nil, ip.SocksAddr{}, nil, err
+	}
+
+	if len(message) < clientMessageHeaderLength {
+		return nil, ip.SocksAddr{}, nil, ErrPacketTooShort
+	}
+	if message[0] != UDPHeaderTypeClient {
+		return nil, ip.SocksAddr{}, nil, fmt.Errorf("%w: %d", ErrTypeMismatch, message[0])
+	}
+	if err = checkTimestamp(binary.BigEndian.Uint64(message[1:]), now); err != nil {
+		return nil, ip.SocksAddr{}, nil, err
+	}
+
+	ss, err := s.sessions.GetOrCreate(clientSessionID, now, func(clientSessionID uint64) (*UDPServerSession, error) {
+		return &UDPServerSession{
+			clientSessionID: clientSessionID,
+			serverSessionID: randomSessionID(),
+			cipher:          replyCipher,
+			user:            user,
+		}, nil
+	})
+	if err != nil {
+		return nil, ip.SocksAddr{}, nil, err
+	}
+	if ss.Value.user != user {
+		return nil, ip.SocksAddr{}, nil, fmt.Errorf("%w: client session %016x", ErrUserMismatch, clientSessionID)
+	}
+	if !ss.AddPacketID(packetID) {
+		return nil, ip.SocksAddr{}, nil, fmt.Errorf("%w: client session %016x packet %d", ErrReplay, clientSessionID, packetID)
+	}
+
+	target, payload, err = parseMessageBody(message[clientMessageHeaderLength-2:])
+	if err != nil {
+		return nil, ip.SocksAddr{}, nil, err
+	}
+	return ss.Value, target, payload, nil
+}
+
+// Seal seals a packet that carries payload from source to the client of the session,
+// appends it to dst, and returns the extended buffer. now is used as the message timestamp.
+func (s *UDPServer) Seal(dst []byte, session *UDPServerSession, source ip.SocksAddr, payload []byte, now time.Time) ([]byte, error) {
+	paddingLen := paddingLength(s.paddingPolicy, source)
+	messageLen := serverMessageHeaderLength + paddingLen + source.EncodedLen() + len(payload)
+
+	start := len(dst)
+	dst = slices.Grow(dst, session.cipher.Overhead()+messageLen)
+	b := dst[start : start+session.cipher.HeaderLength()]
+	b = append(b, UDPHeaderTypeServer)
+	b = binary.BigEndian.AppendUint64(b, uint64(now.Unix()))
+	b = binary.BigEndian.AppendUint64(b, session.clientSessionID)
+	b = appendPadding(b, paddingLen)
+	b = source.Append(b)
+	b = append(b, payload...)
+
+	b, err := session.cipher.SealPacket(b, session.serverSessionID, session.packetID.Add(1)-1)
+	if err != nil {
+		return dst[:start], err
+	}
+	return dst[:start+len(b)], nil
+}
+
+// appendPadding appends the padding length and paddingLen zero bytes to b.
+func appendPadding(b []byte, paddingLen int) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(paddingLen))
+	return append(b, make([]byte, paddingLen)...)
+}
+
+// parseMessageBody parses the padding length, padding, and address at the beginning of b,
+// and returns the address and the rest of b as the payload.
+func parseMessageBody(b []byte) (ip.SocksAddr, []byte, error) {
+	if len(b) < 2 {
+		return ip.SocksAddr{}, nil, ErrPacketTooShort
+	}
+	paddingLen := int(binary.BigEndian.Uint16(b))
+	if paddingLen > MaxPaddingLength {
+		return ip.SocksAddr{}, nil, fmt.Errorf("padding length %d exceeds maximum %d", paddingLen, MaxPaddingLength)
+	}
+	b = b[2:]
+	if len(b) < paddingLen {
+		return ip.SocksAddr{}, nil, fmt.Errorf("truncated padding: %w", ErrPacketTooShort)
+	}
+	b = b[paddingLen:]
+
+	addr, n, err := ip.ParseSocksAddr(b)
+	if err != nil {
+		return ip.SocksAddr{}, nil, err
+	}
+	return addr, b[n:], nil
+}
+
+// randomSessionID returns a random session ID.
+func randomSessionID() uint64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint64(b[:])
+}
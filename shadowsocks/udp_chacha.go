@@ -0,0 +1,83 @@
+package shadowsocks
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// xchachaUDPHeaderLength is the length of the nonce, session ID, and packet ID before the message.
+const xchachaUDPHeaderLength = chacha20poly1305.NonceSizeX + separateHeaderLength
+
+// xchachaUDPCipher implements the UDP construction of 2022-blake3-chacha20-poly1305.
+//
+// There is no separate header. A packet is a random 24-byte nonce, followed by
+// the session ID, packet ID, and message sealed together by XChaCha20-Poly1305 with the PSK.
+// With random nonces, no per-session subkey is needed.
+type xchachaUDPCipher struct {
+	aead cipher.AEAD
+}
+
+func newXChaChaUDPCipher(psk []byte) (*xchachaUDPCipher, error) {
+	if len(psk) != chacha20poly1305.KeySize {
+		return nil, &PSKLengthError{Method: Method2022Blake3Chacha20Poly1305, Length: len(psk)}
+	}
+	aead, err := chacha20poly1305.NewX(psk)
+	if err != nil {
+		return nil, err
+	}
+	return &xchachaUDPCipher{aead: aead}, nil
+}
+
+// Method implements [UDPCipher.Method].
+func (c *xchachaUDPCipher) Method() string {
+	return Method2022Blake3Chacha20Poly1305
+}
+
+// HeaderLength implements [UDPCipher.HeaderLength].
+func (c *xchachaUDPCipher) HeaderLength() int {
+	return xchachaUDPHeaderLength
+}
+
+// Overhead implements [UDPCipher.Overhead].
+func (c *xchachaUDPCipher) Overhead() int {
+	return xchachaUDPHeaderLength + chacha20poly1305.Overhead
+}
+
+// SealPacket implements [UDPCipher.SealPacket].
+func (c *xchachaUDPCipher) SealPacket(b []byte, sessionID, packetID uint64) ([]byte, error) {
+	if len(b) < xchachaUDPHeaderLength {
+		return nil, ErrPacketTooShort
+	}
+	rand.Read(b[:chacha20poly1305.NonceSizeX])
+	return c.sealPacket(b, sessionID, packetID), nil
+}
+
+// sealPacket seals the packet in place with the nonce already in b[:chacha20poly1305.NonceSizeX].
+func (c *xchachaUDPCipher) sealPacket(b []byte, sessionID, packetID uint64) []byte {
+	nonce := b[:chacha20poly1305.NonceSizeX]
+	plaintext := b[chacha20poly1305.NonceSizeX:]
+	binary.BigEndian.PutUint64(plaintext, sessionID)
+	binary.BigEndian.PutUint64(plaintext[8:], packetID)
+	return c.aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+// OpenPacket implements [UDPCipher.OpenPacket].
+func (c *xchachaUDPCipher) OpenPacket(b []byte) (sessionID, packetID uint64, message []byte, err error) {
+	if len(b) < xchachaUDPHeaderLength+chacha20poly1305.Overhead {
+		return 0, 0, nil, ErrPacketTooShort
+	}
+
+	nonce := b[:chacha20poly1305.NonceSizeX]
+	ciphertext := b[chacha20poly1305.NonceSizeX:]
+	plaintext, err := c.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	sessionID = binary.BigEndian.Uint64(plaintext)
+	packetID = binary.BigEndian.Uint64(plaintext[8:])
+	return sessionID, packetID, plaintext[separateHeaderLength:], nil
+}
@@ -1,16 +1,20 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha1"
 	"encoding/binary"
-	"io"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"slices"
 	"testing"
+	"time"
 
+	"github.com/database64128/cubic-go-playground/ip"
 	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/hkdf"
 	"lukechampine.com/blake3"
 )
 
@@ -22,40 +26,424 @@ func init() {
 	rand.Read(key)
 }
 
-func BenchmarkShadowsocksAEADAes256GcmEncryption(b *testing.B) {
-	b.SetBytes(testPayloadLength)
+var udpCipherMethods = [...]struct {
+	method    string
+	keyLength int
+}{
+	{Method2022Blake3Aes128Gcm, 16},
+	{Method2022Blake3Aes256Gcm, 32},
+	{Method2022Blake3Chacha20Poly1305, 32},
+}
 
-	nonce := make([]byte, 12)
-	subkey := make([]byte, 32)
-	buf := make([]byte, 32+testPayloadLength+16)
+func newTestUDPCipher(t testing.TB, method string, keyLength int) UDPCipher {
+	t.Helper()
+	c, err := NewUDPCipher(method, key[:keyLength])
+	if err != nil {
+		t.Fatalf("NewUDPCipher(%q) failed: %v", method, err)
+	}
+	if got := c.Method(); got != method {
+		t.Errorf("c.Method() = %q, want %q", got, method)
+	}
+	return c
+}
 
-	// Random payload
-	payload := buf[32 : 32+testPayloadLength]
-	rand.Read(payload)
+func TestUDPClientServer(t *testing.T) {
+	for _, m := range udpCipherMethods {
+		t.Run(m.method, func(t *testing.T) {
+			for _, p := range [...]struct {
+				name   string
+				policy PaddingPolicy
+			}{
+				{"NoPadding", NoPadding},
+				{"PadAll", PadAll},
+				{"PadPlainDNS", nil},
+			} {
+				t.Run(p.name, func(t *testing.T) {
+					cfg := UDPConfig{
+						Cipher:        newTestUDPCipher(t, m.method, m.keyLength),
+						PaddingPolicy: p.policy,
+					}
+					testUDPClientServer(t, cfg.NewClient(), cfg.NewServer())
+				})
+			}
+		})
+	}
+}
 
-	for b.Loop() {
-		// Generate random salt
-		rand.Read(buf[:32])
+func testUDPClientServer(t *testing.T, client *UDPClient, server *UDPServer) {
+	now := time.Now()
+	domainTarget, _ := ip.SocksAddrFromDomainPort("example.com", 443)
 
-		// Derive subkey
-		r := hkdf.New(sha1.New, key, buf[:32], []byte("ss-subkey"))
+	for i, target := range [...]ip.SocksAddr{
+		ip.SocksAddrFromAddrPort(netip.MustParseAddrPort("1.1.1.1:53")),
+		ip.SocksAddrFromAddrPort(netip.MustParseAddrPort("[2606:4700:4700::1111]:853")),
+		domainTarget,
+	} {
+		payload := make([]byte, 64*i)
+		rand.Read(payload)
 
-		if _, err := io.ReadFull(r, subkey); err != nil {
-			b.Fatal(err)
+		prefix := []byte("prefix")
+		packet, err := client.Seal(prefix, target, payload, now)
+		if err != nil {
+			t.Fatalf("client.Seal() failed: %v", err)
+		}
+		if string(packet[:len(prefix)]) != "prefix" {
+			t.Errorf("client.Seal() clobbered dst: %q", packet[:len(prefix)])
 		}
+		packet = packet[len(prefix):]
 
-		// Seal AEAD
-		cb, err := aes.NewCipher(subkey)
+		session, gotTarget, gotPayload, err := server.Open(packet, now)
 		if err != nil {
-			b.Fatal(err)
+			t.Fatalf("server.Open() failed: %v", err)
+		}
+		if got := session.ClientSessionID(); got != client.SessionID() {
+			t.Errorf("session.ClientSessionID() = %016x, want %016x", got, client.SessionID())
+		}
+		if gotTarget != target {
+			t.Errorf("server.Open() target = %v, want %v", gotTarget, target)
+		}
+		if !bytes.Equal(gotPayload, payload) {
+			t.Errorf("server.Open() payload = %x, want %x", gotPayload, payload)
 		}
 
-		aead, err := cipher.NewGCM(cb)
+		reply, err := server.Seal(nil, session, target, payload, now)
 		if err != nil {
-			b.Fatal(err)
+			t.Fatalf("server.Seal() failed: %v", err)
+		}
+		source, gotPayload, err := client.Open(reply, now)
+		if err != nil {
+			t.Fatalf("client.Open() failed: %v", err)
+		}
+		if source != target {
+			t.Errorf("client.Open() source = %v, want %v", source, target)
+		}
+		if !bytes.Equal(gotPayload, payload) {
+			t.Errorf("client.Open() payload = %x, want %x", gotPayload, payload)
 		}
+	}
 
-		aead.Seal(payload[:0], nonce, payload, nil)
+	if got := server.Sessions().Len(); got != 1 {
+		t.Errorf("server.Sessions().Len() = %d, want 1", got)
+	}
+}
+
+func TestUDPReject(t *testing.T) {
+	c := newTestUDPCipher(t, Method2022Blake3Aes256Gcm, 32)
+	cfg := UDPConfig{Cipher: c}
+	client := cfg.NewClient()
+	server := cfg.NewServer()
+	target := ip.SocksAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:9"))
+	payload := []byte("payload")
+	now := time.Now()
+
+	seal := func(now time.Time) []byte {
+		t.Helper()
+		packet, err := client.Seal(nil, target, payload, now)
+		if err != nil {
+			t.Fatalf("client.Seal() failed: %v", err)
+		}
+		return packet
+	}
+
+	t.Run("Replay", func(t *testing.T) {
+		packet := seal(now)
+		replayed := slices.Clone(packet)
+		if _, _, _, err := server.Open(packet, now); err != nil {
+			t.Fatalf("server.Open() failed: %v", err)
+		}
+		if _, _, _, err := server.Open(replayed, now); !errors.Is(err, ErrReplay) {
+			t.Errorf("server.Open(replayed) error = %v, want %v", err, ErrReplay)
+		}
+	})
+
+	t.Run("Timestamp", func(t *testing.T) {
+		for _, skew := range [...]time.Duration{-MaxTimeDiff - time.Second, MaxTimeDiff + time.Second} {
+			if _, _, _, err := server.Open(seal(now.Add(skew)), now); !errors.Is(err, ErrBadTimestamp) {
+				t.Errorf("server.Open() with skew %v error = %v, want %v", skew, err, ErrBadTimestamp)
+			}
+		}
+		if _, _, _, err := server.Open(seal(now.Add(MaxTimeDiff)), now); err != nil {
+			t.Errorf("server.Open() with skew %v failed: %v", MaxTimeDiff, err)
+		}
+	})
+
+	t.Run("TypeMismatch", func(t *testing.T) {
+		if _, _, err := client.Open(seal(now), now); !errors.Is(err, ErrTypeMismatch) {
+			t.Errorf("client.Open(client packet) error = %v, want %v", err, ErrTypeMismatch)
+		}
+	})
+
+	t.Run("WrongClient", func(t *testing.T) {
+		session, _, _, err := server.Open(seal(now), now)
+		if err != nil {
+			t.Fatalf("server.Open() failed: %v", err)
+		}
+		reply, err := server.Seal(nil, session, target, payload, now)
+		if err != nil {
+			t.Fatalf("server.Seal() failed: %v", err)
+		}
+		if _, _, err = cfg.NewClient().Open(reply, now); err == nil {
+			t.Error("other client opened the reply, want error")
+		}
+	})
+
+	t.Run("WrongKey", func(t *testing.T) {
+		otherKey := make([]byte, 32)
+		rand.Read(otherKey)
+		other, err := NewUDPCipher(Method2022Blake3Aes256Gcm, otherKey)
+		if err != nil {
+			t.Fatalf("NewUDPCipher() failed: %v", err)
+		}
+		if _, _, _, err = (UDPConfig{Cipher: other}).NewServer().Open(seal(now), now); err == nil {
+			t.Error("server with other key opened the packet, want error")
+		}
+	})
+
+	t.Run("Forged", func(t *testing.T) {
+		// Forged packets decrypt to random session IDs, whose subkeys must not be cached.
+		subkeys := c.(*aesUDPCipher).subkeys
+		before := subkeys.Len()
+		for range 16 {
+			forged := make([]byte, 64)
+			rand.Read(forged)
+			if _, _, _, err := server.Open(forged, now); err == nil {
+				t.Error("server.Open() succeeded with a forged packet, want error")
+			}
+		}
+		if got := subkeys.Len(); got != before {
+			t.Errorf("subkeys.Len() = %d after forged packets, want %d", got, before)
+		}
+	})
+
+	t.Run("Tamper", func(t *testing.T) {
+		packet := seal(now)
+		for i := range packet {
+			tampered := slices.Clone(packet)
+			tampered[i] ^= 1
+			if _, _, _, err := server.Open(tampered, now); err == nil {
+				t.Errorf("server.Open() succeeded with byte %d flipped, want error", i)
+			}
+		}
+		for i := range packet {
+			if _, _, _, err := server.Open(slices.Clone(packet[:i]), now); err == nil {
+				t.Errorf("server.Open() succeeded with packet truncated to %d bytes, want error", i)
+			}
+		}
+	})
+}
+
+// udpTestVectors pin down the byte layout of each method.
+// The packets were built by [specUDPPacket] from the SIP022 description of each construction,
+// independently of the package's ciphers, and [TestUDPTestVectorsMatchSpec] keeps them in sync.
+// They have not been checked against another SIP022 implementation.
+// The PSK is 00 01 .. 1f, truncated to the method's key length.
+// The session ID is 0102030405060708, and the packet ID is 42.
+// The message is a client message with timestamp 1700000000, no padding,
+// target 127.0.0.1:53, and payload "hello".
+var udpTestVectors = [...]struct {
+	method string
+	nonce  string
+	packet string
+}{
+	{
+		method: Method2022Blake3Aes128Gcm,
+		packet: "390693e83195b05ac85ba159331516b5d5c0504ad6aff537b8ab00cecd8cfdf7ad7dee073abf2f989cff13cb8910d15a4cc2f75c5ac653",
+	},
+	{
+		method: Method2022Blake3Aes256Gcm,
+		packet: "b7dee5b35eb5fdd6b2fe2b7715e6ccce60868f853c8b848f873dd239fa491df164a56e4dd517008347904dab05e039ba00c68345aae273",
+	},
+	{
+		method: Method2022Blake3Chacha20Poly1305,
+		nonce:  "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7",
+		packet: "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b744ee0919b25ba3a4616f2d897130a3ea3baa9f2caa6399281d408be698a3fe37d1b2c24a2a2a13d4698eab3c3b92fc9e05e499e5af6e4e",
+	},
+}
+
+const udpTestVectorMessage = "00000000006553f1000000017f000001003568656c6c6f"
+
+func TestUDPCipherTestVectors(t *testing.T) {
+	psk := make([]byte, 32)
+	for i := range psk {
+		psk[i] = byte(i)
+	}
+	wantMessage, _ := hex.DecodeString(udpTestVectorMessage)
+
+	for _, v := range udpTestVectors {
+		t.Run(v.method, func(t *testing.T) {
+			c, err := NewUDPCipher(v.method, udpTestVectorPSK(v.method, psk))
+			if err != nil {
+				t.Fatalf("NewUDPCipher() failed: %v", err)
+			}
+			wantPacket, _ := hex.DecodeString(v.packet)
+
+			// Seal with the vector's nonce.
+			b := make([]byte, c.HeaderLength(), c.Overhead()+len(wantMessage))
+			b = append(b, wantMessage...)
+			var packet []byte
+			if v.nonce != "" {
+				hex.Decode(b, []byte(v.nonce))
+				packet = c.(*xchachaUDPCipher).sealPacket(b, 0x0102030405060708, 42)
+			} else {
+				if packet, err = c.SealPacket(b, 0x0102030405060708, 42); err != nil {
+					t.Fatalf("c.SealPacket() failed: %v", err)
+				}
+			}
+			if !bytes.Equal(packet, wantPacket) {
+				t.Errorf("sealed packet = %x, want %x", packet, wantPacket)
+			}
+
+			sessionID, packetID, message, err := c.OpenPacket(wantPacket)
+			if err != nil {
+				t.Fatalf("c.OpenPacket() failed: %v", err)
+			}
+			if sessionID != 0x0102030405060708 || packetID != 42 {
+				t.Errorf("c.OpenPacket() = %016x, %d, want 0102030405060708, 42", sessionID, packetID)
+			}
+			if !bytes.Equal(message, wantMessage) {
+				t.Errorf("c.OpenPacket() message = %x, want %x", message, wantMessage)
+			}
+
+			// The message parses with a server whose clock matches the timestamp.
+			wantPacket, _ = hex.DecodeString(v.packet)
+			_, target, payload, err := UDPConfig{Cipher: c}.NewServer().Open(wantPacket, time.Unix(1700000000, 0))
+			if err != nil {
+				t.Fatalf("server.Open() failed: %v", err)
+			}
+			if target.String() != "127.0.0.1:53" || string(payload) != "hello" {
+				t.Errorf("server.Open() = %v, %q, want 127.0.0.1:53, \"hello\"", target, payload)
+			}
+		})
+	}
+}
+
+// udpTestVectorPSK truncates psk to the key length of method.
+func udpTestVectorPSK(method string, psk []byte) []byte {
+	if method == Method2022Blake3Aes128Gcm {
+		return psk[:16]
+	}
+	return psk
+}
+
+// specUDPPacket builds a packet the way SIP022 describes it, directly from the primitives,
+// without going through any of the package's ciphers.
+func specUDPPacket(t *testing.T, method string, psk, nonce []byte, sessionID, packetID uint64, message []byte) []byte {
+	t.Helper()
+
+	var header [16]byte
+	binary.BigEndian.PutUint64(header[:], sessionID)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+
+	if method == Method2022Blake3Chacha20Poly1305 {
+		aead, err := chacha20poly1305.NewX(psk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return aead.Seal(slices.Clone(nonce), nonce, append(header[:], message...), nil)
+	}
+
+	subkey := make([]byte, len(psk))
+	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", append(slices.Clone(psk), header[:8]...))
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headerBlock, err := aes.NewCipher(psk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, 16)
+	headerBlock.Encrypt(packet, header[:])
+	return aead.Seal(packet, header[4:], message, nil)
+}
+
+func TestUDPTestVectorsMatchSpec(t *testing.T) {
+	psk := make([]byte, 32)
+	for i := range psk {
+		psk[i] = byte(i)
+	}
+	message, _ := hex.DecodeString(udpTestVectorMessage)
+
+	for _, v := range udpTestVectors {
+		t.Run(v.method, func(t *testing.T) {
+			nonce, _ := hex.DecodeString(v.nonce)
+			want, _ := hex.DecodeString(v.packet)
+			if got := specUDPPacket(t, v.method, udpTestVectorPSK(v.method, psk), nonce, 0x0102030405060708, 42, message); !bytes.Equal(got, want) {
+				t.Errorf("specUDPPacket() = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestNewUDPCipherErrors(t *testing.T) {
+	if _, err := NewUDPCipher("aes-256-cfb", key); !errors.Is(err, ErrUnknownMethod) {
+		t.Errorf("NewUDPCipher(aes-256-cfb) error = %v, want %v", err, ErrUnknownMethod)
+	}
+
+	var lengthErr *PSKLengthError
+	if _, err := NewUDPCipher(Method2022Blake3Aes128Gcm, key); !errors.As(err, &lengthErr) {
+		t.Errorf("NewUDPCipher(aes-128, 32-byte key) error = %v, want %T", err, lengthErr)
+	}
+	if _, err := NewUDPCipher(Method2022Blake3Chacha20Poly1305, key[:16]); !errors.As(err, &lengthErr) {
+		t.Errorf("NewUDPCipher(chacha20, 16-byte key) error = %v, want %T", err, lengthErr)
+	}
+}
+
+func FuzzUDPServerOpen(f *testing.F) {
+	c, err := NewUDPCipher(Method2022Blake3Aes256Gcm, key)
+	if err != nil {
+		f.Fatal(err)
+	}
+	cfg := UDPConfig{Cipher: c}
+	client := cfg.NewClient()
+	server := cfg.NewServer()
+	now := time.Now()
+
+	packet, err := client.Seal(nil, ip.SocksAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:53")), []byte("payload"), now)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(packet)
+	f.Add(make([]byte, separateHeaderLength+16))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		_, target, payload, err := server.Open(packet, now)
+		if err != nil {
+			return
+		}
+		if !target.IsValid() {
+			t.Error("server.Open() returned an invalid target without error")
+		}
+		if len(payload) > len(packet) {
+			t.Errorf("len(payload) = %d, want at most %d", len(payload), len(packet))
+		}
+	})
+}
+
+func BenchmarkShadowsocksAEADAes256GcmEncryption(b *testing.B) {
+	b.SetBytes(testPayloadLength)
+
+	c, err := NewLegacyCipher(MethodAes256Gcm, key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	target := ip.SocksAddrFromAddrPort(netip.AddrPortFrom(netip.IPv6Loopback(), 443))
+
+	// Random payload
+	payload := make([]byte, testPayloadLength)
+	rand.Read(payload)
+
+	buf := make([]byte, 0, c.PacketOverhead()+target.EncodedLen()+testPayloadLength)
+
+	for b.Loop() {
+		if _, err = c.SealPacket(buf, target, payload); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
 
@@ -98,75 +486,78 @@ func BenchmarkShadowsocksAEADAes256GcmWithBlake3Encryption(b *testing.B) {
 func BenchmarkDraftSeparateHeaderAes256GcmEncryption(b *testing.B) {
 	b.SetBytes(testPayloadLength)
 
-	var counter uint64
-
-	buf := make([]byte, 16+testPayloadLength+16)
-
-	// Random payload
-	payload := buf[16 : 16+testPayloadLength]
-	rand.Read(payload)
-
-	// Header block cipher
-	aesecb, err := aes.NewCipher(key)
+	c, err := NewUDPCipher(Method2022Blake3Aes256Gcm, key)
 	if err != nil {
 		b.Fatal(err)
 	}
+	client := UDPConfig{Cipher: c, PaddingPolicy: NoPadding}.NewClient()
+	target := ip.SocksAddrFromAddrPort(netip.AddrPortFrom(netip.IPv6Loopback(), 443))
 
-	// AEAD
-	keyMaterial := make([]byte, 32+8) // key + session id
-	sid := keyMaterial[32:]
-	copy(keyMaterial, key)
-	rand.Read(sid)
-
-	subkey := make([]byte, 32)
+	// Random payload
+	payload := make([]byte, testPayloadLength)
+	rand.Read(payload)
 
-	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", keyMaterial)
+	buf := make([]byte, 0, c.Overhead()+clientMessageHeaderLength+target.EncodedLen()+testPayloadLength)
+	now := time.Now()
 
-	cb, err := aes.NewCipher(subkey)
-	if err != nil {
-		b.Fatal(err)
+	for b.Loop() {
+		if _, err = client.Seal(buf, target, payload, now); err != nil {
+			b.Fatal(err)
+		}
 	}
+}
+
+func BenchmarkDraftSeparateHeaderAes256GcmDecryption(b *testing.B) {
+	b.SetBytes(testPayloadLength)
 
-	aead, err := cipher.NewGCM(cb)
+	c, err := NewUDPCipher(Method2022Blake3Aes256Gcm, key)
 	if err != nil {
 		b.Fatal(err)
 	}
+	cfg := UDPConfig{Cipher: c, PaddingPolicy: NoPadding}
+	client := cfg.NewClient()
+	server := cfg.NewServer()
+	target := ip.SocksAddrFromAddrPort(netip.AddrPortFrom(netip.IPv6Loopback(), 443))
 
-	for b.Loop() {
-		// Session id
-		copy(buf, sid)
-
-		// Counter
-		binary.BigEndian.PutUint64(buf[8:], counter)
-		counter++
+	// Random payload
+	payload := make([]byte, testPayloadLength)
+	rand.Read(payload)
 
-		// Header
-		aesecb.Encrypt(buf[:16], buf[:16])
+	now := time.Now()
+	var sealed, buf []byte
 
-		// Seal AEAD
-		aead.Seal(payload[:0], buf[4:16], payload, nil)
+	for b.Loop() {
+		// Each packet must have a new packet ID to pass the replay check.
+		if sealed, err = client.Seal(sealed[:0], target, payload, now); err != nil {
+			b.Fatal(err)
+		}
+		buf = append(buf[:0], sealed...)
+		if _, _, _, err = server.Open(buf, now); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
 
 func BenchmarkDraftXChaCha20Poly1305Encryption(b *testing.B) {
 	b.SetBytes(testPayloadLength)
 
-	buf := make([]byte, 24+testPayloadLength+16)
+	c, err := NewUDPCipher(Method2022Blake3Chacha20Poly1305, key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	client := UDPConfig{Cipher: c, PaddingPolicy: NoPadding}.NewClient()
+	target := ip.SocksAddrFromAddrPort(netip.AddrPortFrom(netip.IPv6Loopback(), 443))
 
 	// Random payload
-	payload := buf[24 : 24+testPayloadLength]
+	payload := make([]byte, testPayloadLength)
 	rand.Read(payload)
 
-	aead, err := chacha20poly1305.NewX(key)
-	if err != nil {
-		b.Fatal(err)
-	}
+	buf := make([]byte, 0, c.Overhead()+clientMessageHeaderLength+target.EncodedLen()+testPayloadLength)
+	now := time.Now()
 
 	for b.Loop() {
-		// Random nonce
-		rand.Read(buf[:24])
-
-		// Seal AEAD
-		aead.Seal(payload[:0], buf[:24], payload, nil)
+		if _, err = client.Seal(buf, target, payload, now); err != nil {
+			b.Fatal(err)
+		}
 	}
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/swgp"
+)
+
+// defaultNATTimeout is the default idle timeout of NAT table entries.
+// WireGuard rekeys every 2 minutes, and gives up on a session after 3 minutes without a handshake.
+const defaultNATTimeout = 3 * time.Minute
+
+// relayConfig is the JSON configuration of a relay.
+//
+//	{
+//		"role": "client",
+//		"listen": "[::1]:20220",
+//		"endpoint": "swgp.example.com:20220",
+//		"handler": "zero-overhead",
+//		"psk": "base64-encoded 32-byte PSK",
+//		"endpointPublicKey": "base64-encoded WireGuard public key",
+//		"padding": "blake3",
+//		"maxPacketLength": 1452,
+//		"natTimeout": "3m"
+//	}
+type relayConfig struct {
+	// Role is either "client" or "server".
+	//
+	// A client listens for WireGuard packets, obfuscates them, and forwards them to a swgp server.
+	// A server listens for obfuscated packets, deobfuscates them, and forwards them to a WireGuard peer.
+	Role string `json:"role"`
+
+	// Listen is the UDP address to listen on.
+	Listen string `json:"listen"`
+
+	// Endpoint is the UDP address to forward packets to.
+	Endpoint string `json:"endpoint"`
+
+	// Handler is the obfuscation handler, either "zero-overhead" or "paranoid".
+	Handler string `json:"handler"`
+
+	// PSK is the base64-encoded 32-byte pre-shared key.
+	PSK []byte `json:"psk"`
+
+	// EndpointPublicKey is the optional base64-encoded public key of the WireGuard peer that packets are forwarded to.
+	// If set, handshake messages to the peer must carry a valid mac1 for it, or they are dropped.
+	EndpointPublicKey []byte `json:"endpointPublicKey"`
+
+	// Padding is the padding source of the zero-overhead handler: "none", "random", or "blake3".
+	// The default is "none".
+	Padding string `json:"padding"`
+
+	// MaxPacketLength is the maximum length of an obfuscated packet.
+	// If not positive, [swgp.DefaultMaxPacketLength] is used.
+	// With the paranoid handler, it limits the WireGuard MTU, as documented on [swgp.ParanoidConfig].
+	MaxPacketLength int `json:"maxPacketLength"`
+
+	// NATTimeout is how long an idle client is kept in the NAT table, as a Go duration string.
+	// The default is 3 minutes.
+	NATTimeout duration `json:"natTimeout"`
+}
+
+// duration is a [time.Duration] that is a Go duration string in JSON.
+type duration time.Duration
+
+// MarshalText implements [encoding.TextMarshaler].
+func (d duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// UnmarshalText implements [encoding.TextUnmarshaler].
+func (d *duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig reads a relay config from the JSON file at path.
+func loadConfig(path string) (*relayConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg relayConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	return &cfg, nil
+}
+
+// newHandler returns the obfuscation handler of the config.
+func (cfg *relayConfig) newHandler() (swgp.Handler, error) {
+	switch cfg.Handler {
+	case "zero-overhead":
+		padding, err := parsePadding(cfg.Padding)
+		if err != nil {
+			return nil, err
+		}
+		return swgp.ZeroOverheadConfig{
+			PSK:             cfg.PSK,
+			Padding:         padding,
+			MaxPacketLength: cfg.MaxPacketLength,
+		}.NewHandler()
+	case "paranoid":
+		if cfg.Padding != "" {
+			return nil, errors.New("padding is not configurable for the paranoid handler")
+		}
+		return swgp.ParanoidConfig{
+			PSK:             cfg.PSK,
+			MaxPacketLength: cfg.MaxPacketLength,
+		}.NewHandler()
+	default:
+		return nil, fmt.Errorf("unknown handler %q", cfg.Handler)
+	}
+}
+
+// parsePadding parses the name of a zero-overhead padding source.
+func parsePadding(s string) (swgp.PaddingSource, error) {
+	switch s {
+	case "", "none":
+		return swgp.PaddingNone, nil
+	case "random":
+		return swgp.PaddingRandom, nil
+	case "blake3":
+		return swgp.PaddingBlake3, nil
+	default:
+		return 0, fmt.Errorf("unknown padding source %q", s)
+	}
+}
+
+// newRelay returns a new relay with the config.
+func (cfg *relayConfig) newRelay(logger *tslog.Logger) (*relay, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("missing endpoint")
+	}
+
+	h, err := cfg.newHandler()
+	if err != nil {
+		return nil, err
+	}
+
+	var mac1 *swgp.MAC1Verifier
+	if len(cfg.EndpointPublicKey) != 0 {
+		if mac1, err = swgp.NewMAC1Verifier(cfg.EndpointPublicKey); err != nil {
+			return nil, fmt.Errorf("bad endpoint public key: %w", err)
+		}
+	}
+
+	r := relay{
+		logger:     logger,
+		endpoint:   cfg.Endpoint,
+		natTimeout: time.Duration(cfg.NATTimeout),
+	}
+	if r.natTimeout <= 0 {
+		r.natTimeout = defaultNATTimeout
+	}
+
+	switch cfg.Role {
+	case "client":
+		r.handleInbound = func(dst, b []byte) ([]byte, error) {
+			// Drop junk before spending crypto on it.
+			if err := checkWireGuardMessage(mac1, b); err != nil {
+				return nil, err
+			}
+			return h.Encrypt(dst, b)
+		}
+		r.handleReply = h.Decrypt
+	case "server":
+		r.handleInbound = func(dst, b []byte) ([]byte, error) {
+			wgPacket, err := h.Decrypt(dst, b)
+			if err != nil {
+				return nil, err
+			}
+			// Drop junk before the endpoint spends crypto on it.
+			if err = checkWireGuardMessage(mac1, wgPacket); err != nil {
+				return nil, err
+			}
+			return wgPacket, nil
+		}
+		r.handleReply = h.Encrypt
+	default:
+		return nil, fmt.Errorf("unknown role %q, must be client or server", cfg.Role)
+	}
+
+	return &r, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+)
+
+var (
+	configPath string
+	logNoColor bool
+	logNoTime  bool
+	logKVPairs bool
+	logJSON    bool
+	logLevel   slog.Level
+)
+
+func init() {
+	flag.StringVar(&configPath, "config", "config.json", "Path to the JSON config file")
+	flag.BoolVar(&logNoColor, "logNoColor", false, "Disable colors in log output")
+	flag.BoolVar(&logNoTime, "logNoTime", false, "Disable timestamps in log output")
+	flag.BoolVar(&logKVPairs, "logKVPairs", false, "Use key=value pairs in log output")
+	flag.BoolVar(&logJSON, "logJSON", false, "Use JSON in log output")
+	flag.TextVar(&logLevel, "logLevel", slog.LevelInfo, "Log level, one of: DEBUG, INFO, WARN, ERROR")
+}
+
+func main() {
+	flag.Parse()
+
+	logCfg := tslog.Config{
+		Level:          logLevel,
+		NoColor:        logNoColor,
+		NoTime:         logNoTime,
+		UseTextHandler: logKVPairs,
+		UseJSONHandler: logJSON,
+	}
+	logger := logCfg.NewLogger(os.Stderr)
+
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		logger.Error("Failed to load config", slog.String("path", configPath), tslog.Err(err))
+		os.Exit(1)
+	}
+
+	r, err := cfg.newRelay(logger)
+	if err != nil {
+		logger.Error("Failed to create relay", tslog.Err(err))
+		os.Exit(1)
+	}
+
+	pc, err := net.ListenPacket("udp", cfg.Listen)
+	if err != nil {
+		logger.Error("Failed to listen on UDP", slog.String("address", cfg.Listen), tslog.Err(err))
+		os.Exit(1)
+	}
+
+	logger.Info("Started relay",
+		slog.String("role", cfg.Role),
+		slog.String("handler", cfg.Handler),
+		slog.String("address", cfg.Listen),
+		slog.String("endpoint", cfg.Endpoint),
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err = r.serve(ctx, pc.(*net.UDPConn)); err != nil {
+		logger.Error("Failed to serve UDP", tslog.Err(err))
+		os.Exit(1)
+	}
+
+	logger.Info("Stopped relay")
+}
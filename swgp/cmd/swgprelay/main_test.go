@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/internal/udprelay"
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/swgp"
+	"golang.org/x/crypto/blake2s"
+)
+
+func newTestLogger(t *testing.T) *tslog.Logger {
+	return tslog.Config{
+		Level:   slog.LevelDebug,
+		NoColor: true,
+	}.NewLogger(t.Output())
+}
+
+func newTestPSK() []byte {
+	psk := make([]byte, swgp.PSKLength)
+	rand.Read(psk)
+	return psk
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP() failed: %v", err)
+	}
+	return conn
+}
+
+// startWireGuardEcho starts a UDP echo server that stands in for a WireGuard peer.
+// It returns its address, and a channel that receives a copy of each packet it echoes.
+func startWireGuardEcho(t *testing.T) (string, <-chan []byte) {
+	conn := listenLoopback(t)
+	received := make(chan []byte, 64)
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		conn.Close()
+		wg.Wait()
+	})
+
+	wg.Go(func() {
+		buf := make([]byte, udprelay.BufferSize)
+		for {
+			n, addr, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			select {
+			case received <- bytes.Clone(buf[:n]):
+			default:
+			}
+			conn.WriteToUDPAddrPort(buf[:n], addr)
+		}
+	})
+
+	return conn.LocalAddr().String(), received
+}
+
+// startRelay starts a relay with cfg on the loopback address, and returns its address.
+func startRelay(t *testing.T, cfg relayConfig) string {
+	t.Helper()
+
+	r, err := cfg.newRelay(newTestLogger(t).WithAttrs(slog.String("role", cfg.Role)))
+	if err != nil {
+		t.Fatalf("newRelay() failed: %v", err)
+	}
+
+	conn := listenLoopback(t)
+	ctx, cancel := context.WithCancel(t.Context())
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	wg.Go(func() {
+		if err := r.serve(ctx, conn); err != nil {
+			t.Errorf("serve() failed: %v", err)
+		}
+	})
+
+	return conn.LocalAddr().String()
+}
+
+// newWireGuardMessage returns a synthetic WireGuard message with random content.
+func newWireGuardMessage(messageType byte, length int) []byte {
+	b := make([]byte, length)
+	rand.Read(b)
+	b[0] = messageType
+	clear(b[1:4])
+	return b
+}
+
+// waitForPacket waits for want on received, skipping other packets, such as duplicates from retries.
+func waitForPacket(t *testing.T, received <-chan []byte, want []byte) {
+	t.Helper()
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case b := <-received:
+			if bytes.Equal(b, want) {
+				return
+			}
+		case <-timer.C:
+			t.Fatalf("the endpoint did not receive the %d-byte packet", len(want))
+		}
+	}
+}
+
+func TestRelay(t *testing.T) {
+	for _, c := range [...]struct {
+		name    string
+		handler string
+		padding string
+	}{
+		{"ZeroOverhead", "zero-overhead", ""},
+		{"ZeroOverheadRandomPadding", "zero-overhead", "random"},
+		{"ZeroOverheadBlake3Padding", "zero-overhead", "blake3"},
+		{"Paranoid", "paranoid", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			endpoint, received := startWireGuardEcho(t)
+			psk := newTestPSK()
+
+			serverAddress := startRelay(t, relayConfig{
+				Role:     "server",
+				Endpoint: endpoint,
+				Handler:  c.handler,
+				PSK:      psk,
+				Padding:  c.padding,
+			})
+			clientAddress := startRelay(t, relayConfig{
+				Role:     "client",
+				Endpoint: serverAddress,
+				Handler:  c.handler,
+				PSK:      psk,
+				Padding:  c.padding,
+			})
+
+			conn, err := net.Dial("udp", clientAddress)
+			if err != nil {
+				t.Fatalf("net.Dial() failed: %v", err)
+			}
+			defer conn.Close()
+
+			buf := make([]byte, udprelay.BufferSize)
+			for _, msg := range [...][]byte{
+				newWireGuardMessage(swgp.WireGuardMessageTypeHandshakeInitiation, swgp.WireGuardMessageLengthHandshakeInitiation),
+				newWireGuardMessage(swgp.WireGuardMessageTypeHandshakeResponse, swgp.WireGuardMessageLengthHandshakeResponse),
+				newWireGuardMessage(swgp.WireGuardMessageTypeCookieReply, swgp.WireGuardMessageLengthCookieReply),
+				newWireGuardMessage(swgp.WireGuardMessageTypeTransportData, swgp.WireGuardMessageLengthTransportDataMin),
+				newWireGuardMessage(swgp.WireGuardMessageTypeTransportData, 1280+swgp.WireGuardMessageLengthTransportDataMin),
+			} {
+				// UDP may drop packets, even on loopback, so retry until the echo comes back.
+				var n int
+				for attempt := 0; ; attempt++ {
+					if attempt == 10 {
+						t.Fatalf("no echo for %d-byte message of type %d", len(msg), msg[0])
+					}
+					if _, err = conn.Write(msg); err != nil {
+						t.Fatalf("conn.Write() failed: %v", err)
+					}
+					conn.SetReadDeadline(time.Now().Add(time.Second))
+					if n, err = conn.Read(buf); err == nil {
+						break
+					}
+				}
+				if !bytes.Equal(buf[:n], msg) {
+					t.Errorf("echo = %x, want %x", buf[:n], msg)
+				}
+
+				// The endpoint must see the plain WireGuard message, not the obfuscated one.
+				waitForPacket(t, received, msg)
+			}
+		})
+	}
+}
+
+// newHandshakeInitiation returns a synthetic handshake initiation with a valid mac1 for the receiver's public key.
+func newHandshakeInitiation(t *testing.T, publicKey []byte) []byte {
+	b := newWireGuardMessage(swgp.WireGuardMessageTypeHandshakeInitiation, swgp.WireGuardMessageLengthHandshakeInitiation)
+	key := blake2s.Sum256(append([]byte("mac1----"), publicKey...))
+	h, err := blake2s.New128(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac1Start := len(b) - 32
+	h.Write(b[:mac1Start])
+	h.Sum(b[:mac1Start])
+	return b
+}
+
+func TestRelayDropsJunk(t *testing.T) {
+	endpoint, received := startWireGuardEcho(t)
+	endpointPublicKey := newTestPSK()
+	cfg := relayConfig{
+		Role:              "server",
+		Endpoint:          endpoint,
+		Handler:           "paranoid",
+		PSK:               newTestPSK(),
+		EndpointPublicKey: endpointPublicKey,
+	}
+	serverAddress := startRelay(t, cfg)
+
+	h, err := cfg.newHandler()
+	if err != nil {
+		t.Fatalf("newHandler() failed: %v", err)
+	}
+
+	conn, err := net.Dial("udp", serverAddress)
+	if err != nil {
+		t.Fatalf("net.Dial() failed: %v", err)
+	}
+	defer conn.Close()
+
+	junk := make([]byte, 256)
+	rand.Read(junk)
+	badMAC1, err := h.Encrypt(nil, newHandshakeInitiation(t, newTestPSK()))
+	if err != nil {
+		t.Fatalf("h.Encrypt() failed: %v", err)
+	}
+	msg := newHandshakeInitiation(t, endpointPublicKey)
+	packet, err := h.Encrypt(nil, msg)
+	if err != nil {
+		t.Fatalf("h.Encrypt() failed: %v", err)
+	}
+
+	// Only the last packet is forwarded, so it must be the first to reach the endpoint.
+	for _, b := range [...][]byte{junk, badMAC1, packet} {
+		if _, err = conn.Write(b); err != nil {
+			t.Fatalf("conn.Write() failed: %v", err)
+		}
+	}
+
+	select {
+	case b := <-received:
+		if !bytes.Equal(b, msg) {
+			t.Errorf("the endpoint received %x, want %x", b, msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the endpoint did not receive the message")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	data := []byte(`{
+	"role": "client",
+	"listen": "[::1]:20220",
+	"endpoint": "[::1]:20221",
+	"handler": "zero-overhead",
+	"psk": "AAECAwQFBgcICQoLDA0ODxAREhMUFRYXGBkaGxwdHh8=",
+	"padding": "blake3",
+	"maxPacketLength": 1280,
+	"natTimeout": "1m30s"
+}`)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig() failed: %v", err)
+	}
+
+	wantPSK := make([]byte, swgp.PSKLength)
+	for i := range wantPSK {
+		wantPSK[i] = byte(i)
+	}
+	if cfg.Role != "client" || cfg.Listen != "[::1]:20220" || cfg.Endpoint != "[::1]:20221" ||
+		cfg.Handler != "zero-overhead" || !bytes.Equal(cfg.PSK, wantPSK) || cfg.Padding != "blake3" ||
+		cfg.MaxPacketLength != 1280 || time.Duration(cfg.NATTimeout) != 90*time.Second {
+		t.Errorf("loadConfig() = %+v", cfg)
+	}
+
+	r, err := cfg.newRelay(newTestLogger(t))
+	if err != nil {
+		t.Fatalf("newRelay() failed: %v", err)
+	}
+	if r.natTimeout != 90*time.Second {
+		t.Errorf("r.natTimeout = %v, want %v", r.natTimeout, 90*time.Second)
+	}
+
+	if err = os.WriteFile(path, []byte(`{"natTimeout": "forever"}`), 0o600); err != nil {
+		t.Fatalf("os.WriteFile() failed: %v", err)
+	}
+	if _, err = loadConfig(path); err == nil {
+		t.Error("loadConfig() succeeded with a bad NAT timeout")
+	}
+}
+
+func TestRelayConfigErrors(t *testing.T) {
+	logger := newTestLogger(t)
+	psk := newTestPSK()
+
+	for _, c := range [...]struct {
+		name string
+		cfg  relayConfig
+	}{
+		{"MissingEndpoint", relayConfig{Role: "client", Handler: "paranoid", PSK: psk}},
+		{"UnknownRole", relayConfig{Role: "proxy", Endpoint: "127.0.0.1:1", Handler: "paranoid", PSK: psk}},
+		{"UnknownHandler", relayConfig{Role: "client", Endpoint: "127.0.0.1:1", Handler: "aes", PSK: psk}},
+		{"UnknownPadding", relayConfig{Role: "client", Endpoint: "127.0.0.1:1", Handler: "zero-overhead", PSK: psk, Padding: "zeros"}},
+		{"ParanoidPadding", relayConfig{Role: "client", Endpoint: "127.0.0.1:1", Handler: "paranoid", PSK: psk, Padding: "random"}},
+		{"MissingPSK", relayConfig{Role: "client", Endpoint: "127.0.0.1:1", Handler: "paranoid"}},
+		{"ShortPSK", relayConfig{Role: "client", Endpoint: "127.0.0.1:1", Handler: "zero-overhead", PSK: psk[:16]}},
+		{"ShortEndpointPublicKey", relayConfig{Role: "server", Endpoint: "127.0.0.1:1", Handler: "paranoid", PSK: psk, EndpointPublicKey: psk[:16]}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := c.cfg.newRelay(logger); err == nil {
+				t.Error("newRelay() succeeded")
+			}
+		})
+	}
+}
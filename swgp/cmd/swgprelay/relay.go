@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/database64128/cubic-go-playground/cache"
+	"github.com/database64128/cubic-go-playground/internal/udprelay"
+	"github.com/database64128/cubic-go-playground/ip"
+	"github.com/database64128/cubic-go-playground/logging/tslog"
+	"github.com/database64128/cubic-go-playground/swgp"
+)
+
+// relay forwards UDP packets between clients and an endpoint, transforming them in both directions.
+type relay struct {
+	logger     *tslog.Logger
+	endpoint   string
+	natTimeout time.Duration
+
+	// handleInbound transforms a packet from a client before it is forwarded to the endpoint.
+	handleInbound func(dst, b []byte) ([]byte, error)
+
+	// handleReply transforms a packet from the endpoint before it is sent back to the client.
+	handleReply func(dst, b []byte) ([]byte, error)
+}
+
+// natEntry is the endpoint socket of a client.
+type natEntry struct {
+	endpointConn *net.UDPConn
+}
+
+// serve reads packets from conn and relays them with [udprelay.ReadLoop], until ctx is canceled.
+// It closes conn before returning.
+//
+// Each client address gets its own socket connected to the endpoint,
+// tracked in a NAT table and closed after the NAT timeout.
+// Packets that fail to transform are dropped before they touch the NAT table.
+func (r *relay) serve(ctx context.Context, conn *net.UDPConn) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	nat := cache.ExpirationCacheConfig[netip.AddrPort, *natEntry]{
+		IdleTimeout: r.natTimeout,
+		OnEvict: func(entry cache.Entry[netip.AddrPort, *natEntry], reason cache.EvictionReason) {
+			r.logger.Debug("Closing NAT entry",
+				tslog.AddrPort("clientAddress", entry.Key),
+				slog.String("reason", reason.String()),
+			)
+			entry.Value.endpointConn.Close()
+		},
+	}.NewCache()
+	defer nat.Clear()
+
+	janitorCtx, cancelJanitor := context.WithCancel(ctx)
+	defer cancelJanitor()
+	wg.Go(func() {
+		nat.RunJanitor(janitorCtx, nil)
+	})
+
+	return udprelay.ReadLoop(ctx, r.logger, conn, func(b []byte, clientAddr netip.AddrPort) {
+		packet, err := r.handleInbound(b[:0], b)
+		if err != nil {
+			r.logger.Debug("Dropped packet from client",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.Int("length", len(b)),
+				tslog.Err(err),
+			)
+			return
+		}
+
+		// The listener may report the same client as IPv4 or IPv4-mapped IPv6, depending on the socket.
+		key := ip.AddrPortv4Mappedv6(clientAddr)
+
+		entry, err := nat.GetOrLoadNow(key, func(key netip.AddrPort) (*natEntry, time.Time, error) {
+			endpointConn, err := udprelay.Dial(ctx, r.endpoint)
+			if err != nil {
+				return nil, time.Time{}, err
+			}
+			entry := &natEntry{
+				endpointConn: endpointConn,
+			}
+			r.logger.Debug("Added NAT entry",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.AddrPort("endpointLocalAddress", endpointConn.LocalAddr().(*net.UDPAddr).AddrPort()),
+			)
+			wg.Go(func() {
+				r.relayReplies(ctx, conn, entry, clientAddr)
+			})
+			return entry, nat.Clock().Now().Add(r.natTimeout), nil
+		})
+		if err != nil {
+			r.logger.Warn("Failed to add NAT entry", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+			return
+		}
+
+		if _, err = entry.endpointConn.Write(packet); err != nil {
+			r.logger.Warn("Failed to send packet to endpoint", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+		}
+	})
+}
+
+// relayReplies transforms packets from the endpoint and sends them to the client,
+// until the endpoint socket is closed or ctx is canceled.
+//
+// Read errors are retried with [udprelay.Backoff]. The loop never gives up on them,
+// as the socket is closed when the NAT entry is evicted.
+func (r *relay) relayReplies(ctx context.Context, conn *net.UDPConn, entry *natEntry, clientAddr netip.AddrPort) {
+	var (
+		buf     = make([]byte, udprelay.BufferSize)
+		backoff udprelay.Backoff
+	)
+	for {
+		n, err := entry.endpointConn.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			r.logger.Debug("Failed to read packet from endpoint",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.Int("consecutiveErrors", backoff.Fail()),
+				tslog.Err(err),
+			)
+			if !backoff.Wait(ctx) {
+				return
+			}
+			continue
+		}
+		backoff.Reset()
+
+		packet, err := r.handleReply(buf[:0], buf[:n])
+		if err != nil {
+			r.logger.Debug("Dropped packet from endpoint",
+				tslog.AddrPort("clientAddress", clientAddr),
+				tslog.Int("length", n),
+				tslog.Err(err),
+			)
+			continue
+		}
+
+		if _, err = conn.WriteToUDPAddrPort(packet, clientAddr); err != nil {
+			r.logger.Debug("Failed to send packet to client", tslog.AddrPort("clientAddress", clientAddr), tslog.Err(err))
+		}
+	}
+}
+
+// checkWireGuardMessage returns an error if b is not a valid WireGuard message.
+// If mac1 is not nil, handshake initiation and response messages must also carry a valid mac1.
+func checkWireGuardMessage(mac1 *swgp.MAC1Verifier, b []byte) error {
+	m, err := swgp.ParseWireGuardMessage(b)
+	if err != nil {
+		return err
+	}
+	if mac1 != nil && m.HasMAC1() {
+		return mac1.Verify(b)
+	}
+	return nil
+}
@@ -1,429 +1,178 @@
 package swgp
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
-	mrand "math/rand/v2"
 	"testing"
-
-	"golang.org/x/crypto/chacha20poly1305"
-	"lukechampine.com/blake3"
 )
 
 const (
 	wireguardHandshakeInitiationMessageLength = 148
-	maxPaddingLength                          = 1024
 	maxPacketLength                           = 1452
 )
 
-var (
-	key       = make([]byte, 32)
-	aesecb    cipher.Block
-	xc20p1305 cipher.AEAD
-	blake3xof *blake3.OutputReader
-)
+var key = make([]byte, 32)
 
 func init() {
 	rand.Read(key)
-
-	var err error
-	aesecb, err = aes.NewCipher(key)
-	if err != nil {
-		panic(err)
-	}
-
-	xc20p1305, err = chacha20poly1305.NewX(key)
-	if err != nil {
-		panic(err)
-	}
-
-	h := blake3.New(24, key)
-	blake3xof = h.XOF()
 }
 
 func writeWgHsInit(buf []byte) {
-	buf[0] = 1
-	rand.Read(buf[1:wireguardHandshakeInitiationMessageLength])
+	buf[0] = WireGuardMessageTypeHandshakeInitiation
+	clear(buf[1:4])
+	rand.Read(buf[4:wireguardHandshakeInitiationMessageLength])
 }
 
 func writeWgData(buf []byte) {
-	buf[0] = 4
-	rand.Read(buf[1:])
+	buf[0] = WireGuardMessageTypeTransportData
+	clear(buf[1:4])
+	rand.Read(buf[4:])
 }
 
-func BenchmarkZeroOverheadAesEncryptPartialWgHsInit(b *testing.B) {
-	b.SetBytes(maxPacketLength)
+// maxWgDataLength is the length of the longest transport data message that fits in maxPacketLength.
+const maxWgDataLength = maxPacketLength
 
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf)
-
-	for b.Loop() {
-		aesecb.Encrypt(buf[:16], buf[:16])
-	}
-}
-
-func BenchmarkZeroOverheadAesEncryptPartialWgHsInitRandomPadding(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf)
-
-	for b.Loop() {
-		aesecb.Encrypt(buf[:16], buf[:16])
-
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		rand.Read(buf[wireguardHandshakeInitiationMessageLength : wireguardHandshakeInitiationMessageLength+paddingLen])
+func benchmarkZeroOverheadEncrypt(b *testing.B, padding PaddingSource, wg []byte) {
+	h, err := ZeroOverheadConfig{
+		PSK:             key,
+		Padding:         padding,
+		MaxPacketLength: maxPacketLength,
+	}.NewHandler()
+	if err != nil {
+		b.Fatal(err)
 	}
-}
 
-func BenchmarkZeroOverheadAesEncryptPartialWgHsInitBlake3KeyedHashPadding(b *testing.B) {
 	b.SetBytes(maxPacketLength)
 
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf)
+	buf := make([]byte, 0, maxPacketLength)
 
 	for b.Loop() {
-		aesecb.Encrypt(buf[:16], buf[:16])
-
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		_, err := blake3xof.Read(buf[wireguardHandshakeInitiationMessageLength : wireguardHandshakeInitiationMessageLength+paddingLen])
-		if err != nil {
+		if _, err = h.Encrypt(buf, wg); err != nil {
 			b.Fatal(err)
 		}
 	}
 }
 
-func BenchmarkZeroOverheadAesEncryptPartialWgData(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	writeWgData(buf)
-
-	for b.Loop() {
-		aesecb.Encrypt(buf[:16], buf[:16])
-	}
-}
-
-func BenchmarkParanoidXChaCha20Poly1305EncryptPartialWgHsInitRandomNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
+func BenchmarkZeroOverheadAesEncryptPartialWgHsInit(b *testing.B) {
 	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
 	writeWgHsInit(wg)
-
-	for b.Loop() {
-		validLen := chacha20poly1305.NonceSizeX + wireguardHandshakeInitiationMessageLength + chacha20poly1305.Overhead
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Copy plaintext after 16 bytes
-		copy(buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:], wg[16:])
-
-		// Seal first 16 bytes
-		xc20p1305.Seal(nonce, nonce, wg[:16], buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:validLen])
-	}
+	benchmarkZeroOverheadEncrypt(b, PaddingNone, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptPartialWgHsInitBlake3KeyedHashNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
+func BenchmarkZeroOverheadAesEncryptPartialWgHsInitRandomPadding(b *testing.B) {
 	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
 	writeWgHsInit(wg)
-
-	for b.Loop() {
-		validLen := chacha20poly1305.NonceSizeX + wireguardHandshakeInitiationMessageLength + chacha20poly1305.Overhead
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
-			b.Fatal(err)
-		}
-
-		// Copy plaintext after 16 bytes
-		copy(buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:], wg[16:])
-
-		// Seal first 16 bytes
-		xc20p1305.Seal(nonce, nonce, wg[:16], buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:validLen])
-	}
+	benchmarkZeroOverheadEncrypt(b, PaddingRandom, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptPartialWgHsInitRandomPadding(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
+func BenchmarkZeroOverheadAesEncryptPartialWgHsInitBlake3KeyedHashPadding(b *testing.B) {
 	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
 	writeWgHsInit(wg)
-
-	for b.Loop() {
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		validLen := chacha20poly1305.NonceSizeX + wireguardHandshakeInitiationMessageLength + chacha20poly1305.Overhead
-		totalLen := validLen + paddingLen
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-		padding := buf[validLen:totalLen]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Copy plaintext after 16 bytes
-		copy(buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:], wg[16:])
-
-		// Add padding
-		rand.Read(padding)
-
-		// Seal first 16 bytes
-		xc20p1305.Seal(nonce, nonce, wg[:16], buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:totalLen])
-	}
+	benchmarkZeroOverheadEncrypt(b, PaddingBlake3, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptPartialWgHsInitBlake3KeyedHashPadding(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
-	writeWgHsInit(wg)
-
-	for b.Loop() {
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		validLen := chacha20poly1305.NonceSizeX + wireguardHandshakeInitiationMessageLength + chacha20poly1305.Overhead
-		totalLen := validLen + paddingLen
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-		padding := buf[validLen:totalLen]
-
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
-			b.Fatal(err)
-		}
-
-		// Copy plaintext after 16 bytes
-		copy(buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:], wg[16:])
-
-		// Add padding
-		_, err = blake3xof.Read(padding)
-		if err != nil {
-			b.Fatal(err)
-		}
-
-		// Seal first 16 bytes
-		xc20p1305.Seal(nonce, nonce, wg[:16], buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:totalLen])
-	}
+func BenchmarkZeroOverheadAesEncryptPartialWgData(b *testing.B) {
+	wg := make([]byte, maxWgDataLength)
+	writeWgData(wg)
+	benchmarkZeroOverheadEncrypt(b, PaddingNone, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgHsInitRandomNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
+// maxParanoidWgDataLength is the length of the longest transport data message
+// that fits in maxPacketLength after paranoid encryption.
+const maxParanoidWgDataLength = maxPacketLength - ParanoidOverhead
 
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf[chacha20poly1305.NonceSizeX:])
+// paranoidUnpaddedWgHsInitPacketLength is the maximum packet length that leaves
+// no room for padding a handshake initiation message.
+const paranoidUnpaddedWgHsInitPacketLength = wireguardHandshakeInitiationMessageLength + ParanoidOverhead
 
-	for b.Loop() {
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+wireguardHandshakeInitiationMessageLength], nil)
+func newBenchmarkParanoidHandler(b *testing.B, maxPacketLength int) *ParanoidHandler {
+	h, err := ParanoidConfig{
+		PSK:             key,
+		MaxPacketLength: maxPacketLength,
+	}.NewHandler()
+	if err != nil {
+		b.Fatal(err)
 	}
+	return h
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgHsInitBlake3KeyedHashNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
+func benchmarkParanoidEncrypt(b *testing.B, maxPacketLength int, wg []byte) {
+	h := newBenchmarkParanoidHandler(b, maxPacketLength)
 
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf[chacha20poly1305.NonceSizeX:])
+	b.SetBytes(int64(len(wg)))
 
-	for b.Loop() {
-		nonce := buf[:chacha20poly1305.NonceSizeX]
+	buf := make([]byte, 0, maxPacketLength)
 
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
+	for b.Loop() {
+		if _, err := h.Encrypt(buf, wg); err != nil {
 			b.Fatal(err)
 		}
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+wireguardHandshakeInitiationMessageLength], nil)
 	}
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgHsInitRandomPadding(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf[chacha20poly1305.NonceSizeX:])
-
-	for b.Loop() {
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		validLen := chacha20poly1305.NonceSizeX + wireguardHandshakeInitiationMessageLength + chacha20poly1305.Overhead
-		totalLen := validLen + paddingLen
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-		padding := buf[validLen:totalLen]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Add padding
-		rand.Read(padding)
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+wireguardHandshakeInitiationMessageLength], padding)
+func benchmarkParanoidDecrypt(b *testing.B, maxPacketLength int, wg []byte) {
+	h := newBenchmarkParanoidHandler(b, maxPacketLength)
+	swgpPacket, err := h.Encrypt(nil, wg)
+	if err != nil {
+		b.Fatal(err)
 	}
-}
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgHsInitBlake3KeyedHashPadding(b *testing.B) {
-	b.SetBytes(maxPacketLength)
+	b.SetBytes(int64(len(wg)))
 
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf[chacha20poly1305.NonceSizeX:])
+	buf := make([]byte, len(swgpPacket))
 
 	for b.Loop() {
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		validLen := chacha20poly1305.NonceSizeX + wireguardHandshakeInitiationMessageLength + chacha20poly1305.Overhead
-		totalLen := validLen + paddingLen
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-		padding := buf[validLen:totalLen]
-
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
+		// Decryption is in place, as a relay would do with its receive buffer.
+		copy(buf, swgpPacket)
+		if _, err = h.Decrypt(buf[:0], buf); err != nil {
 			b.Fatal(err)
 		}
-
-		// Add padding
-		_, err = blake3xof.Read(padding)
-		if err != nil {
-			b.Fatal(err)
-		}
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+wireguardHandshakeInitiationMessageLength], padding)
 	}
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgHsInitEncryptPaddingRandomNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf[chacha20poly1305.NonceSizeX:])
-
-	for b.Loop() {
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+wireguardHandshakeInitiationMessageLength+paddingLen], nil)
-	}
+func BenchmarkParanoidXChaCha20Poly1305DecryptWgHsInit(b *testing.B) {
+	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
+	writeWgHsInit(wg)
+	benchmarkParanoidDecrypt(b, maxPacketLength, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgHsInitEncryptPaddingBlake3KeyedHashNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	writeWgHsInit(buf[chacha20poly1305.NonceSizeX:])
-
-	for b.Loop() {
-		paddingLen := mrand.IntN(maxPaddingLength + 1)
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
-			b.Fatal(err)
-		}
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, buf[chacha20poly1305.NonceSizeX:chacha20poly1305.NonceSizeX+wireguardHandshakeInitiationMessageLength+paddingLen], nil)
-	}
+func BenchmarkParanoidXChaCha20Poly1305DecryptWgHsInitNoPadding(b *testing.B) {
+	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
+	writeWgHsInit(wg)
+	benchmarkParanoidDecrypt(b, paranoidUnpaddedWgHsInitPacketLength, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptPartialWgDataRandomNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	wg := make([]byte, maxPacketLength-chacha20poly1305.NonceSizeX-chacha20poly1305.Overhead)
+func BenchmarkParanoidXChaCha20Poly1305DecryptWgKeepalive(b *testing.B) {
+	wg := make([]byte, WireGuardMessageLengthTransportDataMin)
 	writeWgData(wg)
-
-	for b.Loop() {
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Copy wg packet after 16B
-		copy(buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:], wg[16:])
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, wg[:16], buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:chacha20poly1305.NonceSizeX+len(wg)+chacha20poly1305.Overhead])
-	}
+	benchmarkParanoidDecrypt(b, maxPacketLength, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptPartialWgDataBlake3KeyedHashNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	wg := make([]byte, maxPacketLength-chacha20poly1305.NonceSizeX-chacha20poly1305.Overhead)
+func BenchmarkParanoidXChaCha20Poly1305DecryptWgData(b *testing.B) {
+	wg := make([]byte, maxParanoidWgDataLength)
 	writeWgData(wg)
-
-	for b.Loop() {
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
-			b.Fatal(err)
-		}
-
-		// Copy wg packet after 16B
-		copy(buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:], wg[16:])
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, wg[:16], buf[chacha20poly1305.NonceSizeX+16+chacha20poly1305.Overhead:chacha20poly1305.NonceSizeX+len(wg)+chacha20poly1305.Overhead])
-	}
+	benchmarkParanoidDecrypt(b, maxPacketLength, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgDataRandomNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	plaintext := buf[chacha20poly1305.NonceSizeX : maxPacketLength-chacha20poly1305.NonceSizeX-chacha20poly1305.Overhead]
-	writeWgData(plaintext)
-
-	for b.Loop() {
-		nonce := buf[:chacha20poly1305.NonceSizeX]
-
-		// Generate nonce
-		rand.Read(nonce)
-
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, plaintext, nil)
-	}
+func BenchmarkParanoidXChaCha20Poly1305EncryptWgHsInit(b *testing.B) {
+	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
+	writeWgHsInit(wg)
+	benchmarkParanoidEncrypt(b, maxPacketLength, wg)
 }
 
-func BenchmarkParanoidXChaCha20Poly1305EncryptFullWgDataBlake3KeyedHashNonce(b *testing.B) {
-	b.SetBytes(maxPacketLength)
-
-	buf := make([]byte, maxPacketLength)
-	plaintext := buf[chacha20poly1305.NonceSizeX : maxPacketLength-chacha20poly1305.NonceSizeX-chacha20poly1305.Overhead]
-	writeWgData(plaintext)
-
-	for b.Loop() {
-		nonce := buf[:chacha20poly1305.NonceSizeX]
+func BenchmarkParanoidXChaCha20Poly1305EncryptWgHsInitNoPadding(b *testing.B) {
+	wg := make([]byte, wireguardHandshakeInitiationMessageLength)
+	writeWgHsInit(wg)
+	benchmarkParanoidEncrypt(b, paranoidUnpaddedWgHsInitPacketLength, wg)
+}
 
-		// Generate nonce
-		_, err := blake3xof.Read(nonce)
-		if err != nil {
-			b.Fatal(err)
-		}
+func BenchmarkParanoidXChaCha20Poly1305EncryptWgKeepalive(b *testing.B) {
+	wg := make([]byte, WireGuardMessageLengthTransportDataMin)
+	writeWgData(wg)
+	benchmarkParanoidEncrypt(b, maxPacketLength, wg)
+}
 
-		// Seal AEAD
-		xc20p1305.Seal(nonce, nonce, plaintext, nil)
-	}
+func BenchmarkParanoidXChaCha20Poly1305EncryptWgData(b *testing.B) {
+	wg := make([]byte, maxParanoidWgDataLength)
+	writeWgData(wg)
+	benchmarkParanoidEncrypt(b, maxPacketLength, wg)
 }
@@ -0,0 +1,127 @@
+package swgp
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	mrand "math/rand/v2"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// ParanoidOverhead is the number of bytes the paranoid handler adds to each packet, excluding padding.
+const ParanoidOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+// ParanoidConfig is the configuration of a [*ParanoidHandler].
+type ParanoidConfig struct {
+	// PSK is the pre-shared key. It must be [PSKLength] bytes long.
+	PSK []byte
+
+	// MaxPacketLength is the maximum length of an encrypted packet, including padding.
+	// If not positive, [DefaultMaxPacketLength] is used.
+	//
+	// Longer messages are rejected, so it limits the MTU of the WireGuard interfaces behind the handler.
+	// A full-size transport data message is 32 bytes plus the MTU,
+	// and it is encrypted into a packet [ParanoidOverhead] bytes longer.
+	// The default fits a WireGuard MTU of up to 1380 bytes. WireGuard's default MTU of 1420
+	// needs a MaxPacketLength of at least 1492.
+	MaxPacketLength int
+}
+
+// ParanoidHandler encrypts and authenticates whole WireGuard packets with XChaCha20-Poly1305.
+//
+// The wire format is:
+//
+//	+-------------+-------------------------------------------------+
+//	| 24B nonce   | AEAD(WireGuard message || zero padding)         |
+//	+-------------+-------------------------------------------------+
+//
+// The nonce is generated by [crypto/rand]. Nonces from a keyed hash XOF are cheaper,
+// but the XOF would restart from the same state, and repeat the same nonces, every time the process restarts.
+//
+// Handshake messages are padded to a random length, up to the maximum packet length.
+// The padding is encrypted, so it is all zeros and costs nothing to generate.
+// Transport data messages are not padded: they take up the whole plaintext.
+//
+// ParanoidHandler is safe for concurrent use.
+type ParanoidHandler struct {
+	aead            cipher.AEAD
+	maxPacketLength int
+}
+
+// NewHandler returns a new paranoid handler with the config.
+func (cfg ParanoidConfig) NewHandler() (*ParanoidHandler, error) {
+	if len(cfg.PSK) != PSKLength {
+		return nil, PSKLengthError(len(cfg.PSK))
+	}
+
+	aead, err := chacha20poly1305.NewX(cfg.PSK)
+	if err != nil {
+		return nil, err
+	}
+
+	h := ParanoidHandler{
+		aead:            aead,
+		maxPacketLength: cfg.MaxPacketLength,
+	}
+	if h.maxPacketLength <= 0 {
+		h.maxPacketLength = DefaultMaxPacketLength
+	}
+	return &h, nil
+}
+
+// Encrypt implements [Handler.Encrypt].
+//
+// It returns [ErrPacketTooLong] if the encrypted packet would be longer than the maximum packet length.
+func (h *ParanoidHandler) Encrypt(dst, wgPacket []byte) ([]byte, error) {
+	if n, ok := wireguardMessageLength(wgPacket); !ok || n != len(wgPacket) {
+		return nil, ErrMalformedWireGuardMessage
+	}
+
+	maxPlaintextLen := h.maxPacketLength - ParanoidOverhead
+	if len(wgPacket) > maxPlaintextLen {
+		return nil, ErrPacketTooLong
+	}
+
+	plaintextLen := len(wgPacket)
+	if isWireGuardHandshake(wgPacket[0]) {
+		plaintextLen += mrand.IntN(maxPlaintextLen - len(wgPacket) + 1)
+	}
+
+	start := len(dst)
+	dst = slices.Grow(dst, ParanoidOverhead+plaintextLen)
+	dst = dst[:start+chacha20poly1305.NonceSizeX+plaintextLen]
+	nonce := dst[start : start+chacha20poly1305.NonceSizeX]
+	plaintext := dst[start+chacha20poly1305.NonceSizeX:]
+
+	// Move the packet before writing the nonce, as dst may be wgPacket[:0].
+	copy(plaintext, wgPacket)
+	clear(plaintext[len(wgPacket):])
+	rand.Read(nonce)
+
+	return h.aead.Seal(dst[:len(dst)-plaintextLen], nonce, plaintext, nil), nil
+}
+
+// Decrypt implements [Handler.Decrypt].
+//
+// The packet is decrypted in place, so swgpPacket is overwritten even when dst does not alias it.
+// It returns [ErrDecryptionFailed] if the packet fails authentication.
+func (h *ParanoidHandler) Decrypt(dst, swgpPacket []byte) ([]byte, error) {
+	if len(swgpPacket) < ParanoidOverhead+WireGuardMessageLengthTransportDataMin {
+		return nil, ErrPacketTooShort
+	}
+
+	nonce := swgpPacket[:chacha20poly1305.NonceSizeX]
+	ciphertext := swgpPacket[chacha20poly1305.NonceSizeX:]
+
+	plaintext, err := h.aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+
+	n, ok := wireguardMessageLength(plaintext)
+	if !ok {
+		return nil, ErrMalformedWireGuardMessage
+	}
+	return append(dst, plaintext[:n]...), nil
+}
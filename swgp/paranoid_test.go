@@ -0,0 +1,194 @@
+package swgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newTestParanoidHandler(t *testing.T, maxPacketLength int) *ParanoidHandler {
+	t.Helper()
+	h, err := ParanoidConfig{
+		PSK:             key,
+		MaxPacketLength: maxPacketLength,
+	}.NewHandler()
+	if err != nil {
+		t.Fatalf("NewHandler() failed: %v", err)
+	}
+	return h
+}
+
+func TestParanoidHandlerRoundTrip(t *testing.T) {
+	h := newTestParanoidHandler(t, 0)
+
+	for _, c := range testWireGuardMessages() {
+		t.Run(c.name, func(t *testing.T) {
+			prefix := []byte("prefix")
+
+			swgpPacket, err := h.Encrypt(bytes.Clone(prefix), c.msg)
+			if err != nil {
+				t.Fatalf("h.Encrypt() failed: %v", err)
+			}
+			if !bytes.HasPrefix(swgpPacket, prefix) {
+				t.Fatalf("h.Encrypt() overwrote dst")
+			}
+			swgpPacket = swgpPacket[len(prefix):]
+
+			if c.msg[0] == WireGuardMessageTypeTransportData {
+				if want := len(c.msg) + ParanoidOverhead; len(swgpPacket) != want {
+					t.Errorf("len(swgpPacket) = %d, want %d", len(swgpPacket), want)
+				}
+			} else if len(swgpPacket) < len(c.msg)+ParanoidOverhead || len(swgpPacket) > DefaultMaxPacketLength {
+				t.Errorf("len(swgpPacket) = %d, want between %d and %d", len(swgpPacket), len(c.msg)+ParanoidOverhead, DefaultMaxPacketLength)
+			}
+			if bytes.Contains(swgpPacket, c.msg[4:]) {
+				t.Error("the message is not encrypted")
+			}
+
+			wgPacket, err := h.Decrypt(nil, bytes.Clone(swgpPacket))
+			if err != nil {
+				t.Fatalf("h.Decrypt() failed: %v", err)
+			}
+			if !bytes.Equal(wgPacket, c.msg) {
+				t.Errorf("h.Decrypt() = %v, want %v", wgPacket, c.msg)
+			}
+
+			// In place.
+			buf := make([]byte, len(c.msg), DefaultMaxPacketLength)
+			copy(buf, c.msg)
+			buf, err = h.Encrypt(buf[:0], buf)
+			if err != nil {
+				t.Fatalf("h.Encrypt() in place failed: %v", err)
+			}
+			buf, err = h.Decrypt(buf[:0], buf)
+			if err != nil {
+				t.Fatalf("h.Decrypt() in place failed: %v", err)
+			}
+			if !bytes.Equal(buf, c.msg) {
+				t.Errorf("h.Decrypt() in place = %v, want %v", buf, c.msg)
+			}
+		})
+	}
+}
+
+func TestParanoidHandlerMaxPacketLength(t *testing.T) {
+	const maxPacketLength = 256
+	h := newTestParanoidHandler(t, maxPacketLength)
+
+	handshake := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	handshake[0] = WireGuardMessageTypeHandshakeInitiation
+	for range 100 {
+		swgpPacket, err := h.Encrypt(nil, handshake)
+		if err != nil {
+			t.Fatalf("h.Encrypt() failed: %v", err)
+		}
+		if len(swgpPacket) > maxPacketLength {
+			t.Fatalf("len(swgpPacket) = %d, want at most %d", len(swgpPacket), maxPacketLength)
+		}
+	}
+
+	maxData := make([]byte, maxPacketLength-ParanoidOverhead)
+	maxData[0] = WireGuardMessageTypeTransportData
+	if _, err := h.Encrypt(nil, maxData); err != nil {
+		t.Errorf("h.Encrypt(%d bytes) failed: %v", len(maxData), err)
+	}
+
+	tooLong := make([]byte, len(maxData)+1)
+	tooLong[0] = WireGuardMessageTypeTransportData
+	if _, err := h.Encrypt(nil, tooLong); !errors.Is(err, ErrPacketTooLong) {
+		t.Errorf("h.Encrypt(%d bytes) error = %v, want %v", len(tooLong), err, ErrPacketTooLong)
+	}
+}
+
+func TestParanoidHandlerDefaultMaxPacketLength(t *testing.T) {
+	newData := func(mtu int) []byte {
+		b := make([]byte, 32+mtu)
+		b[0] = WireGuardMessageTypeTransportData
+		return b
+	}
+
+	// The largest transport data message that fits is that of a WireGuard MTU of 1380.
+	h := newTestParanoidHandler(t, 0)
+	maxData := newData(1380)
+	if len(maxData) != 1412 {
+		t.Fatalf("len(maxData) = %d, want 1412", len(maxData))
+	}
+	swgpPacket, err := h.Encrypt(nil, maxData)
+	if err != nil {
+		t.Fatalf("h.Encrypt(%d bytes) failed: %v", len(maxData), err)
+	}
+	if len(swgpPacket) > DefaultMaxPacketLength {
+		t.Errorf("len(swgpPacket) = %d, want at most %d", len(swgpPacket), DefaultMaxPacketLength)
+	}
+	tooLong := newData(1381)
+	if _, err = h.Encrypt(nil, tooLong); !errors.Is(err, ErrPacketTooLong) {
+		t.Errorf("h.Encrypt(%d bytes) error = %v, want %v", len(tooLong), err, ErrPacketTooLong)
+	}
+
+	// WireGuard's default MTU of 1420 needs a MaxPacketLength of 1492.
+	defaultMTUData := newData(1420)
+	if _, err = h.Encrypt(nil, defaultMTUData); !errors.Is(err, ErrPacketTooLong) {
+		t.Errorf("h.Encrypt(%d bytes) error = %v, want %v", len(defaultMTUData), err, ErrPacketTooLong)
+	}
+	if _, err = newTestParanoidHandler(t, 1492).Encrypt(nil, defaultMTUData); err != nil {
+		t.Errorf("h.Encrypt(%d bytes) with MaxPacketLength 1492 failed: %v", len(defaultMTUData), err)
+	}
+	if _, err = newTestParanoidHandler(t, 1491).Encrypt(nil, defaultMTUData); !errors.Is(err, ErrPacketTooLong) {
+		t.Errorf("h.Encrypt(%d bytes) with MaxPacketLength 1491 error = %v, want %v", len(defaultMTUData), err, ErrPacketTooLong)
+	}
+}
+
+func TestParanoidHandlerDecryptErrors(t *testing.T) {
+	h := newTestParanoidHandler(t, 0)
+
+	data := make([]byte, WireGuardMessageLengthTransportDataMin)
+	data[0] = WireGuardMessageTypeTransportData
+	swgpPacket, err := h.Encrypt(nil, data)
+	if err != nil {
+		t.Fatalf("h.Encrypt() failed: %v", err)
+	}
+
+	if _, err = h.Decrypt(nil, bytes.Clone(swgpPacket[:len(swgpPacket)-1])); !errors.Is(err, ErrPacketTooShort) {
+		t.Errorf("h.Decrypt(truncated) error = %v, want %v", err, ErrPacketTooShort)
+	}
+
+	for i := range swgpPacket {
+		tampered := bytes.Clone(swgpPacket)
+		tampered[i] ^= 1
+		if _, err = h.Decrypt(nil, tampered); !errors.Is(err, ErrDecryptionFailed) {
+			t.Fatalf("h.Decrypt(tampered at %d) error = %v, want %v", i, err, ErrDecryptionFailed)
+		}
+	}
+
+	otherKey := make([]byte, PSKLength)
+	rand.Read(otherKey)
+	other, err := ParanoidConfig{PSK: otherKey}.NewHandler()
+	if err != nil {
+		t.Fatalf("NewHandler() failed: %v", err)
+	}
+	if _, err = other.Decrypt(nil, bytes.Clone(swgpPacket)); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("other.Decrypt() error = %v, want %v", err, ErrDecryptionFailed)
+	}
+
+	// An authentic packet that does not hold a WireGuard message.
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	rand.Read(nonce)
+	junk := aead.Seal(nonce, nonce, make([]byte, WireGuardMessageLengthTransportDataMin), nil)
+	if _, err = h.Decrypt(nil, junk); !errors.Is(err, ErrMalformedWireGuardMessage) {
+		t.Errorf("h.Decrypt(junk) error = %v, want %v", err, ErrMalformedWireGuardMessage)
+	}
+}
+
+func TestParanoidConfigErrors(t *testing.T) {
+	var pskLengthErr PSKLengthError
+	if _, err := (ParanoidConfig{PSK: key[:16]}).NewHandler(); !errors.As(err, &pskLengthErr) || pskLengthErr != 16 {
+		t.Errorf("NewHandler() error = %v, want %v", err, PSKLengthError(16))
+	}
+}
@@ -0,0 +1,54 @@
+// Package swgp implements obfuscation of WireGuard packets, so that they do not look like WireGuard on the wire.
+package swgp
+
+import (
+	"errors"
+	"strconv"
+)
+
+// DefaultMaxPacketLength is the default maximum length of an obfuscated packet.
+// It is the payload size of a UDP packet over IPv6 with a 1500-byte MTU: 1500 - 40 (IPv6 header) - 8 (UDP header).
+const DefaultMaxPacketLength = 1452
+
+// PSKLength is the length of the pre-shared key of all handlers.
+const PSKLength = 32
+
+var (
+	// ErrPacketTooShort is returned when a packet is too short to be a valid packet.
+	ErrPacketTooShort = errors.New("packet too short")
+
+	// ErrPacketTooLong is returned when an obfuscated packet would exceed the maximum packet length.
+	ErrPacketTooLong = errors.New("packet too long")
+
+	// ErrDecryptionFailed is returned when a packet fails authentication,
+	// either because it was not sent by a peer with the same PSK, or because it was tampered with.
+	ErrDecryptionFailed = errors.New("decryption failed")
+
+	// ErrMalformedWireGuardMessage is returned when a packet is not a valid WireGuard message,
+	// either before obfuscation or after deobfuscation.
+	ErrMalformedWireGuardMessage = errors.New("malformed WireGuard message")
+
+	// ErrBadMAC1 is returned when the mac1 field of a WireGuard handshake message does not match the receiver's public key.
+	ErrBadMAC1 = errors.New("bad WireGuard mac1")
+)
+
+// PSKLengthError is returned when a pre-shared key is not [PSKLength] bytes long.
+type PSKLengthError int
+
+func (e PSKLengthError) Error() string {
+	return "bad PSK length " + strconv.Itoa(int(e)) + ", want " + strconv.Itoa(PSKLength)
+}
+
+// Handler obfuscates WireGuard packets, and deobfuscates them on the other side.
+//
+// Implementations must be safe for concurrent use.
+type Handler interface {
+	// Encrypt obfuscates the WireGuard packet, appends the result to dst, and returns the extended buffer.
+	// dst may be wgPacket[:0] to obfuscate in place, if wgPacket has enough spare capacity.
+	Encrypt(dst, wgPacket []byte) ([]byte, error)
+
+	// Decrypt deobfuscates the packet, appends the WireGuard packet to dst, and returns the extended buffer.
+	// dst may be swgpPacket[:0] to deobfuscate in place.
+	// Implementations may use swgpPacket as scratch space, so its contents are undefined after the call.
+	Decrypt(dst, swgpPacket []byte) ([]byte, error)
+}
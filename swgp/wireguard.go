@@ -0,0 +1,187 @@
+package swgp
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// WireGuard message types.
+const (
+	WireGuardMessageTypeHandshakeInitiation = 1
+	WireGuardMessageTypeHandshakeResponse   = 2
+	WireGuardMessageTypeCookieReply         = 3
+	WireGuardMessageTypeTransportData       = 4
+)
+
+// WireGuard message lengths.
+const (
+	WireGuardMessageLengthHandshakeInitiation = 148
+	WireGuardMessageLengthHandshakeResponse   = 92
+	WireGuardMessageLengthCookieReply         = 64
+
+	// WireGuardMessageLengthTransportDataMin is the length of a keepalive message:
+	// the 16-byte header and the authentication tag of an empty payload.
+	WireGuardMessageLengthTransportDataMin = 32
+)
+
+// wireguardMessageLength returns the length of a WireGuard message, given its first bytes and the length available.
+// Handshake messages have a fixed length, and b may be longer than that, for example when it has padding.
+// Transport data messages take up all of b. Their length need not be a multiple of 16,
+// as WireGuard pads the encapsulated packet to a multiple of 16, but never past the MTU.
+//
+// It returns false if b does not start with a valid message header, or is too short for the message.
+func wireguardMessageLength(b []byte) (int, bool) {
+	if len(b) < 4 {
+		return 0, false
+	}
+	return wireguardMessageLengthFromHeader([4]byte(b), len(b))
+}
+
+// wireguardMessageLengthFromHeader is like [wireguardMessageLength],
+// but takes the 4-byte message header and the length available separately.
+func wireguardMessageLengthFromHeader(header [4]byte, length int) (int, bool) {
+	if header[1] != 0 || header[2] != 0 || header[3] != 0 {
+		return 0, false
+	}
+
+	var n int
+	switch header[0] {
+	case WireGuardMessageTypeHandshakeInitiation:
+		n = WireGuardMessageLengthHandshakeInitiation
+	case WireGuardMessageTypeHandshakeResponse:
+		n = WireGuardMessageLengthHandshakeResponse
+	case WireGuardMessageTypeCookieReply:
+		n = WireGuardMessageLengthCookieReply
+	case WireGuardMessageTypeTransportData:
+		if length < WireGuardMessageLengthTransportDataMin {
+			return 0, false
+		}
+		return length, true
+	default:
+		return 0, false
+	}
+
+	if length < n {
+		return 0, false
+	}
+	return n, true
+}
+
+// isWireGuardHandshake returns whether the message type is one of the fixed-length handshake messages.
+func isWireGuardHandshake(messageType byte) bool {
+	return messageType >= WireGuardMessageTypeHandshakeInitiation && messageType <= WireGuardMessageTypeCookieReply
+}
+
+// WireGuardMessage is the header of a WireGuard message, as parsed by [ParseWireGuardMessage].
+type WireGuardMessage struct {
+	// Type is the message type.
+	Type uint8
+
+	// SenderIndex is the session index chosen by the sender.
+	// Only handshake initiation and response messages have it.
+	SenderIndex uint32
+
+	// ReceiverIndex is the session index chosen by the receiver.
+	// Handshake response, cookie reply, and transport data messages have it.
+	ReceiverIndex uint32
+}
+
+// HasMAC1 returns whether the message carries a mac1 field, that is, whether it is a handshake initiation or response.
+func (m WireGuardMessage) HasMAC1() bool {
+	return m.Type == WireGuardMessageTypeHandshakeInitiation || m.Type == WireGuardMessageTypeHandshakeResponse
+}
+
+// ParseWireGuardMessage parses and validates a whole WireGuard message.
+//
+// It checks the message type, the reserved bytes, and the length:
+// handshake messages must have their exact length, and transport data messages
+// must hold at least a header and an authentication tag.
+// Otherwise, it returns [ErrMalformedWireGuardMessage].
+func ParseWireGuardMessage(b []byte) (WireGuardMessage, error) {
+	if n, ok := wireguardMessageLength(b); !ok || n != len(b) {
+		return WireGuardMessage{}, ErrMalformedWireGuardMessage
+	}
+
+	m := WireGuardMessage{Type: b[0]}
+	switch m.Type {
+	case WireGuardMessageTypeHandshakeInitiation:
+		m.SenderIndex = binary.LittleEndian.Uint32(b[4:])
+	case WireGuardMessageTypeHandshakeResponse:
+		m.SenderIndex = binary.LittleEndian.Uint32(b[4:])
+		m.ReceiverIndex = binary.LittleEndian.Uint32(b[8:])
+	case WireGuardMessageTypeCookieReply, WireGuardMessageTypeTransportData:
+		m.ReceiverIndex = binary.LittleEndian.Uint32(b[4:])
+	}
+	return m, nil
+}
+
+// wireguardMAC1Label is the label hashed with the receiver's public key to derive the mac1 key.
+const wireguardMAC1Label = "mac1----"
+
+// wireguardMACLength is the length of the mac1 and mac2 fields, which are the last 32 bytes of handshake messages.
+const wireguardMACLength = 16
+
+// MAC1Verifier verifies the mac1 field of handshake messages sent to a WireGuard peer.
+//
+// mac1 is a keyed BLAKE2s-128 of the message up to the field, keyed by BLAKE2s-256("mac1----" || public key).
+// Anyone who knows the peer's public key can compute it, so it does not authenticate the sender,
+// but a message with a bad mac1 is certainly not from a WireGuard peer, and would be dropped by the receiver.
+//
+// MAC1Verifier is safe for concurrent use.
+type MAC1Verifier struct {
+	key  [blake2s.Size]byte
+	pool sync.Pool // *mac1State
+}
+
+// mac1State is the reusable state of a mac1 computation.
+type mac1State struct {
+	h   hash.Hash
+	sum [wireguardMACLength]byte
+}
+
+// NewMAC1Verifier returns a verifier for messages sent to the peer with the given 32-byte public key.
+func NewMAC1Verifier(publicKey []byte) (*MAC1Verifier, error) {
+	if len(publicKey) != 32 {
+		return nil, fmt.Errorf("bad public key length %d, want 32", len(publicKey))
+	}
+
+	v := MAC1Verifier{
+		key: blake2s.Sum256(append([]byte(wireguardMAC1Label), publicKey...)),
+	}
+	v.pool.New = func() any {
+		h, err := blake2s.New128(v.key[:])
+		if err != nil {
+			panic(err)
+		}
+		return &mac1State{h: h}
+	}
+	return &v, nil
+}
+
+// Verify checks the mac1 field of the handshake initiation or response message.
+// It returns [ErrMalformedWireGuardMessage] if b is not such a message, or [ErrBadMAC1] if mac1 does not match.
+func (v *MAC1Verifier) Verify(b []byte) error {
+	m, err := ParseWireGuardMessage(b)
+	if err != nil {
+		return err
+	}
+	if !m.HasMAC1() {
+		return ErrMalformedWireGuardMessage
+	}
+
+	mac1Start := len(b) - 2*wireguardMACLength
+	state := v.pool.Get().(*mac1State)
+	state.h.Reset()
+	state.h.Write(b[:mac1Start])
+	ok := subtle.ConstantTimeCompare(state.h.Sum(state.sum[:0]), b[mac1Start:mac1Start+wireguardMACLength]) == 1
+	v.pool.Put(state)
+	if !ok {
+		return ErrBadMAC1
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package swgp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/blake2s"
+)
+
+// newTestHandshake returns a handshake initiation or response with the given indexes,
+// and a valid mac1 for the receiver's public key.
+func newTestHandshake(t testing.TB, messageType byte, senderIndex, receiverIndex uint32, publicKey []byte) []byte {
+	var b []byte
+	switch messageType {
+	case WireGuardMessageTypeHandshakeInitiation:
+		b = newTestWireGuardMessage(messageType, WireGuardMessageLengthHandshakeInitiation)
+		binary.LittleEndian.PutUint32(b[4:], senderIndex)
+	case WireGuardMessageTypeHandshakeResponse:
+		b = newTestWireGuardMessage(messageType, WireGuardMessageLengthHandshakeResponse)
+		binary.LittleEndian.PutUint32(b[4:], senderIndex)
+		binary.LittleEndian.PutUint32(b[8:], receiverIndex)
+	default:
+		t.Fatalf("message type %d is not a handshake initiation or response", messageType)
+	}
+
+	// Compute mac1 as described in the WireGuard whitepaper, section 5.4.4.
+	key := blake2s.Sum256(append([]byte("mac1----"), publicKey...))
+	h, err := blake2s.New128(key[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac1Start := len(b) - 32
+	h.Write(b[:mac1Start])
+	h.Sum(b[:mac1Start])
+	return b
+}
+
+func newTestWireGuardMessage(messageType byte, length int) []byte {
+	b := make([]byte, length)
+	rand.Read(b)
+	b[0] = messageType
+	clear(b[1:4])
+	return b
+}
+
+func TestParseWireGuardMessage(t *testing.T) {
+	cookieReply := newTestWireGuardMessage(WireGuardMessageTypeCookieReply, WireGuardMessageLengthCookieReply)
+	binary.LittleEndian.PutUint32(cookieReply[4:], 0xdeadbeef)
+	transportData := newTestWireGuardMessage(WireGuardMessageTypeTransportData, 1280+WireGuardMessageLengthTransportDataMin)
+	binary.LittleEndian.PutUint32(transportData[4:], 0xcafebabe)
+	// A full-size message for WireGuard's default MTU of 1420 is not a whole number of 16-byte blocks.
+	fullMTUTransportData := newTestWireGuardMessage(WireGuardMessageTypeTransportData, 1420+WireGuardMessageLengthTransportDataMin)
+	binary.LittleEndian.PutUint32(fullMTUTransportData[4:], 0xfeedface)
+
+	for _, c := range [...]struct {
+		name string
+		msg  []byte
+		want WireGuardMessage
+	}{
+		{
+			name: "HandshakeInitiation",
+			msg:  newTestHandshake(t, WireGuardMessageTypeHandshakeInitiation, 0x01020304, 0, make([]byte, 32)),
+			want: WireGuardMessage{Type: WireGuardMessageTypeHandshakeInitiation, SenderIndex: 0x01020304},
+		},
+		{
+			name: "HandshakeResponse",
+			msg:  newTestHandshake(t, WireGuardMessageTypeHandshakeResponse, 0x05060708, 0x01020304, make([]byte, 32)),
+			want: WireGuardMessage{Type: WireGuardMessageTypeHandshakeResponse, SenderIndex: 0x05060708, ReceiverIndex: 0x01020304},
+		},
+		{
+			name: "CookieReply",
+			msg:  cookieReply,
+			want: WireGuardMessage{Type: WireGuardMessageTypeCookieReply, ReceiverIndex: 0xdeadbeef},
+		},
+		{
+			name: "TransportData",
+			msg:  transportData,
+			want: WireGuardMessage{Type: WireGuardMessageTypeTransportData, ReceiverIndex: 0xcafebabe},
+		},
+		{
+			name: "FullMTUTransportData",
+			msg:  fullMTUTransportData,
+			want: WireGuardMessage{Type: WireGuardMessageTypeTransportData, ReceiverIndex: 0xfeedface},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			m, err := ParseWireGuardMessage(c.msg)
+			if err != nil {
+				t.Fatalf("ParseWireGuardMessage() failed: %v", err)
+			}
+			if m != c.want {
+				t.Errorf("ParseWireGuardMessage() = %+v, want %+v", m, c.want)
+			}
+			if got, want := m.HasMAC1(), c.want.Type <= WireGuardMessageTypeHandshakeResponse; got != want {
+				t.Errorf("m.HasMAC1() = %v, want %v", got, want)
+			}
+
+			// Handshake messages have an exact length.
+			if c.want.Type != WireGuardMessageTypeTransportData {
+				for _, n := range [...]int{len(c.msg) - 1, len(c.msg) + 1} {
+					b := append(c.msg[:len(c.msg):len(c.msg)], 0)[:n]
+					if _, err = ParseWireGuardMessage(b); !errors.Is(err, ErrMalformedWireGuardMessage) {
+						t.Errorf("ParseWireGuardMessage(%d bytes) error = %v, want %v", n, err, ErrMalformedWireGuardMessage)
+					}
+				}
+			}
+
+			for i := 1; i < 4; i++ {
+				b := append([]byte(nil), c.msg...)
+				b[i] = 1
+				if _, err = ParseWireGuardMessage(b); !errors.Is(err, ErrMalformedWireGuardMessage) {
+					t.Errorf("ParseWireGuardMessage(reserved byte %d set) error = %v, want %v", i, err, ErrMalformedWireGuardMessage)
+				}
+			}
+		})
+	}
+
+	for _, b := range [...][]byte{
+		nil,
+		{WireGuardMessageTypeTransportData, 0, 0},
+		newTestWireGuardMessage(0, WireGuardMessageLengthTransportDataMin),
+		newTestWireGuardMessage(5, WireGuardMessageLengthTransportDataMin),
+		newTestWireGuardMessage(WireGuardMessageTypeTransportData, 16),
+	} {
+		if _, err := ParseWireGuardMessage(b); !errors.Is(err, ErrMalformedWireGuardMessage) {
+			t.Errorf("ParseWireGuardMessage(%x) error = %v, want %v", b, err, ErrMalformedWireGuardMessage)
+		}
+	}
+}
+
+// wireguardHandshakeInitiationVector is a handshake initiation captured from wireguard-go
+// (golang.zx2c4.com/wireguard v0.0.0-20260522210424-ecfc5a8d5446). It is the first packet sent by a device
+// with the private key 01 02 .. 20 to a peer with the private key 40 41 .. 5f, when a packet was routed to the peer.
+// It has no mac2, as the device had no cookie.
+const (
+	wireguardHandshakeInitiationVector = "01000000c039d62fd31fa67496c507bed4d7e6f8300711cab7ffec43aa6ad794a4b6c52a" +
+		"4466cf0babf25f51b78dddd85ae5e16d6c7a220d13ab20fdd511155c2be1d6591b332b84aaa8bf22df99b2e88876df22" +
+		"17718c99b03e9e7201b97f87c0616ac621aa93419cf98e76659f14899c39a237b28b6760f5206e1f7f762a3a7b96552600" +
+		"000000000000000000000000000000"
+	wireguardHandshakeInitiationVectorPublicKey = "79a631eede1bf9c98f12032cdeadd0e7a079398fc786b88cc846ec89af85a51a"
+)
+
+func TestMAC1VerifierKnownAnswer(t *testing.T) {
+	msg, _ := hex.DecodeString(wireguardHandshakeInitiationVector)
+	publicKey, _ := hex.DecodeString(wireguardHandshakeInitiationVectorPublicKey)
+
+	m, err := ParseWireGuardMessage(msg)
+	if err != nil {
+		t.Fatalf("ParseWireGuardMessage() failed: %v", err)
+	}
+	if want := (WireGuardMessage{Type: WireGuardMessageTypeHandshakeInitiation, SenderIndex: 0x2fd639c0}); m != want {
+		t.Errorf("ParseWireGuardMessage() = %+v, want %+v", m, want)
+	}
+
+	v, err := NewMAC1Verifier(publicKey)
+	if err != nil {
+		t.Fatalf("NewMAC1Verifier() failed: %v", err)
+	}
+	if err = v.Verify(msg); err != nil {
+		t.Errorf("v.Verify() failed: %v", err)
+	}
+
+	msg[len(msg)-33] ^= 1
+	if err = v.Verify(msg); !errors.Is(err, ErrBadMAC1) {
+		t.Errorf("v.Verify(tampered) error = %v, want %v", err, ErrBadMAC1)
+	}
+}
+
+func TestMAC1Verifier(t *testing.T) {
+	publicKey := make([]byte, 32)
+	rand.Read(publicKey)
+	otherPublicKey := make([]byte, 32)
+	rand.Read(otherPublicKey)
+
+	v, err := NewMAC1Verifier(publicKey)
+	if err != nil {
+		t.Fatalf("NewMAC1Verifier() failed: %v", err)
+	}
+
+	for _, messageType := range [...]byte{WireGuardMessageTypeHandshakeInitiation, WireGuardMessageTypeHandshakeResponse} {
+		msg := newTestHandshake(t, messageType, 1, 2, publicKey)
+		if err = v.Verify(msg); err != nil {
+			t.Errorf("v.Verify(type %d) failed: %v", messageType, err)
+		}
+
+		// mac2 is not covered by mac1.
+		msg[len(msg)-1] ^= 1
+		if err = v.Verify(msg); err != nil {
+			t.Errorf("v.Verify(type %d with modified mac2) failed: %v", messageType, err)
+		}
+
+		for _, i := range [...]int{4, len(msg) - 33, len(msg) - 32, len(msg) - 17} {
+			tampered := append([]byte(nil), msg...)
+			tampered[i] ^= 1
+			if err = v.Verify(tampered); !errors.Is(err, ErrBadMAC1) {
+				t.Errorf("v.Verify(type %d tampered at %d) error = %v, want %v", messageType, i, err, ErrBadMAC1)
+			}
+		}
+
+		if err = v.Verify(newTestHandshake(t, messageType, 1, 2, otherPublicKey)); !errors.Is(err, ErrBadMAC1) {
+			t.Errorf("v.Verify(type %d for another peer) error = %v, want %v", messageType, err, ErrBadMAC1)
+		}
+	}
+
+	for _, b := range [...][]byte{
+		newTestWireGuardMessage(WireGuardMessageTypeCookieReply, WireGuardMessageLengthCookieReply),
+		newTestWireGuardMessage(WireGuardMessageTypeTransportData, WireGuardMessageLengthTransportDataMin),
+		newTestWireGuardMessage(WireGuardMessageTypeHandshakeInitiation, WireGuardMessageLengthHandshakeInitiation+1),
+	} {
+		if err = v.Verify(b); !errors.Is(err, ErrMalformedWireGuardMessage) {
+			t.Errorf("v.Verify(type %d, %d bytes) error = %v, want %v", b[0], len(b), err, ErrMalformedWireGuardMessage)
+		}
+	}
+
+	if _, err = NewMAC1Verifier(publicKey[:31]); err == nil {
+		t.Error("NewMAC1Verifier() succeeded with a 31-byte public key")
+	}
+
+	msg := newTestHandshake(t, WireGuardMessageTypeHandshakeInitiation, 1, 0, publicKey)
+	if allocs := testing.AllocsPerRun(100, func() {
+		v.Verify(msg)
+	}); allocs != 0 {
+		t.Errorf("v.Verify() allocs = %v, want 0", allocs)
+	}
+}
+
+func FuzzParseWireGuardMessage(f *testing.F) {
+	f.Add(newTestWireGuardMessage(WireGuardMessageTypeHandshakeInitiation, WireGuardMessageLengthHandshakeInitiation))
+	f.Add(newTestWireGuardMessage(WireGuardMessageTypeHandshakeResponse, WireGuardMessageLengthHandshakeResponse))
+	f.Add(newTestWireGuardMessage(WireGuardMessageTypeCookieReply, WireGuardMessageLengthCookieReply))
+	f.Add(newTestWireGuardMessage(WireGuardMessageTypeTransportData, WireGuardMessageLengthTransportDataMin))
+	f.Add(newTestWireGuardMessage(WireGuardMessageTypeTransportData, WireGuardMessageLengthTransportDataMin+1))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ParseWireGuardMessage(b)
+		if err != nil {
+			return
+		}
+
+		var wantLen int
+		switch m.Type {
+		case WireGuardMessageTypeHandshakeInitiation:
+			wantLen = WireGuardMessageLengthHandshakeInitiation
+		case WireGuardMessageTypeHandshakeResponse:
+			wantLen = WireGuardMessageLengthHandshakeResponse
+		case WireGuardMessageTypeCookieReply:
+			wantLen = WireGuardMessageLengthCookieReply
+		case WireGuardMessageTypeTransportData:
+			if len(b) < WireGuardMessageLengthTransportDataMin {
+				t.Fatalf("ParseWireGuardMessage() accepted %d-byte transport data", len(b))
+			}
+			wantLen = len(b)
+		default:
+			t.Fatalf("ParseWireGuardMessage() accepted message type %d", m.Type)
+		}
+		if len(b) != wantLen {
+			t.Fatalf("ParseWireGuardMessage() accepted %d-byte message of type %d, want %d bytes", len(b), m.Type, wantLen)
+		}
+		if b[1]|b[2]|b[3] != 0 {
+			t.Fatalf("ParseWireGuardMessage() accepted non-zero reserved bytes %x", b[1:4])
+		}
+	})
+}
+
+func BenchmarkParseWireGuardMessage(b *testing.B) {
+	msg := newTestWireGuardMessage(WireGuardMessageTypeTransportData, maxWgDataLength)
+	for b.Loop() {
+		ParseWireGuardMessage(msg)
+	}
+}
+
+func BenchmarkMAC1Verify(b *testing.B) {
+	publicKey := make([]byte, 32)
+	rand.Read(publicKey)
+	v, err := NewMAC1Verifier(publicKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	msg := newTestHandshake(b, WireGuardMessageTypeHandshakeInitiation, 1, 0, publicKey)
+
+	for b.Loop() {
+		if err := v.Verify(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
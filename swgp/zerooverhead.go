@@ -0,0 +1,166 @@
+package swgp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	mrand "math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+
+	"lukechampine.com/blake3"
+)
+
+// PaddingSource is the source of the padding bytes appended to handshake messages.
+type PaddingSource uint8
+
+const (
+	// PaddingNone disables padding.
+	PaddingNone PaddingSource = iota
+
+	// PaddingRandom fills padding with bytes from [crypto/rand].
+	PaddingRandom
+
+	// PaddingBlake3 fills padding with the output of a BLAKE3 XOF keyed by random bytes
+	// drawn from [crypto/rand] when the handler is created.
+	// It is faster than [PaddingRandom], and just as unpredictable to observers,
+	// who cannot tell the padding of two handlers apart, even if they share the PSK.
+	PaddingBlake3
+)
+
+// String returns the name of the padding source.
+func (s PaddingSource) String() string {
+	switch s {
+	case PaddingNone:
+		return "none"
+	case PaddingRandom:
+		return "random"
+	case PaddingBlake3:
+		return "blake3"
+	default:
+		return "PaddingSource(" + strconv.Itoa(int(s)) + ")"
+	}
+}
+
+// ZeroOverheadConfig is the configuration of a [*ZeroOverheadHandler].
+type ZeroOverheadConfig struct {
+	// PSK is the pre-shared key. It must be [PSKLength] bytes long.
+	PSK []byte
+
+	// Padding is the source of the padding appended to handshake messages.
+	// The default is [PaddingNone].
+	Padding PaddingSource
+
+	// MaxPacketLength is the maximum length of a padded packet.
+	// If not positive, [DefaultMaxPacketLength] is used.
+	MaxPacketLength int
+}
+
+// ZeroOverheadHandler obfuscates WireGuard packets without adding any overhead to transport data messages.
+//
+// The first 16 bytes of each message, which hold its type and the sender or receiver index,
+// are encrypted as one AES block with the PSK. The rest of a WireGuard message is already indistinguishable from random.
+// Handshake messages, whose lengths are telling, are padded with a random amount of padding.
+// The padding is removed by the other side, which learns the message length from the decrypted type.
+//
+// ZeroOverheadHandler is safe for concurrent use.
+type ZeroOverheadHandler struct {
+	block           cipher.Block
+	padding         PaddingSource
+	maxPacketLength int
+
+	xofMu sync.Mutex
+	xof   *blake3.OutputReader
+}
+
+// NewHandler returns a new zero-overhead handler with the config.
+func (cfg ZeroOverheadConfig) NewHandler() (*ZeroOverheadHandler, error) {
+	if len(cfg.PSK) != PSKLength {
+		return nil, PSKLengthError(len(cfg.PSK))
+	}
+
+	block, err := aes.NewCipher(cfg.PSK)
+	if err != nil {
+		return nil, err
+	}
+
+	h := ZeroOverheadHandler{
+		block:           block,
+		padding:         cfg.Padding,
+		maxPacketLength: cfg.MaxPacketLength,
+	}
+	if h.maxPacketLength <= 0 {
+		h.maxPacketLength = DefaultMaxPacketLength
+	}
+
+	switch cfg.Padding {
+	case PaddingNone, PaddingRandom:
+	case PaddingBlake3:
+		// Keying the XOF by the PSK would make the padding the same stream for every handler with the PSK.
+		var key [32]byte
+		rand.Read(key[:])
+		h.xof = blake3.New(32, key[:]).XOF()
+	default:
+		return nil, fmt.Errorf("unknown padding source %d", cfg.Padding)
+	}
+
+	return &h, nil
+}
+
+// Encrypt implements [Handler.Encrypt].
+func (h *ZeroOverheadHandler) Encrypt(dst, wgPacket []byte) ([]byte, error) {
+	if n, ok := wireguardMessageLength(wgPacket); !ok || n != len(wgPacket) {
+		return nil, ErrMalformedWireGuardMessage
+	}
+
+	paddingLen := 0
+	if h.padding != PaddingNone && isWireGuardHandshake(wgPacket[0]) && len(wgPacket) < h.maxPacketLength {
+		paddingLen = mrand.IntN(h.maxPacketLength - len(wgPacket) + 1)
+	}
+
+	start := len(dst)
+	dst = slices.Grow(dst, len(wgPacket)+paddingLen)
+	dst = append(dst, wgPacket...)
+	h.block.Encrypt(dst[start:], dst[start:])
+
+	if paddingLen > 0 {
+		end := len(dst)
+		dst = dst[:end+paddingLen]
+		h.fillPadding(dst[end:])
+	}
+	return dst, nil
+}
+
+// fillPadding fills b with padding from the handler's padding source.
+func (h *ZeroOverheadHandler) fillPadding(b []byte) {
+	switch h.padding {
+	case PaddingRandom:
+		rand.Read(b)
+	case PaddingBlake3:
+		h.xofMu.Lock()
+		// The XOF has a practically endless output, so reads never fail.
+		_, _ = h.xof.Read(b)
+		h.xofMu.Unlock()
+	}
+}
+
+// Decrypt implements [Handler.Decrypt].
+func (h *ZeroOverheadHandler) Decrypt(dst, swgpPacket []byte) ([]byte, error) {
+	if len(swgpPacket) < aes.BlockSize {
+		return nil, ErrPacketTooShort
+	}
+
+	var header [aes.BlockSize]byte
+	h.block.Decrypt(header[:], swgpPacket)
+
+	// A wrong PSK or a junk packet almost certainly decrypts to an invalid header.
+	n, ok := wireguardMessageLengthFromHeader([4]byte(header[:]), len(swgpPacket))
+	if !ok {
+		return nil, ErrMalformedWireGuardMessage
+	}
+
+	dst = append(dst, header[:]...)
+	return append(dst, swgpPacket[aes.BlockSize:n]...), nil
+}
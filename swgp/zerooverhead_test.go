@@ -0,0 +1,199 @@
+package swgp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// testWireGuardMessages returns one message of each WireGuard message type, with random content.
+func testWireGuardMessages() []struct {
+	name string
+	msg  []byte
+} {
+	return []struct {
+		name string
+		msg  []byte
+	}{
+		{"HandshakeInitiation", newTestWireGuardMessage(WireGuardMessageTypeHandshakeInitiation, WireGuardMessageLengthHandshakeInitiation)},
+		{"HandshakeResponse", newTestWireGuardMessage(WireGuardMessageTypeHandshakeResponse, WireGuardMessageLengthHandshakeResponse)},
+		{"CookieReply", newTestWireGuardMessage(WireGuardMessageTypeCookieReply, WireGuardMessageLengthCookieReply)},
+		{"Keepalive", newTestWireGuardMessage(WireGuardMessageTypeTransportData, WireGuardMessageLengthTransportDataMin)},
+		{"TransportData", newTestWireGuardMessage(WireGuardMessageTypeTransportData, 1280+WireGuardMessageLengthTransportDataMin)},
+	}
+}
+
+func newTestZeroOverheadHandler(t *testing.T, padding PaddingSource) *ZeroOverheadHandler {
+	t.Helper()
+	h, err := ZeroOverheadConfig{
+		PSK:     key,
+		Padding: padding,
+	}.NewHandler()
+	if err != nil {
+		t.Fatalf("NewHandler() failed: %v", err)
+	}
+	return h
+}
+
+func TestZeroOverheadHandlerRoundTrip(t *testing.T) {
+	for _, padding := range [...]PaddingSource{PaddingNone, PaddingRandom, PaddingBlake3} {
+		t.Run(padding.String(), func(t *testing.T) {
+			h := newTestZeroOverheadHandler(t, padding)
+
+			for _, c := range testWireGuardMessages() {
+				t.Run(c.name, func(t *testing.T) {
+					prefix := []byte("prefix")
+
+					swgpPacket, err := h.Encrypt(bytes.Clone(prefix), c.msg)
+					if err != nil {
+						t.Fatalf("h.Encrypt() failed: %v", err)
+					}
+					if !bytes.HasPrefix(swgpPacket, prefix) {
+						t.Fatalf("h.Encrypt() overwrote dst")
+					}
+					swgpPacket = swgpPacket[len(prefix):]
+
+					switch {
+					case padding == PaddingNone || c.msg[0] == WireGuardMessageTypeTransportData:
+						if len(swgpPacket) != len(c.msg) {
+							t.Errorf("len(swgpPacket) = %d, want %d", len(swgpPacket), len(c.msg))
+						}
+					case len(swgpPacket) < len(c.msg) || len(swgpPacket) > DefaultMaxPacketLength:
+						t.Errorf("len(swgpPacket) = %d, want between %d and %d", len(swgpPacket), len(c.msg), DefaultMaxPacketLength)
+					}
+					if bytes.Equal(swgpPacket[:16], c.msg[:16]) {
+						t.Error("the first block is not encrypted")
+					}
+					if !bytes.Equal(swgpPacket[16:len(c.msg)], c.msg[16:]) {
+						t.Error("the rest of the message is modified")
+					}
+
+					wgPacket, err := h.Decrypt(nil, swgpPacket)
+					if err != nil {
+						t.Fatalf("h.Decrypt() failed: %v", err)
+					}
+					if !bytes.Equal(wgPacket, c.msg) {
+						t.Errorf("h.Decrypt() = %v, want %v", wgPacket, c.msg)
+					}
+
+					// In place.
+					buf := make([]byte, len(c.msg), DefaultMaxPacketLength)
+					copy(buf, c.msg)
+					buf, err = h.Encrypt(buf[:0], buf)
+					if err != nil {
+						t.Fatalf("h.Encrypt() in place failed: %v", err)
+					}
+					buf, err = h.Decrypt(buf[:0], buf)
+					if err != nil {
+						t.Fatalf("h.Decrypt() in place failed: %v", err)
+					}
+					if !bytes.Equal(buf, c.msg) {
+						t.Errorf("h.Decrypt() in place = %v, want %v", buf, c.msg)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestZeroOverheadHandlerFullMTUTransportData(t *testing.T) {
+	// WireGuard pads packets to a multiple of 16, but never past the MTU,
+	// so a full-size data message at the default MTU of 1420 is not a whole number of blocks.
+	msg := newTestWireGuardMessage(WireGuardMessageTypeTransportData, WireGuardMessageLengthTransportDataMin+1420)
+
+	for _, padding := range [...]PaddingSource{PaddingNone, PaddingRandom, PaddingBlake3} {
+		t.Run(padding.String(), func(t *testing.T) {
+			h := newTestZeroOverheadHandler(t, padding)
+
+			swgpPacket, err := h.Encrypt(nil, msg)
+			if err != nil {
+				t.Fatalf("h.Encrypt(%d bytes) failed: %v", len(msg), err)
+			}
+			wgPacket, err := h.Decrypt(nil, swgpPacket)
+			if err != nil {
+				t.Fatalf("h.Decrypt() failed: %v", err)
+			}
+			if !bytes.Equal(wgPacket, msg) {
+				t.Errorf("h.Decrypt() = %x, want %x", wgPacket, msg)
+			}
+		})
+	}
+}
+
+func TestZeroOverheadHandlerBlake3PaddingIsUnique(t *testing.T) {
+	h1 := newTestZeroOverheadHandler(t, PaddingBlake3)
+	h2 := newTestZeroOverheadHandler(t, PaddingBlake3)
+
+	// Handlers with the same PSK must not produce the same padding stream.
+	p1 := make([]byte, 64)
+	p2 := make([]byte, 64)
+	h1.fillPadding(p1)
+	h2.fillPadding(p2)
+	if bytes.Equal(p1, p2) {
+		t.Errorf("two handlers with the same PSK produced the same padding %x", p1)
+	}
+}
+
+func TestZeroOverheadHandlerMalformed(t *testing.T) {
+	h := newTestZeroOverheadHandler(t, PaddingRandom)
+
+	handshake := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	handshake[0] = WireGuardMessageTypeHandshakeInitiation
+
+	for _, c := range [...]struct {
+		name string
+		msg  []byte
+	}{
+		{"Empty", nil},
+		{"UnknownType", []byte{5, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"NonZeroReserved", append([]byte{1, 0, 1, 0}, handshake[4:]...)},
+		{"ShortHandshake", handshake[:WireGuardMessageLengthHandshakeInitiation-1]},
+		{"LongHandshake", append(handshake, 0)},
+		{"ShortTransportData", []byte{4, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := h.Encrypt(nil, c.msg); !errors.Is(err, ErrMalformedWireGuardMessage) {
+				t.Errorf("h.Encrypt() error = %v, want %v", err, ErrMalformedWireGuardMessage)
+			}
+		})
+	}
+
+	swgpPacket, err := h.Encrypt(nil, handshake)
+	if err != nil {
+		t.Fatalf("h.Encrypt() failed: %v", err)
+	}
+
+	if _, err = h.Decrypt(nil, swgpPacket[:15]); !errors.Is(err, ErrPacketTooShort) {
+		t.Errorf("h.Decrypt(15 bytes) error = %v, want %v", err, ErrPacketTooShort)
+	}
+	if _, err = h.Decrypt(nil, swgpPacket[:WireGuardMessageLengthHandshakeInitiation-1]); !errors.Is(err, ErrMalformedWireGuardMessage) {
+		t.Errorf("h.Decrypt(truncated) error = %v, want %v", err, ErrMalformedWireGuardMessage)
+	}
+
+	junk := make([]byte, WireGuardMessageLengthHandshakeInitiation)
+	rand.Read(junk)
+	if _, err = h.Decrypt(nil, junk); !errors.Is(err, ErrMalformedWireGuardMessage) {
+		t.Errorf("h.Decrypt(junk) error = %v, want %v", err, ErrMalformedWireGuardMessage)
+	}
+
+	otherKey := make([]byte, PSKLength)
+	rand.Read(otherKey)
+	other, err := ZeroOverheadConfig{PSK: otherKey}.NewHandler()
+	if err != nil {
+		t.Fatalf("NewHandler() failed: %v", err)
+	}
+	if _, err = other.Decrypt(nil, swgpPacket); !errors.Is(err, ErrMalformedWireGuardMessage) {
+		t.Errorf("other.Decrypt() error = %v, want %v", err, ErrMalformedWireGuardMessage)
+	}
+}
+
+func TestZeroOverheadConfigErrors(t *testing.T) {
+	var pskLengthErr PSKLengthError
+	if _, err := (ZeroOverheadConfig{PSK: key[:16]}).NewHandler(); !errors.As(err, &pskLengthErr) || pskLengthErr != 16 {
+		t.Errorf("NewHandler() error = %v, want %v", err, PSKLengthError(16))
+	}
+	if _, err := (ZeroOverheadConfig{PSK: key, Padding: 255}).NewHandler(); err == nil {
+		t.Error("NewHandler() with unknown padding source succeeded")
+	}
+}